@@ -0,0 +1,203 @@
+package balancer
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type mockEndpoint struct {
+	addr     string
+	weight   uint32
+	inFlight int64
+}
+
+func (m *mockEndpoint) Addr() string {
+	return m.addr
+}
+
+func (m *mockEndpoint) Weight() uint32 {
+	return m.weight
+}
+
+func (m *mockEndpoint) InFlight() int64 {
+	return m.inFlight
+}
+
+func newEndpoints(weights []uint32, inFlights []int64) []Endpoint {
+	res := make([]Endpoint, 0, len(weights))
+	for i, w := range weights {
+		ep := &mockEndpoint{addr: "localhost:" + strconv.Itoa(8081+i), weight: w}
+		if inFlights != nil {
+			ep.inFlight = inFlights[i]
+		}
+		res = append(res, ep)
+	}
+	return res
+}
+
+// countPicks 选 n 次，返回每个地址被选中的次数
+func countPicks(t *testing.T, b Balancer, info Info, n int) map[string]int {
+	res := make(map[string]int, 4)
+	for i := 0; i < n; i++ {
+		ep, err := b.Pick(info)
+		require.NoError(t, err)
+		res[ep.Addr()]++
+	}
+	return res
+}
+
+func TestNoEndpoint(t *testing.T) {
+	testCases := []struct {
+		name string
+		b    Balancer
+	}{
+		{name: "round robin", b: NewRoundRobin()},
+		{name: "weighted random", b: NewWeightedRandom()},
+		{name: "least in flight", b: NewLeastInFlight()},
+		{name: "p2c", b: NewP2C()},
+		{name: "consistent hash", b: NewConsistentHash("user-id")},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := tc.b.Pick(Info{})
+			assert.Equal(t, ErrNoEndpoint, err)
+			// 实例全部下线之后也一样
+			tc.b.Update(newEndpoints([]uint32{1}, nil))
+			_, err = tc.b.Pick(Info{})
+			require.NoError(t, err)
+			tc.b.Update(nil)
+			_, err = tc.b.Pick(Info{})
+			assert.Equal(t, ErrNoEndpoint, err)
+		})
+	}
+}
+
+func TestRoundRobin(t *testing.T) {
+	b := NewRoundRobin()
+	b.Update(newEndpoints([]uint32{1, 1, 1}, nil))
+	var addrs []string
+	for i := 0; i < 4; i++ {
+		ep, err := b.Pick(Info{})
+		require.NoError(t, err)
+		addrs = append(addrs, ep.Addr())
+	}
+	assert.Equal(t, []string{"localhost:8081", "localhost:8082", "localhost:8083", "localhost:8081"}, addrs)
+}
+
+func TestWeightedRandom(t *testing.T) {
+	b := NewWeightedRandom()
+	b.Update(newEndpoints([]uint32{1, 3}, nil))
+	cnt := countPicks(t, b, Info{}, 10000)
+	assert.InDelta(t, 7500, cnt["localhost:8082"], 500)
+}
+
+func TestLeastInFlight(t *testing.T) {
+	b := NewLeastInFlight()
+	b.Update(newEndpoints([]uint32{1, 1, 1}, []int64{3, 1, 2}))
+	cnt := countPicks(t, b, Info{}, 100)
+	assert.Equal(t, map[string]int{"localhost:8082": 100}, cnt)
+
+	// 一样多的时候都有机会被选中
+	b.Update(newEndpoints([]uint32{1, 1}, []int64{0, 0}))
+	cnt = countPicks(t, b, Info{}, 100)
+	assert.Len(t, cnt, 2)
+}
+
+func TestP2C(t *testing.T) {
+	b := NewP2C()
+	b.Update(newEndpoints([]uint32{1, 1, 1}, []int64{0, 5, 10}))
+	cnt := countPicks(t, b, Info{}, 1000)
+	// 调用数最多的实例永远比不过另外一个
+	assert.Zero(t, cnt["localhost:8083"])
+	// 调用数最少的实例只要被抽到就会被选中，大约 2/3 的概率
+	assert.InDelta(t, 667, cnt["localhost:8081"], 100)
+
+	b.Update(newEndpoints([]uint32{1}, []int64{10}))
+	cnt = countPicks(t, b, Info{}, 10)
+	assert.Equal(t, map[string]int{"localhost:8081": 10}, cnt)
+}
+
+func TestConsistentHash(t *testing.T) {
+	b := NewConsistentHash("user-id")
+	endpoints := newEndpoints([]uint32{1, 1, 1}, nil)
+	b.Update(endpoints)
+
+	picked := make(map[string]string, 3000)
+	cnt := make(map[string]int, 3)
+	for i := 0; i < 3000; i++ {
+		key := strconv.Itoa(i)
+		ep, err := b.Pick(Info{Meta: map[string]string{"user-id": key}})
+		require.NoError(t, err)
+		picked[key] = ep.Addr()
+		cnt[ep.Addr()]++
+		// 同样的值总是落到同一个实例
+		ep, err = b.Pick(Info{Meta: map[string]string{"user-id": key}})
+		require.NoError(t, err)
+		assert.Equal(t, picked[key], ep.Addr())
+	}
+	for _, ep := range endpoints {
+		assert.Greater(t, cnt[ep.Addr()], 600, ep.Addr())
+	}
+
+	// 下线一个实例，原来落在其它实例上的值不受影响
+	b.Update(endpoints[:2])
+	for key, addr := range picked {
+		ep, err := b.Pick(Info{Meta: map[string]string{"user-id": key}})
+		require.NoError(t, err)
+		if addr != "localhost:8083" {
+			assert.Equal(t, addr, ep.Addr())
+		}
+	}
+
+	// 没有带元数据的时候随机选择
+	cnt = countPicks(t, b, Info{}, 100)
+	assert.Len(t, cnt, 2)
+
+	// 新增一个实例，变化的 key 只会换到新的实例上
+	b.Update(endpoints)
+	for key := range picked {
+		ep, err := b.Pick(Info{Meta: map[string]string{"user-id": key}})
+		require.NoError(t, err)
+		picked[key] = ep.Addr()
+	}
+	endpoints = append(endpoints, &mockEndpoint{addr: "localhost:8084", weight: 1})
+	b.Update(endpoints)
+	moved := 0
+	for key, addr := range picked {
+		ep, err := b.Pick(Info{Meta: map[string]string{"user-id": key}})
+		require.NoError(t, err)
+		if ep.Addr() != addr {
+			assert.Equal(t, "localhost:8084", ep.Addr())
+			moved++
+		}
+	}
+	// 大约 1/4 的 key 换到了新的实例
+	assert.InDelta(t, 750, moved, 200)
+}
+
+func TestConsistentHashKey(t *testing.T) {
+	b := NewConsistentHash("user-id")
+	b.Update(newEndpoints([]uint32{1, 1, 1}, nil))
+	// 从请求里取出来的 key 优先于元数据
+	want, err := b.Pick(Info{HashKey: "123"})
+	require.NoError(t, err)
+	for i := 0; i < 100; i++ {
+		ep, err := b.Pick(Info{HashKey: "123", Meta: map[string]string{"user-id": strconv.Itoa(i)}})
+		require.NoError(t, err)
+		assert.Equal(t, want, ep)
+	}
+
+	// 权重为 3 的实例分到大约 3/5 的 key
+	b = NewConsistentHash("")
+	b.Update(newEndpoints([]uint32{1, 3, 1}, nil))
+	cnt := make(map[string]int, 3)
+	for i := 0; i < 5000; i++ {
+		ep, err := b.Pick(Info{HashKey: strconv.Itoa(i)})
+		require.NoError(t, err)
+		cnt[ep.Addr()]++
+	}
+	assert.InDelta(t, 3000, cnt["localhost:8082"], 300)
+}
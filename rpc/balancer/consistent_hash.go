@@ -0,0 +1,90 @@
+package balancer
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"math/rand"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// pointsPerWeight 权重为 1 的实例在哈希环上的虚拟节点数，和 ketama 一样是 160
+// 每次 md5 得到 16 个字节，切成 4 个虚拟节点
+const pointsPerWeight = 160
+
+// ConsistentHash ketama 一致性哈希，同样的 key 总是落到同一个实例上，
+// 实例上下线的时候只有原来落在这个实例上的 key 会换到别的实例。
+// key 优先使用 Info.HashKey，也就是从请求里取出来的 key，其次是元数据里 metaKey 对应的值，
+// 都没有的时候随机选择
+type ConsistentHash struct {
+	metaKey string
+
+	mu sync.RWMutex
+	// ring 是排好序的虚拟节点
+	ring      []uint32
+	endpoints map[uint32]Endpoint
+	all       []Endpoint
+}
+
+// NewConsistentHash metaKey 为空的时候只使用从请求里取出来的 key
+func NewConsistentHash(metaKey string) *ConsistentHash {
+	return &ConsistentHash{metaKey: metaKey}
+}
+
+// Update 重新构建哈希环，虚拟节点数和权重成正比
+func (c *ConsistentHash) Update(endpoints []Endpoint) {
+	ring := make([]uint32, 0, len(endpoints)*pointsPerWeight)
+	nodes := make(map[uint32]Endpoint, len(endpoints)*pointsPerWeight)
+	for _, ep := range endpoints {
+		digests := int(ep.Weight()) * pointsPerWeight / 4
+		for i := 0; i < digests; i++ {
+			digest := md5.Sum([]byte(ep.Addr() + "-" + strconv.Itoa(i)))
+			for j := 0; j < 4; j++ {
+				h := binary.LittleEndian.Uint32(digest[j*4:])
+				// 冲突的时候保留先放进去的，endpoints 是排好序的，所以结果是确定的
+				if _, ok := nodes[h]; ok {
+					continue
+				}
+				nodes[h] = ep
+				ring = append(ring, h)
+			}
+		}
+	}
+	sort.Slice(ring, func(i, j int) bool {
+		return ring[i] < ring[j]
+	})
+	c.mu.Lock()
+	c.ring, c.endpoints, c.all = ring, nodes, endpoints
+	c.mu.Unlock()
+}
+
+func (c *ConsistentHash) Pick(info Info) (Endpoint, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if len(c.ring) == 0 {
+		return nil, ErrNoEndpoint
+	}
+	key, ok := info.HashKey, info.HashKey != ""
+	if !ok && c.metaKey != "" {
+		key, ok = info.Meta[c.metaKey]
+	}
+	if !ok {
+		return c.all[rand.Intn(len(c.all))], nil
+	}
+	h := hash(key)
+	// 顺时针找到第一个虚拟节点，超过最后一个的时候回到开头
+	idx := sort.Search(len(c.ring), func(i int) bool {
+		return c.ring[i] >= h
+	})
+	if idx == len(c.ring) {
+		idx = 0
+	}
+	return c.endpoints[c.ring[idx]], nil
+}
+
+// hash 和 ketama 一样取 md5 的前 4 个字节
+func hash(key string) uint32 {
+	digest := md5.Sum([]byte(key))
+	return binary.LittleEndian.Uint32(digest[:4])
+}
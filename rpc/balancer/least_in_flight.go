@@ -0,0 +1,29 @@
+package balancer
+
+import "math/rand"
+
+// LeastInFlight 选择正在进行的调用最少的实例，一样多的时候随机选择
+type LeastInFlight struct {
+	endpointList
+}
+
+func NewLeastInFlight() *LeastInFlight {
+	return &LeastInFlight{}
+}
+
+func (l *LeastInFlight) Pick(info Info) (Endpoint, error) {
+	endpoints := l.list()
+	if len(endpoints) == 0 {
+		return nil, ErrNoEndpoint
+	}
+	// 从随机的位置开始找，避免调用数一样的时候总是选中前面的实例
+	start := rand.Intn(len(endpoints))
+	res := endpoints[start]
+	for i := 1; i < len(endpoints); i++ {
+		ep := endpoints[(start+i)%len(endpoints)]
+		if ep.InFlight() < res.InFlight() {
+			res = ep
+		}
+	}
+	return res, nil
+}
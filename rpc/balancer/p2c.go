@@ -0,0 +1,31 @@
+package balancer
+
+import "math/rand"
+
+// P2C 随机选两个实例，取正在进行的调用少的那个
+// 效果接近 LeastInFlight，但是不用遍历所有的实例
+type P2C struct {
+	endpointList
+}
+
+func NewP2C() *P2C {
+	return &P2C{}
+}
+
+func (p *P2C) Pick(info Info) (Endpoint, error) {
+	endpoints := p.list()
+	switch len(endpoints) {
+	case 0:
+		return nil, ErrNoEndpoint
+	case 1:
+		return endpoints[0], nil
+	}
+	i := rand.Intn(len(endpoints))
+	// j 和 i 一定不同
+	j := (i + 1 + rand.Intn(len(endpoints)-1)) % len(endpoints)
+	a, b := endpoints[i], endpoints[j]
+	if b.InFlight() < a.InFlight() {
+		return b, nil
+	}
+	return a, nil
+}
@@ -0,0 +1,22 @@
+package balancer
+
+import "sync/atomic"
+
+// RoundRobin 按顺序轮流选择，不考虑权重
+type RoundRobin struct {
+	endpointList
+	next atomic.Uint64
+}
+
+func NewRoundRobin() *RoundRobin {
+	return &RoundRobin{}
+}
+
+func (r *RoundRobin) Pick(info Info) (Endpoint, error) {
+	endpoints := r.list()
+	if len(endpoints) == 0 {
+		return nil, ErrNoEndpoint
+	}
+	idx := (r.next.Add(1) - 1) % uint64(len(endpoints))
+	return endpoints[idx], nil
+}
@@ -0,0 +1,54 @@
+package balancer
+
+import (
+	"errors"
+	"sync"
+)
+
+// ErrNoEndpoint 没有可以选择的实例
+var ErrNoEndpoint = errors.New("balancer: 没有可用的实例")
+
+// Endpoint 客户端到一个实例的子连接
+type Endpoint interface {
+	Addr() string
+	// Weight 实例的权重，至少是 1
+	Weight() uint32
+	// InFlight 这个实例上正在进行的调用数
+	InFlight() int64
+}
+
+// Info 一次调用的信息，Meta 包含了用户设置的元数据
+type Info struct {
+	ServiceName string
+	MethodName  string
+	Meta        map[string]string
+	// HashKey 是从请求里取出来的哈希 key，没有的时候为空
+	HashKey string
+}
+
+// Balancer 每次调用的时候选出一个实例
+// 一个 Balancer 只能给一个客户端使用，Update 和 Pick 可能并发调用
+type Balancer interface {
+	// Update 实例列表变化的时候调用，endpoints 按照地址排序
+	Update(endpoints []Endpoint)
+	Pick(info Info) (Endpoint, error)
+}
+
+// endpointList 保存最新的实例列表，各个 Balancer 内嵌它来实现 Update
+type endpointList struct {
+	mu        sync.RWMutex
+	endpoints []Endpoint
+}
+
+func (l *endpointList) Update(endpoints []Endpoint) {
+	l.mu.Lock()
+	l.endpoints = endpoints
+	l.mu.Unlock()
+}
+
+// list 返回的切片不会被修改，Update 的时候整个替换
+func (l *endpointList) list() []Endpoint {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.endpoints
+}
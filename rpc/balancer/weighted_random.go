@@ -0,0 +1,32 @@
+package balancer
+
+import "math/rand"
+
+// WeightedRandom 按照权重随机选择，权重越大被选中的概率越大
+type WeightedRandom struct {
+	endpointList
+}
+
+func NewWeightedRandom() *WeightedRandom {
+	return &WeightedRandom{}
+}
+
+func (w *WeightedRandom) Pick(info Info) (Endpoint, error) {
+	endpoints := w.list()
+	if len(endpoints) == 0 {
+		return nil, ErrNoEndpoint
+	}
+	var total int64
+	for _, ep := range endpoints {
+		total += int64(ep.Weight())
+	}
+	n := rand.Int63n(total)
+	for _, ep := range endpoints {
+		n -= int64(ep.Weight())
+		if n < 0 {
+			return ep, nil
+		}
+	}
+	// 权重在计算的过程中被修改了
+	return endpoints[len(endpoints)-1], nil
+}
@@ -0,0 +1,221 @@
+package breaker
+
+import (
+	"strconv"
+	"sync"
+	"time"
+)
+
+// State 熔断器的状态
+type State int32
+
+const (
+	// Closed 正常放行，统计调用结果
+	Closed State = iota
+	// Open 熔断中，所有调用直接失败，过了 OpenTimeout 之后进入 HalfOpen
+	Open
+	// HalfOpen 放过去少量试探的调用，都成功了就恢复 Closed，有一个失败就回到 Open
+	HalfOpen
+)
+
+func (s State) String() string {
+	switch s {
+	case Closed:
+		return "closed"
+	case Open:
+		return "open"
+	case HalfOpen:
+		return "half-open"
+	}
+	return "State(" + strconv.Itoa(int(s)) + ")"
+}
+
+const (
+	defaultWindow              = 10 * time.Second
+	defaultBuckets             = 10
+	defaultMinRequests         = 20
+	defaultErrorRate           = 0.5
+	defaultConsecutiveFailures = 5
+	defaultOpenTimeout         = 5 * time.Second
+	defaultHalfOpenRequests    = 1
+)
+
+// Config 熔断的条件，零值的字段使用默认值
+// 错误率和连续失败次数任意一个达到阈值都会熔断
+type Config struct {
+	// Window 统计错误率的滑动窗口，默认是 10s，比 Buckets 纳秒还小的时候按照 Buckets 纳秒处理
+	Window time.Duration
+	// Buckets 窗口分成多少个桶，窗口每次滑动一个桶，默认是 10
+	Buckets int
+	// MinRequests 窗口里的调用数达到 MinRequests 之后才看错误率，避免调用很少的时候误判，默认是 20
+	MinRequests int
+	// ErrorRate 窗口里失败的比例达到 ErrorRate 就熔断，默认是 0.5
+	ErrorRate float64
+	// ConsecutiveFailures 连续失败这么多次就熔断，默认是 5
+	ConsecutiveFailures int
+	// OpenTimeout 熔断之后过多久进入半开状态，默认是 5s
+	OpenTimeout time.Duration
+	// HalfOpenRequests 半开状态下最多同时放过去的试探调用数，这么多次调用都成功之后恢复，默认是 1
+	HalfOpenRequests int
+}
+
+func (c Config) withDefaults() Config {
+	if c.Window <= 0 {
+		c.Window = defaultWindow
+	}
+	if c.Buckets <= 0 {
+		c.Buckets = defaultBuckets
+	}
+	// 每个桶至少 1ns，否则计算桶的大小的时候会除以 0
+	c.Window = max(c.Window, time.Duration(c.Buckets))
+	if c.MinRequests <= 0 {
+		c.MinRequests = defaultMinRequests
+	}
+	if c.ErrorRate <= 0 || c.ErrorRate > 1 {
+		c.ErrorRate = defaultErrorRate
+	}
+	if c.ConsecutiveFailures <= 0 {
+		c.ConsecutiveFailures = defaultConsecutiveFailures
+	}
+	if c.OpenTimeout <= 0 {
+		c.OpenTimeout = defaultOpenTimeout
+	}
+	if c.HalfOpenRequests <= 0 {
+		c.HalfOpenRequests = defaultHalfOpenRequests
+	}
+	return c
+}
+
+// Breaker 熔断器，调用之前通过 Allow 判断能不能调用，
+// 允许调用之后必须调用 Success、Failure 或者 Ignore 中的一个告诉熔断器调用的结果
+type Breaker struct {
+	cfg           Config
+	onStateChange func(from, to State)
+	// now 测试的时候替换掉
+	now func() time.Time
+
+	mu    sync.Mutex
+	state State
+	// window 和 consecutive 只在 Closed 状态下统计
+	window      *window
+	consecutive int
+	// openedAt 最近一次进入 Open 的时间
+	openedAt time.Time
+	// probes 和 probeSuccesses 是半开状态下正在进行的和已经成功的试探调用数
+	probes         int
+	probeSuccesses int
+}
+
+// New onStateChange 在状态变化之后调用，可以为 nil
+// 它可能被多个 goroutine 并发调用，不能阻塞
+func New(cfg Config, onStateChange func(from, to State)) *Breaker {
+	cfg = cfg.withDefaults()
+	return &Breaker{
+		cfg:           cfg,
+		onStateChange: onStateChange,
+		now:           time.Now,
+		window:        newWindow(cfg.Window, cfg.Buckets),
+	}
+}
+
+func (b *Breaker) State() State {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+// Allow 返回 false 说明正在熔断，这次调用应该直接失败
+func (b *Breaker) Allow() bool {
+	b.mu.Lock()
+	from := b.state
+	if b.state == Open && b.now().Sub(b.openedAt) >= b.cfg.OpenTimeout {
+		b.setStateLocked(HalfOpen)
+	}
+	var res bool
+	switch b.state {
+	case Closed:
+		res = true
+	case HalfOpen:
+		res = b.probes < b.cfg.HalfOpenRequests
+		if res {
+			b.probes++
+		}
+	}
+	to := b.state
+	b.mu.Unlock()
+	b.notify(from, to)
+	return res
+}
+
+// Success 调用成功
+func (b *Breaker) Success() {
+	b.mu.Lock()
+	from := b.state
+	switch b.state {
+	case Closed:
+		b.consecutive = 0
+		b.window.add(b.now(), false)
+	case HalfOpen:
+		// 进入半开之前发起的调用也算作试探
+		b.probes = max(b.probes-1, 0)
+		b.probeSuccesses++
+		if b.probeSuccesses >= b.cfg.HalfOpenRequests {
+			b.setStateLocked(Closed)
+		}
+	}
+	to := b.state
+	b.mu.Unlock()
+	b.notify(from, to)
+}
+
+// Failure 调用失败
+func (b *Breaker) Failure() {
+	b.mu.Lock()
+	from := b.state
+	switch b.state {
+	case Closed:
+		b.consecutive++
+		now := b.now()
+		b.window.add(now, true)
+		total, failures := b.window.sum(now)
+		if b.consecutive >= b.cfg.ConsecutiveFailures ||
+			(total >= b.cfg.MinRequests && float64(failures) >= b.cfg.ErrorRate*float64(total)) {
+			b.setStateLocked(Open)
+		}
+	case HalfOpen:
+		b.setStateLocked(Open)
+	}
+	to := b.state
+	b.mu.Unlock()
+	b.notify(from, to)
+}
+
+// Ignore 调用的结果不能说明对端的状态，比如调用方自己取消了，只释放半开状态下的试探名额
+func (b *Breaker) Ignore() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == HalfOpen && b.probes > 0 {
+		b.probes--
+	}
+}
+
+// setStateLocked 切换状态的时候清空上一个状态的统计
+func (b *Breaker) setStateLocked(state State) {
+	b.state = state
+	switch state {
+	case Closed:
+		b.window.reset()
+		b.consecutive = 0
+	case Open:
+		b.openedAt = b.now()
+	case HalfOpen:
+		b.probes = 0
+		b.probeSuccesses = 0
+	}
+}
+
+func (b *Breaker) notify(from, to State) {
+	if from != to && b.onStateChange != nil {
+		b.onStateChange(from, to)
+	}
+}
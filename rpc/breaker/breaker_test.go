@@ -0,0 +1,168 @@
+package breaker
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// clock 手动拨动的时钟
+type clock struct {
+	now time.Time
+}
+
+func (c *clock) Now() time.Time {
+	return c.now
+}
+
+func (c *clock) Add(d time.Duration) {
+	c.now = c.now.Add(d)
+}
+
+type transition struct {
+	from, to State
+}
+
+func newTestBreaker(cfg Config) (*Breaker, *clock, *[]transition) {
+	c := &clock{now: time.Unix(1700000000, 0)}
+	var transitions []transition
+	b := New(cfg, func(from, to State) {
+		transitions = append(transitions, transition{from: from, to: to})
+	})
+	b.now = c.Now
+	return b, c, &transitions
+}
+
+func TestConsecutiveFailures(t *testing.T) {
+	b, c, transitions := newTestBreaker(Config{ConsecutiveFailures: 3, OpenTimeout: time.Second})
+	for i := 0; i < 2; i++ {
+		assert.True(t, b.Allow())
+		b.Failure()
+	}
+	// 中间成功一次就重新计数
+	assert.True(t, b.Allow())
+	b.Success()
+	for i := 0; i < 3; i++ {
+		assert.True(t, b.Allow())
+		b.Failure()
+	}
+	assert.Equal(t, Open, b.State())
+	assert.False(t, b.Allow())
+
+	// 过了 OpenTimeout 之后只放过去一个试探的调用
+	c.Add(time.Second)
+	assert.True(t, b.Allow())
+	assert.Equal(t, HalfOpen, b.State())
+	assert.False(t, b.Allow())
+	// 试探失败重新熔断
+	b.Failure()
+	assert.Equal(t, Open, b.State())
+	assert.False(t, b.Allow())
+
+	c.Add(time.Second)
+	assert.True(t, b.Allow())
+	b.Success()
+	assert.Equal(t, Closed, b.State())
+	assert.True(t, b.Allow())
+
+	assert.Equal(t, []transition{
+		{from: Closed, to: Open},
+		{from: Open, to: HalfOpen},
+		{from: HalfOpen, to: Open},
+		{from: Open, to: HalfOpen},
+		{from: HalfOpen, to: Closed},
+	}, *transitions)
+}
+
+func TestErrorRate(t *testing.T) {
+	testCases := []struct {
+		name string
+		// calls 每一秒里成功和失败的调用数
+		calls [][2]int
+
+		wantState State
+	}{
+		{
+			name:      "below min requests",
+			calls:     [][2]int{{0, 4}, {0, 4}},
+			wantState: Closed,
+		},
+		{
+			name:      "below error rate",
+			calls:     [][2]int{{6, 4}, {6, 4}},
+			wantState: Closed,
+		},
+		{
+			name:      "reach error rate",
+			calls:     [][2]int{{6, 4}, {4, 4}, {0, 2}},
+			wantState: Open,
+		},
+		{
+			// 窗口外面的失败不算
+			name:      "expired",
+			calls:     [][2]int{{0, 4}, {}, {}, {}, {}, {10, 0}, {0, 4}},
+			wantState: Closed,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			b, c, _ := newTestBreaker(Config{
+				Window:              5 * time.Second,
+				Buckets:             5,
+				MinRequests:         10,
+				ErrorRate:           0.5,
+				ConsecutiveFailures: 100,
+			})
+			for _, call := range tc.calls {
+				for i := 0; i < call[0]; i++ {
+					assert.True(t, b.Allow())
+					b.Success()
+				}
+				for i := 0; i < call[1]; i++ {
+					assert.True(t, b.Allow())
+					b.Failure()
+				}
+				c.Add(time.Second)
+			}
+			assert.Equal(t, tc.wantState, b.State())
+		})
+	}
+}
+
+func TestTinyWindow(t *testing.T) {
+	// 窗口比桶的个数还小的时候每个桶按照 1ns 计算
+	b, c, _ := newTestBreaker(Config{Window: 5, Buckets: 10, MinRequests: 2, ConsecutiveFailures: 100})
+	assert.Equal(t, 10*time.Nanosecond, b.cfg.Window)
+	for i := 0; i < 2; i++ {
+		assert.True(t, b.Allow())
+		b.Failure()
+		c.Add(time.Nanosecond)
+	}
+	assert.Equal(t, Open, b.State())
+}
+
+func TestHalfOpen(t *testing.T) {
+	b, c, _ := newTestBreaker(Config{ConsecutiveFailures: 1, OpenTimeout: time.Second, HalfOpenRequests: 2})
+	assert.True(t, b.Allow())
+	b.Failure()
+	c.Add(time.Second)
+
+	assert.True(t, b.Allow())
+	assert.True(t, b.Allow())
+	assert.False(t, b.Allow())
+	// 调用方自己取消的调用不算结果，名额还回去
+	b.Ignore()
+	assert.True(t, b.Allow())
+	b.Success()
+	assert.Equal(t, HalfOpen, b.State())
+	b.Success()
+	assert.Equal(t, Closed, b.State())
+}
+
+func TestStateString(t *testing.T) {
+	assert.Equal(t, "closed", Closed.String())
+	assert.Equal(t, "open", Open.String())
+	assert.Equal(t, "half-open", HalfOpen.String())
+	assert.Equal(t, "State(3)", State(3).String())
+}
@@ -0,0 +1,52 @@
+package breaker
+
+import "time"
+
+// window 按时间分桶的滑动窗口，统计最近一段时间的调用数和失败数
+type window struct {
+	size    time.Duration
+	buckets []bucket
+}
+
+type bucket struct {
+	// start 桶对应的时间段的开始，过期的桶在下一次用到的时候清零
+	start    time.Time
+	total    int
+	failures int
+}
+
+func newWindow(size time.Duration, buckets int) *window {
+	return &window{size: size, buckets: make([]bucket, buckets)}
+}
+
+func (w *window) bucketSize() time.Duration {
+	return w.size / time.Duration(len(w.buckets))
+}
+
+func (w *window) add(now time.Time, failed bool) {
+	start := now.Truncate(w.bucketSize())
+	b := &w.buckets[int(start.UnixNano()/int64(w.bucketSize()))%len(w.buckets)]
+	if !b.start.Equal(start) {
+		*b = bucket{start: start}
+	}
+	b.total++
+	if failed {
+		b.failures++
+	}
+}
+
+// sum 返回窗口里的调用数和失败数
+func (w *window) sum(now time.Time) (total, failures int) {
+	oldest := now.Truncate(w.bucketSize()).Add(-w.size)
+	for _, b := range w.buckets {
+		if b.start.After(oldest) {
+			total += b.total
+			failures += b.failures
+		}
+	}
+	return total, failures
+}
+
+func (w *window) reset() {
+	clear(w.buckets)
+}
@@ -3,22 +3,131 @@ package rpc
 import (
 	"context"
 	"errors"
+	"fmt"
 	"net"
 	"reflect"
+	"self_developed_rpc/rpc/balancer"
+	"self_developed_rpc/rpc/breaker"
+	"self_developed_rpc/rpc/compress"
 	"self_developed_rpc/rpc/message"
+	"self_developed_rpc/rpc/registry"
 	"self_developed_rpc/rpc/serialize"
 	"self_developed_rpc/rpc/serialize/json"
+	"self_developed_rpc/rpc/status"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
-
-	"github.com/silenceper/pool"
 )
 
 // InitService 要为 GetById 之类的函数类型的字段赋值
 func (c *Client) InitService(service Service) error {
-	return setStructFunc(service, c, c.serializer)
+	return setStructFunc(service, c.proxy, c.serializer, c.hashKey, c.newStream)
+}
+
+// Call 直接发起一次调用，resp 必须是指针
+// rpcgen 生成的客户端通过它发起调用，不需要反射
+func (c *Client) Call(ctx context.Context, serviceName, methodName string, req, resp any) error {
+	return call(ctx, c.proxy, c.serializer, c.hashKey, serviceName, methodName, req, resp)
+}
+
+// call 序列化请求，通过 p 发起调用，再把响应反序列化到 resp 里面
+// 远端返回错误的时候，如果有响应数据也会反序列化
+func call(ctx context.Context, p Proxy, s serialize.Serialize, hashKey HashKeyFunc,
+	serviceName, methodName string, reqVal, respVal any) error {
+	// 序列化之前取出负载均衡用的哈希 key
+	ctx, err := withHashKey(ctx, hashKey, serviceName, methodName, reqVal)
+	if err != nil {
+		return err
+	}
+	req, err := newRequest(ctx, s, serviceName, methodName, reqVal)
+	if err != nil {
+		return err
+	}
+
+	// resp => eg: Response { data : []byte("{"Msg": "Hello, world"}") }
+	resp, err := p.Invoke(ctx, req)
+	if err != nil {
+		// 这里可能是网络异常
+		return err
+	}
+
+	var retErr error
+	if len(resp.Error) > 0 {
+		// 远端执行返回的错误
+		retErr = status.Unmarshal(resp.Error).Err()
+	}
+
+	if len(resp.Data) > 0 {
+		// 返回值序列化
+		err = s.Decode(resp.Data, respVal)
+		if err != nil {
+			// 序列化出错
+			return err
+		}
+	}
+	return retErr
 }
 
-func setStructFunc(service Service, p Proxy, s serialize.Serialize) error {
+// newRequest 序列化请求数据，带上元数据
+func newRequest(ctx context.Context, s serialize.Serialize,
+	serviceName, methodName string, reqVal any) (*message.Request, error) {
+	// 客户端流和双向流打开的时候没有请求数据
+	var reqData []byte
+	if reqVal != nil {
+		var err error
+		if reqData, err = s.Encode(reqVal); err != nil {
+			return nil, err
+		}
+	}
+
+	// 用户设置的元数据，框架自己用到的 key 不能由用户设置
+	meta := userMeta(ctx)
+	if mode := oneWayOf(ctx); mode != oneWayNone {
+		if meta == nil {
+			meta = make(map[string]string, 1)
+		}
+		meta["one-way"] = string(mode)
+	}
+	if timeout, ok, err := remainingTimeout(ctx); err != nil {
+		return nil, err
+	} else if ok {
+		if meta == nil {
+			meta = make(map[string]string, 1)
+		}
+		meta["timeout"] = timeout
+	}
+
+	req := &message.Request{
+		Serializer:  s.Code(),
+		ServiceName: serviceName,
+		MethodName:  methodName,
+		Data:        reqData,
+		Meta:        meta,
+	}
+
+	req.SetHeadLength()
+	req.SetBodyLength()
+	return req, nil
+}
+
+// remainingTimeout 返回元数据 "timeout" 的值，ctx 没有设置超时的时候 ok 为 false
+// 传剩余时间而不是截止时间点，避免两端时钟不一致
+func remainingTimeout(ctx context.Context) (timeout string, ok bool, err error) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return "", false, nil
+	}
+	remaining := time.Until(deadline)
+	if remaining <= 0 {
+		return "", false, context.DeadlineExceeded
+	}
+	return strconv.FormatInt(int64(remaining), 10), true, nil
+}
+
+func setStructFunc(service Service, p Proxy, s serialize.Serialize, hashKey HashKeyFunc, open streamOpener) error {
 	if service == nil {
 		return errors.New("rpc: 不支持 nil")
 	}
@@ -30,93 +139,222 @@ func setStructFunc(service Service, p Proxy, s serialize.Serialize) error {
 	vOf = vOf.Elem()
 	tOf = tOf.Elem()
 	numField := vOf.NumField()
+	// 先检查所有字段的签名，有问题的话一个字段都不设置
+	var invalid []string
+	for i := 0; i < numField; i++ {
+		fieldTyp := tOf.Field(i)
+		if !vOf.Field(i).CanSet() || fieldTyp.Type.Kind() != reflect.Func {
+			continue
+		}
+		kind, ok := clientFieldKind(fieldTyp.Type)
+		if !ok {
+			invalid = append(invalid, fieldTyp.Name)
+			continue
+		}
+		// 只有普通方法和服务端流有请求，提前检查 hashkey 标签
+		if kind == unary || kind == serverStreaming {
+			if err := hashKeyFieldOf(fieldTyp.Type.In(1).Elem()).err; err != nil {
+				return err
+			}
+		}
+	}
+	if len(invalid) > 0 {
+		return fmt.Errorf("rpc: 服务 %s 的字段 %v 签名不对，必须是 %s",
+			service.Name(), invalid, clientSignatures)
+	}
 	for i := 0; i < numField; i++ {
 		fieldVal := vOf.Field(i)
 		fieldTyp := tOf.Field(i)
 
-		if fieldVal.CanSet() {
-			fn := func(args []reflect.Value) (results []reflect.Value) {
-				//args[0] 是 context.Context
-				//args[1] 是 req（用户的请求数据）
-				ctx := args[0].Interface().(context.Context)
-
-				// Out 对那个Type为函数类型时，第i+1个返回值
-				// eg: GetByIdResp
-				retVal := reflect.New(fieldTyp.Type.Out(0).Elem())
-
-				reqData, err := s.Encode(args[1].Interface())
-				if err != nil {
-					return []reflect.Value{retVal, reflect.ValueOf(err)}
-				}
-
-				var meta map[string]string
-				if isOneWay(ctx) {
-					meta = map[string]string{"one-way": "true"}
-				}
-
-				req := &message.Request{
-					Serializer:  s.Code(),
-					ServiceName: service.Name(),
-					MethodName:  fieldTyp.Name,
-					Data:        reqData,
-					Meta:        meta,
-				}
-
-				req.SetHeadLength()
-				req.SetBodyLength()
-
-				// resp => eg: Response { data : []byte("{"Msg": "Hello, world"}") }
-				resp, err := p.Invoke(ctx, req)
-
-				if err != nil {
-					// 这里可能是网络异常
-					return []reflect.Value{retVal, reflect.ValueOf(err)}
-				}
-
-				var retErr error
-				if len(resp.Error) > 0 {
-					// 远端执行返回的错误
-					retErr = errors.New(string(resp.Error))
-				}
-
-				if len(resp.Data) > 0 {
-					// 返回值序列化
-					err = s.Decode(resp.Data, retVal.Interface())
-					if err != nil {
-						// 序列化出错
-						return []reflect.Value{retVal, reflect.ValueOf(err)}
-					}
-				}
-
-				var retErrVal reflect.Value
-				if retErr == nil {
-					retErrVal = reflect.Zero(reflect.TypeOf(new(error)).Elem())
-				} else {
-					retErrVal = reflect.ValueOf(retErr)
-				}
-
-				return []reflect.Value{retVal, retErrVal}
+		// 只处理函数类型的字段，其它字段跳过
+		if !fieldVal.CanSet() || fieldTyp.Type.Kind() != reflect.Func {
+			continue
+		}
+		if kind, _ := clientFieldKind(fieldTyp.Type); kind != unary {
+			fieldVal.Set(streamFunc(service.Name(), fieldTyp, kind, open))
+			continue
+		}
+		fn := func(args []reflect.Value) (results []reflect.Value) {
+			//args[0] 是 context.Context
+			//args[1] 是 req（用户的请求数据）
+			ctx := args[0].Interface().(context.Context)
+
+			// Out 对那个Type为函数类型时，第i+1个返回值
+			// eg: GetByIdResp
+			retVal := reflect.New(fieldTyp.Type.Out(0).Elem())
+
+			err := call(ctx, p, s, hashKey, service.Name(), fieldTyp.Name, args[1].Interface(), retVal.Interface())
+
+			var retErrVal reflect.Value
+			if err == nil {
+				retErrVal = reflect.Zero(errorType)
+			} else {
+				retErrVal = reflect.ValueOf(err)
 			}
-			fnVal := reflect.MakeFunc(fieldTyp.Type, fn)
-			fieldVal.Set(fnVal)
+
+			return []reflect.Value{retVal, retErrVal}
 		}
+		fnVal := reflect.MakeFunc(fieldTyp.Type, fn)
+		fieldVal.Set(fnVal)
 	}
 	return nil
 }
 
+var errClientClosed = errors.New("rpc: 客户端已关闭")
+
+// defaultCompressThreshold 小于这个大小的数据不压缩，压缩收益抵不过开销
+const defaultCompressThreshold = 1024
+
 type Client struct {
-	pool       pool.Pool
+	// target 是 NewClient 的地址，或者 NewClientWithRegistry 的服务名，只用在错误信息里
+	target string
+	// balancer 每次调用的时候从 subConns 里面选一个
+	balancer balancer.Balancer
+	mu       sync.Mutex
+	// subConns 每个实例一个子连接，通过注册中心发现的服务会跟着注册中心变化
+	subConns map[string]*subConn
+	// stopWatch 停止订阅注册中心
+	stopWatch context.CancelFunc
+	closed    bool
+	// messageId 用于生成请求的 MessageId
+	messageId  uint32
 	serializer serialize.Serialize
+	// compressor 为 nil 时不压缩
+	compressor        compress.Compressor
+	compressThreshold int
+	interceptors      []ClientInterceptor
+	// proxy 是套上了拦截器的 Client
+	proxy Proxy
+	// maxFrameSize 能接收的响应帧的最大长度
+	maxFrameSize uint32
+	// version 允许使用的最高协议版本
+	version uint8
+	// streamWindow 每个流的接收窗口
+	streamWindow uint32
+	// hashKey 为 nil 的时候只使用请求结构体上的 hashkey 标签
+	hashKey HashKeyFunc
+	// retryPolicies 和 idempotent 的 key 是服务名，或者服务名/方法名
+	retryPolicies map[string]RetryPolicy
+	idempotent    map[string]bool
+	retryBudget   *retryBudget
+	// breakerConfig 为 nil 的时候不熔断
+	breakerConfig        *breaker.Config
+	onBreakerStateChange BreakerStateFunc
+}
+
+// breakerFailureCodes 熔断器统计为失败的错误码，其它错误说明实例是正常的，比如参数不对
+var breakerFailureCodes = []status.Code{
+	status.Unavailable, status.DeadlineExceeded, status.ResourceExhausted, status.Internal,
 }
 
 func (c *Client) Invoke(ctx context.Context, req *message.Request) (*message.Response, error) {
+	sc, err := c.pickSubConn(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	b := sc.breakerOf(req.ServiceName, req.MethodName)
+	if b == nil {
+		return c.invoke(ctx, sc, req)
+	}
+	// 熔断的时候不建立连接也不发请求，直接失败
+	if !b.Allow() {
+		return nil, status.Errorf(status.Unavailable, "rpc: 实例 %s 的 %s.%s 已经熔断",
+			sc.addr, req.ServiceName, req.MethodName)
+	}
+	resp, err := c.invoke(ctx, sc, req)
+	switch code := resultCode(resp, err); {
+	case code == status.Canceled:
+		// 调用方自己取消的，不能说明实例有问题
+		b.Ignore()
+	case slices.Contains(breakerFailureCodes, code):
+		b.Failure()
+	default:
+		b.Success()
+	}
+	return resp, err
+}
+
+// invoke 通过选中的实例发起调用
+func (c *Client) invoke(ctx context.Context, sc *subConn, req *message.Request) (*message.Response, error) {
+	cc, err := sc.conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	sc.inFlight.Add(1)
+	defer sc.inFlight.Add(-1)
+	// 按照握手的结果编码
+	req.Version = cc.version
+	req.SetHeadLength()
+	if err = c.compress(cc, req); err != nil {
+		return nil, err
+	}
+	req.MessageId = c.nextMessageId()
 	// rpc通信中 传输需要进行
 	data := message.EncodeReq(req)
-	result, err := c.send(ctx, data)
+	if oneWayOf(ctx) == oneWayFire {
+		// 服务端不会回复，写成功就算调用成功
+		if err = cc.write(ctx, data); err != nil {
+			return nil, err
+		}
+		return &message.Response{
+			MessageId:  req.MessageId,
+			Version:    req.Version,
+			Serializer: req.Serializer,
+		}, nil
+	}
+	resp, err := cc.send(ctx, req.MessageId, data)
 	if err != nil {
 		return nil, err
 	}
-	return message.DecodeResp(result), nil
+	if err = c.decompress(resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// compress 请求数据超过阈值才压缩，否则 Compresser 保持为 0
+func (c *Client) compress(cc *clientConn, req *message.Request) error {
+	data, code, err := c.compressData(cc, req.Data)
+	if err != nil || code == 0 {
+		return err
+	}
+	req.Data = data
+	req.Compresser = code
+	req.SetHeadLength()
+	req.SetBodyLength()
+	return nil
+}
+
+// compressData 返回压缩之后的数据和压缩算法，没有压缩的时候压缩算法为 0
+func (c *Client) compressData(cc *clientConn, data []byte) ([]byte, uint8, error) {
+	if cc.compressor == nil || len(data) < c.compressThreshold {
+		return data, 0, nil
+	}
+	res, err := cc.compressor.Compress(data)
+	if err != nil {
+		return nil, 0, err
+	}
+	return res, cc.compressor.Code(), nil
+}
+
+func (c *Client) decompress(resp *message.Response) error {
+	data, err := c.decompressData(resp.Compresser, resp.Data)
+	if err != nil {
+		return err
+	}
+	resp.Data = data
+	return nil
+}
+
+// decompressData 按照 code 解压服务端返回的数据，code 为 0 表示没有压缩
+func (c *Client) decompressData(code uint8, data []byte) ([]byte, error) {
+	if code == 0 || len(data) == 0 {
+		return data, nil
+	}
+	if c.compressor == nil || c.compressor.Code() != code {
+		return nil, errors.New("rpc: 不支持的压缩算法")
+	}
+	return c.compressor.Decompress(data)
 }
 
 type ClientOptions func(client *Client)
@@ -127,56 +365,343 @@ func ClientWithSerializer(sl serialize.Serialize) ClientOptions {
 	}
 }
 
+// ClientWithCompressor 设置压缩算法，服务端需要通过 Serve.RegisterCompressor 注册同一个算法
+func ClientWithCompressor(c compress.Compressor) ClientOptions {
+	return func(client *Client) {
+		client.compressor = c
+	}
+}
+
+// ClientWithCompressThreshold 请求数据小于 threshold 字节时不压缩
+func ClientWithCompressThreshold(threshold int) ClientOptions {
+	return func(client *Client) {
+		client.compressThreshold = threshold
+	}
+}
+
+// ClientWithInterceptors 添加拦截器，第一个拦截器在最外层
+func ClientWithInterceptors(interceptors ...ClientInterceptor) ClientOptions {
+	return func(client *Client) {
+		client.interceptors = append(client.interceptors, interceptors...)
+	}
+}
+
+// ClientWithMaxFrameSize 设置能接收的响应帧的最大长度，超过之后连接会被关闭
+func ClientWithMaxFrameSize(size uint32) ClientOptions {
+	return func(client *Client) {
+		client.maxFrameSize = size
+	}
+}
+
+// ClientWithProtocolVersion 设置允许使用的最高协议版本，默认是 message.Version1
+// 实际使用的版本由建立连接时的握手决定
+func ClientWithProtocolVersion(version uint8) ClientOptions {
+	return func(client *Client) {
+		client.version = version
+	}
+}
+
+// ClientWithStreamWindow 设置每个流的接收窗口，单位是字节，不能小于 64KB，也不能超过 2GB
+// 窗口越大，服务端在客户端读取之前能推送的数据越多
+func ClientWithStreamWindow(window uint32) ClientOptions {
+	return func(client *Client) {
+		client.streamWindow = streamWindow(window)
+	}
+}
+
+// ClientWithBalancer 设置负载均衡策略，默认是轮询
+// 一个 Balancer 只能给一个客户端使用
+func ClientWithBalancer(b balancer.Balancer) ClientOptions {
+	return func(client *Client) {
+		client.balancer = b
+	}
+}
+
+// ClientWithHashKeyFunc 自定义一致性哈希的 key，配合 balancer.ConsistentHash 使用
+// fn 返回 false 的时候使用请求结构体上标记了 rpc:"hashkey" 的字段
+func ClientWithHashKeyFunc(fn HashKeyFunc) ClientOptions {
+	return func(client *Client) {
+		client.hashKey = fn
+	}
+}
+
+// ClientWithRetryPolicy 设置服务的重试策略，methodNames 为空的时候对服务的所有方法生效，方法上的策略优先
+// 只有通过 ClientWithIdempotent 标记为幂等的方法才会重试，流式调用不会重试
+func ClientWithRetryPolicy(policy RetryPolicy, serviceName string, methodNames ...string) ClientOptions {
+	return func(client *Client) {
+		if client.retryPolicies == nil {
+			client.retryPolicies = make(map[string]RetryPolicy, 4)
+		}
+		policy = policy.withDefaults()
+		for _, key := range methodKeys(serviceName, methodNames) {
+			client.retryPolicies[key] = policy
+		}
+	}
+}
+
+// ClientWithIdempotent 标记幂等的方法，重复调用不会有副作用，methodNames 为空的时候标记服务的所有方法
+func ClientWithIdempotent(serviceName string, methodNames ...string) ClientOptions {
+	return func(client *Client) {
+		if client.idempotent == nil {
+			client.idempotent = make(map[string]bool, 4)
+		}
+		for _, key := range methodKeys(serviceName, methodNames) {
+			client.idempotent[key] = true
+		}
+	}
+}
+
+// ClientWithRetryBudget 限制重试次数不超过调用量的 ratio 倍，burst 是最多能攒下来的重试次数
+// 默认是 0.2 和 10，也就是重试最多占调用量的 20%
+func ClientWithRetryBudget(ratio float64, burst int) ClientOptions {
+	return func(client *Client) {
+		client.retryBudget = newRetryBudget(ratio, burst)
+	}
+}
+
+// BreakerStateFunc 熔断器状态变化的时候调用，addr 是实例的地址，可以用来接入告警
+// 它可能被多个 goroutine 并发调用，不能阻塞
+type BreakerStateFunc func(addr, serviceName, methodName string, from, to breaker.State)
+
+// ClientWithBreaker 给每个实例上的每个方法设置一个熔断器，熔断的时候直接返回 Unavailable，
+// 不会建立连接，也不会发送请求，onStateChange 可以为 nil
+// Unavailable、DeadlineExceeded、ResourceExhausted、Internal 和网络错误算作失败，流式调用不熔断
+func ClientWithBreaker(cfg breaker.Config, onStateChange BreakerStateFunc) ClientOptions {
+	return func(client *Client) {
+		client.breakerConfig = &cfg
+		client.onBreakerStateChange = onStateChange
+	}
+}
+
+// methodKeys methodNames 为空的时候返回服务名，否则返回服务名/方法名
+func methodKeys(serviceName string, methodNames []string) []string {
+	if len(methodNames) == 0 {
+		return []string{serviceName}
+	}
+	res := make([]string, 0, len(methodNames))
+	for _, name := range methodNames {
+		res = append(res, serviceName+"/"+name)
+	}
+	return res
+}
+
 func NewClient(addr string, opts ...ClientOptions) (*Client, error) {
-	p, err := pool.NewChannelPool(&pool.Config{
-		InitialCap:  1,
-		MaxCap:      30,
-		MaxIdle:     10,
-		IdleTimeout: time.Minute,
-		Factory: func() (interface{}, error) {
-			conn, err := net.DialTimeout("tcp", addr, time.Second*3)
-			if err != nil {
-				return nil, err
-			}
-			return conn, nil
-		},
-		Close: func(i interface{}) error {
-			return i.(net.Conn).Close()
-		},
-	})
+	res := newClient(addr, []registry.Instance{{Addr: addr}}, opts)
+	// 先建立一个连接，地址不可用的话尽早暴露出来
+	if _, err := res.subConns[addr].conn(context.Background()); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// NewClientWithInstances 每次调用通过负载均衡从固定的实例列表里选一个，实例的 Name 会被忽略
+// 建立连接推迟到第一次选中实例的时候
+func NewClientWithInstances(instances []registry.Instance, opts ...ClientOptions) (*Client, error) {
+	if len(instances) == 0 {
+		return nil, errors.New("rpc: 实例列表不能为空")
+	}
+	addrs := addrsOf(instances)
+	return newClient(strings.Join(addrs, ","), instances, opts), nil
+}
+
+// registryScheme 是 NewClientWithRegistry 的 target 的前缀
+const registryScheme = "registry:///"
+
+// NewClientWithRegistry 通过注册中心找到服务的地址，target 的格式是 registry:///user-service
+// 实例上下线之后客户端会自动切换，下线的实例上还没结束的请求不受影响
+// 暂时没有实例的话不会返回错误，调用的时候返回 Unavailable
+func NewClientWithRegistry(target string, r registry.Registry, opts ...ClientOptions) (*Client, error) {
+	name, ok := strings.CutPrefix(target, registryScheme)
+	if !ok || name == "" || r == nil {
+		return nil, fmt.Errorf("rpc: 不支持的 target %s，必须是 %s<服务名>", target, registryScheme)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	ch, err := r.Subscribe(ctx, name)
 	if err != nil {
+		cancel()
 		return nil, err
 	}
+	res := newClient(name, <-ch, opts)
+	res.stopWatch = cancel
+	go res.watch(ch)
+	return res, nil
+}
+
+func newClient(target string, instances []registry.Instance, opts []ClientOptions) *Client {
 	res := &Client{
-		pool:       p,
-		serializer: &json.Serializer{},
+		target:            target,
+		subConns:          make(map[string]*subConn, len(instances)),
+		serializer:        &json.Serializer{},
+		compressThreshold: defaultCompressThreshold,
+		maxFrameSize:      defaultMaxFrameSize,
+		version:           message.Version1,
+		streamWindow:      defaultStreamWindow,
 	}
 	for _, opt := range opts {
 		opt(res)
 	}
-	return res, nil
+	if res.balancer == nil {
+		res.balancer = balancer.NewRoundRobin()
+	}
+	var p Proxy = res
+	if len(res.retryPolicies) > 0 {
+		if res.retryBudget == nil {
+			res.retryBudget = newRetryBudget(defaultRetryRatio, defaultRetryBurst)
+		}
+		p = &retrier{p: res, policies: res.retryPolicies, idempotent: res.idempotent, budget: res.retryBudget}
+	}
+	res.proxy = chainClientInterceptors(p, res.interceptors)
+	res.setInstances(instances)
+	return res
+}
+
+// watch 注册中心推送的实例列表替换掉原来的实例
+func (c *Client) watch(ch <-chan []registry.Instance) {
+	for instances := range ch {
+		c.setInstances(instances)
+	}
+}
+
+// setInstances 保留还在列表里的子连接，下线的实例上的连接等调用结束之后关闭
+func (c *Client) setInstances(instances []registry.Instance) {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return
+	}
+	// Balancer 要求按照地址排序，不修改调用方传进来的列表
+	instances = slices.Clone(instances)
+	registry.Sort(instances)
+	subConns := make(map[string]*subConn, len(instances))
+	endpoints := make([]balancer.Endpoint, 0, len(instances))
+	for _, ins := range instances {
+		if _, ok := subConns[ins.Addr]; ok {
+			continue
+		}
+		sc, ok := c.subConns[ins.Addr]
+		if !ok {
+			sc = newSubConn(c, ins.Addr)
+		}
+		sc.setWeight(ins.Weight)
+		subConns[ins.Addr] = sc
+		endpoints = append(endpoints, sc)
+	}
+	var removed []*subConn
+	for addr, sc := range c.subConns {
+		if _, ok := subConns[addr]; !ok {
+			removed = append(removed, sc)
+		}
+	}
+	c.subConns = subConns
+	c.balancer.Update(endpoints)
+	c.mu.Unlock()
+	// 不持有 c.mu，选实例的调用不用等下线的实例
+	for _, sc := range removed {
+		sc.drain()
+	}
+}
+
+func addrsOf(instances []registry.Instance) []string {
+	res := make([]string, 0, len(instances))
+	for _, ins := range instances {
+		res = append(res, ins.Addr)
+	}
+	return res
 }
 
-func (c *Client) send(ctx context.Context, req []byte) ([]byte, error) {
-	val, err := c.pool.Get()
+// nextMessageId 0 留给不对应任何请求的帧使用
+func (c *Client) nextMessageId() uint32 {
+	for {
+		id := atomic.AddUint32(&c.messageId, 1)
+		if id != 0 {
+			return id
+		}
+	}
+}
+
+// pick 通过负载均衡选出这次调用使用的子连接，并且拿到可用的连接
+func (c *Client) pick(ctx context.Context, req *message.Request) (*subConn, *clientConn, error) {
+	sc, err := c.pickSubConn(ctx, req)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
+	}
+	cc, err := sc.conn(ctx)
+	if err != nil {
+		return nil, nil, err
 	}
-	conn := val.(net.Conn)
-	defer func() {
-		_ = c.pool.Put(val)
-	}()
+	return sc, cc, nil
+}
 
-	_, err = conn.Write(req)
+// pickSubConn 通过负载均衡选出子连接，还没有建立连接
+func (c *Client) pickSubConn(ctx context.Context, req *message.Request) (*subConn, error) {
+	c.mu.Lock()
+	closed := c.closed
+	c.mu.Unlock()
+	if closed {
+		return nil, errClientClosed
+	}
+	ep, err := c.balancer.Pick(balancer.Info{
+		ServiceName: req.ServiceName,
+		MethodName:  req.MethodName,
+		Meta:        req.Meta,
+		HashKey:     hashKeyFromCtx(ctx),
+	})
 	if err != nil {
-		return nil, err
+		return nil, status.Errorf(status.Unavailable, "rpc: 服务 %s 没有可用的实例 %v", c.target, err)
 	}
+	return ep.(*subConn), nil
+}
+
+// dialTimeout 建立 TCP 连接的超时时间，ctx 的截止时间更早的话以 ctx 为准
+const dialTimeout = time.Second * 3
 
-	if isOneWay(ctx) {
-		return nil, errors.New("micro: 这是一个 oneway 调用，你不应该处理任何结果")
+// dial 建立连接并且完成握手，ctx 结束的时候放弃
+func (c *Client) dial(ctx context.Context, addr string) (*clientConn, error) {
+	conn, err := (&net.Dialer{Timeout: dialTimeout}).DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, dialErr(ctx, err)
+	}
+	res, err := c.handshake(ctx, conn)
+	if err != nil {
+		_ = conn.Close()
+		return nil, dialErr(ctx, err)
 	}
+	cc := newClientConn(conn, c.maxFrameSize)
+	cc.version = res.Version
+	cc.compressor = c.negotiatedCompressor(res)
+	return cc, nil
+}
 
-	respBs, err := ReadMsg(conn)
+// dialErr 因为 ctx 失败的时候返回 ctx 的错误，调用方拿到的是 DeadlineExceeded 或者 Canceled
+// ctx 的计时器可能比连接上的超时晚一点触发，所以已经过了截止时间的也算超时
+func dialErr(ctx context.Context, err error) error {
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return ctxErr
+	}
+	if deadline, ok := ctx.Deadline(); ok && !time.Now().Before(deadline) {
+		return context.DeadlineExceeded
+	}
+	return err
+}
 
-	return respBs, err
+// Close 关闭所有的连接，还在等待响应的调用会返回错误
+func (c *Client) Close() error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return errClientClosed
+	}
+	c.closed = true
+	if c.stopWatch != nil {
+		c.stopWatch()
+	}
+	subConns := make([]*subConn, 0, len(c.subConns))
+	for _, sc := range c.subConns {
+		subConns = append(subConns, sc)
+	}
+	c.mu.Unlock()
+	for _, sc := range subConns {
+		sc.close(errClientClosed)
+	}
+	return nil
 }
@@ -0,0 +1,270 @@
+package rpc
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"os"
+	"self_developed_rpc/rpc/compress"
+	"self_developed_rpc/rpc/message"
+	"sync"
+	"time"
+)
+
+var errConnClosed = errors.New("rpc: 连接已关闭")
+
+// clientConn 多个请求共享同一个 net.Conn
+// 每个请求带上唯一的 MessageId，读协程按照 MessageId 把响应分发给等待的调用方
+type clientConn struct {
+	conn net.Conn
+	// 只有读协程会用到
+	reader       *bufio.Reader
+	maxFrameSize uint32
+	// 握手选出来的协议版本和压缩算法，compressor 为 nil 表示不压缩
+	version    uint8
+	compressor compress.Compressor
+	// 写需要加锁，否则多个请求的帧会交错在一起
+	// 用缓冲为 1 的 channel 当锁，等锁的调用方可以在 ctx 结束的时候放弃
+	writeMu chan struct{}
+
+	mu      sync.Mutex
+	pending map[uint32]chan *message.Response
+	// streams 是还没有结束的流，key 是流的 id
+	streams map[uint32]*clientStream
+	// err 不为 nil 说明连接已经不可用
+	err error
+	// draining 为 true 说明服务端正在关闭，已经发出去的请求还会有响应，但是不能再发新的请求
+	draining bool
+	// closeWhenIdle 为 true 的时候，最后一个请求或者流结束之后关闭连接
+	closeWhenIdle bool
+}
+
+func newClientConn(conn net.Conn, maxFrameSize uint32) *clientConn {
+	cc := &clientConn{
+		conn:         conn,
+		reader:       bufio.NewReader(conn),
+		maxFrameSize: maxFrameSize,
+		writeMu:      make(chan struct{}, 1),
+		pending:      make(map[uint32]chan *message.Response, 16),
+		streams:      make(map[uint32]*clientStream, 4),
+	}
+	go cc.readLoop()
+	return cc
+}
+
+func (cc *clientConn) readLoop() {
+	for {
+		data, err := ReadMsg(cc.reader, cc.maxFrameSize)
+		if err != nil {
+			cc.close(err)
+			return
+		}
+		if message.IsFrame(data) {
+			f, er := message.DecodeFrame(data)
+			if er != nil {
+				cc.close(er)
+				return
+			}
+			cc.dispatchFrame(f)
+			continue
+		}
+		resp, err := message.DecodeResp(data)
+		if err != nil {
+			cc.close(err)
+			return
+		}
+		cc.mu.Lock()
+		if resp.MessageId == goAwayMessageId {
+			cc.draining = true
+			cc.mu.Unlock()
+			continue
+		}
+		ch, ok := cc.pending[resp.MessageId]
+		delete(cc.pending, resp.MessageId)
+		cc.closeIfIdleLocked()
+		cc.mu.Unlock()
+		// 找不到说明调用方已经不等了，直接丢弃
+		if ok {
+			ch <- resp
+			continue
+		}
+		for _, f := range respToFrames(resp) {
+			cc.dispatchFrame(f)
+		}
+	}
+}
+
+// dispatchFrame 把帧交给对应的流，找不到说明流已经关闭了，直接丢弃
+func (cc *clientConn) dispatchFrame(f *message.Frame) {
+	cc.mu.Lock()
+	cs, ok := cc.streams[f.StreamId]
+	cc.mu.Unlock()
+	if ok && cs.handle(f) {
+		cc.removeStream(f.StreamId)
+	}
+}
+
+// openStream 注册流之后再发送打开流的请求，避免漏掉服务端的帧
+func (cc *clientConn) openStream(ctx context.Context, cs *clientStream, data []byte) error {
+	cc.mu.Lock()
+	if cc.err != nil {
+		cc.mu.Unlock()
+		return cc.err
+	}
+	cc.streams[cs.id] = cs
+	cc.mu.Unlock()
+
+	if err := cc.write(ctx, data); err != nil {
+		cc.removeStream(cs.id)
+		return err
+	}
+	return nil
+}
+
+// removeStream 返回 false 说明流已经被移除了
+func (cc *clientConn) removeStream(id uint32) bool {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	_, ok := cc.streams[id]
+	delete(cc.streams, id)
+	cc.closeIfIdleLocked()
+	return ok
+}
+
+func (cc *clientConn) send(ctx context.Context, messageId uint32, data []byte) (*message.Response, error) {
+	// 缓冲为 1，读协程不会因为调用方提前返回而阻塞
+	ch := make(chan *message.Response, 1)
+	cc.mu.Lock()
+	if cc.err != nil {
+		cc.mu.Unlock()
+		return nil, cc.err
+	}
+	cc.pending[messageId] = ch
+	cc.mu.Unlock()
+
+	if err := cc.write(ctx, data); err != nil {
+		cc.remove(messageId)
+		return nil, err
+	}
+
+	// 读协程是所有请求共享的，不能给它设置单个请求的读超时，这里靠 ctx 放弃等待
+	// 迟到的响应在读协程里找不到调用方，会被丢弃
+	select {
+	case resp, ok := <-ch:
+		if !ok {
+			return nil, cc.closedErr()
+		}
+		return resp, nil
+	case <-ctx.Done():
+		cc.remove(messageId)
+		return nil, ctx.Err()
+	}
+}
+
+// write 按照 ctx 设置写超时，ctx 取消的时候也会中断正在进行的写
+// 前面的写被对端阻塞住的时候，等锁的调用方也会在 ctx 结束的时候返回，不会写出任何数据
+func (cc *clientConn) write(ctx context.Context, data []byte) error {
+	select {
+	case cc.writeMu <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	defer func() {
+		<-cc.writeMu
+	}()
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	deadline, _ := ctx.Deadline()
+	if err := cc.conn.SetWriteDeadline(deadline); err != nil {
+		cc.close(err)
+		return err
+	}
+	interrupted := make(chan struct{})
+	stop := context.AfterFunc(ctx, func() {
+		_ = cc.conn.SetWriteDeadline(time.Now())
+		close(interrupted)
+	})
+	_, err := cc.conn.Write(data)
+	if !stop() {
+		// 等回调执行完，避免它改掉下一次写的超时时间
+		<-interrupted
+	}
+	if err != nil {
+		// 写了一半的帧会破坏后续所有请求，这个连接不能再用了
+		cc.close(err)
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return ctxErr
+		}
+		// 写超时的时候 ctx 的计时器可能还没有触发
+		if errors.Is(err, os.ErrDeadlineExceeded) && !deadline.IsZero() {
+			return context.DeadlineExceeded
+		}
+		return err
+	}
+	return nil
+}
+
+func (cc *clientConn) remove(messageId uint32) {
+	cc.mu.Lock()
+	delete(cc.pending, messageId)
+	cc.closeIfIdleLocked()
+	cc.mu.Unlock()
+}
+
+// drain 不再发送新的请求，已经发出去的请求和流结束之后关闭连接
+// 服务实例从注册中心下线的时候使用
+func (cc *clientConn) drain() {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	cc.draining = true
+	cc.closeWhenIdle = true
+	cc.closeIfIdleLocked()
+}
+
+func (cc *clientConn) closeIfIdleLocked() {
+	if cc.closeWhenIdle && len(cc.pending) == 0 && len(cc.streams) == 0 {
+		cc.closeLocked(errConnClosed)
+	}
+}
+
+// close 关闭连接，并且唤醒所有还在等待响应的调用方
+func (cc *clientConn) close(err error) {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	cc.closeLocked(err)
+}
+
+func (cc *clientConn) closeLocked(err error) {
+	if cc.err != nil {
+		return
+	}
+	if err == nil {
+		err = errConnClosed
+	}
+	cc.err = err
+	_ = cc.conn.Close()
+	for id, ch := range cc.pending {
+		close(ch)
+		delete(cc.pending, id)
+	}
+	for id, cs := range cc.streams {
+		cs.stop()
+		cs.closeRecv(err)
+		cs.closeSend(err)
+		delete(cc.streams, id)
+	}
+}
+
+func (cc *clientConn) closedErr() error {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	return cc.err
+}
+
+func (cc *clientConn) available() bool {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	return cc.err == nil && !cc.draining
+}
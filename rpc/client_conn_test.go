@@ -0,0 +1,190 @@
+package rpc
+
+import (
+	"context"
+	"io"
+	"net"
+	"self_developed_rpc/rpc/message"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClientConnMultiplex(t *testing.T) {
+	const cnt = 10
+	client, server := net.Pipe()
+	// 服务端把请求都读完之后倒序返回，验证响应能按照 MessageId 找到调用方
+	go func() {
+		reqs := make([]*message.Request, 0, cnt)
+		for i := 0; i < cnt; i++ {
+			data, err := ReadMsg(server, 0)
+			if err != nil {
+				return
+			}
+			req, err := message.DecodeReq(data)
+			if err != nil {
+				return
+			}
+			reqs = append(reqs, req)
+		}
+		for i := len(reqs) - 1; i >= 0; i-- {
+			resp := &message.Response{
+				MessageId: reqs[i].MessageId,
+				Data:      reqs[i].Data,
+			}
+			resp.SetHeadLength()
+			resp.SetBodyLength()
+			_, _ = server.Write(message.EncodeResp(resp))
+		}
+	}()
+
+	cc := newClientConn(client, defaultMaxFrameSize)
+	var wg sync.WaitGroup
+	for i := 1; i <= cnt; i++ {
+		wg.Add(1)
+		go func(id uint32) {
+			defer wg.Done()
+			req := &message.Request{
+				MessageId:   id,
+				ServiceName: "user-service",
+				MethodName:  "GetById",
+				Data:        []byte(strconv.Itoa(int(id))),
+			}
+			req.SetHeadLength()
+			req.SetBodyLength()
+			resp, err := cc.send(context.Background(), id, message.EncodeReq(req))
+			require.NoError(t, err)
+			assert.Equal(t, id, resp.MessageId)
+			assert.Equal(t, req.Data, resp.Data)
+		}(uint32(i))
+	}
+	wg.Wait()
+}
+
+func TestClientConnClose(t *testing.T) {
+	client, server := net.Pipe()
+	go func() {
+		// 读到请求之后直接断开连接
+		_, _ = ReadMsg(server, 0)
+		_ = server.Close()
+	}()
+
+	cc := newClientConn(client, defaultMaxFrameSize)
+	req := &message.Request{
+		MessageId:   1,
+		ServiceName: "user-service",
+		MethodName:  "GetById",
+	}
+	req.SetHeadLength()
+	req.SetBodyLength()
+	_, err := cc.send(context.Background(), 1, message.EncodeReq(req))
+	assert.Error(t, err)
+	assert.False(t, cc.available())
+}
+
+func TestClientConnTimeout(t *testing.T) {
+	testCases := []struct {
+		name string
+		// serve 模拟服务端的行为
+		serve func(conn net.Conn)
+
+		wantErr       error
+		wantAvailable bool
+	}{
+		{
+			name: "no response",
+			serve: func(conn net.Conn) {
+				_, _ = ReadMsg(conn, 0)
+			},
+			wantErr: context.DeadlineExceeded,
+			// 只是没有等到响应，连接还能继续用
+			wantAvailable: true,
+		},
+		{
+			name: "write blocked",
+			serve: func(conn net.Conn) {
+				// 不读数据，写会被阻塞
+			},
+			wantErr:       context.DeadlineExceeded,
+			wantAvailable: false,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer server.Close()
+			go tc.serve(server)
+
+			cc := newClientConn(client, defaultMaxFrameSize)
+			req := &message.Request{
+				MessageId:   1,
+				ServiceName: "user-service",
+				MethodName:  "GetById",
+			}
+			req.SetHeadLength()
+			req.SetBodyLength()
+			ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*100)
+			defer cancel()
+			_, err := cc.send(ctx, 1, message.EncodeReq(req))
+			assert.Equal(t, tc.wantErr, err)
+			assert.Equal(t, tc.wantAvailable, cc.available())
+		})
+	}
+}
+
+// deadlineCtx 只有截止时间，永远不会结束，模拟写超时先于 ctx 的计时器触发
+type deadlineCtx struct {
+	context.Context
+	deadline time.Time
+}
+
+func (d deadlineCtx) Deadline() (time.Time, bool) {
+	return d.deadline, true
+}
+
+func TestClientConnWriteDeadline(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	// 服务端不读数据，写会一直阻塞到写超时
+	cc := newClientConn(client, defaultMaxFrameSize)
+	ctx := deadlineCtx{Context: context.Background(), deadline: time.Now().Add(50 * time.Millisecond)}
+	err := cc.write(ctx, []byte("hello"))
+	assert.Equal(t, context.DeadlineExceeded, err)
+}
+
+func TestClientConnWriteWaitLock(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	cc := newClientConn(client, defaultMaxFrameSize)
+	// 服务端不再读数据，前一个写一直占着锁
+	blocked := make(chan error, 1)
+	go func() {
+		blocked <- cc.write(context.Background(), []byte("hello"))
+	}()
+	time.Sleep(time.Millisecond * 50)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*100)
+	defer cancel()
+	start := time.Now()
+	err := cc.write(ctx, []byte("world"))
+	assert.Equal(t, context.DeadlineExceeded, err)
+	assert.Less(t, time.Since(start), time.Millisecond*500)
+	// 没有拿到锁就返回了，连接还是好的
+	assert.True(t, cc.available())
+
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.Equal(t, context.Canceled, cc.write(canceled, []byte("world")))
+
+	// 服务端恢复读之后，前一个写正常完成
+	data := make([]byte, 5)
+	_, err = io.ReadFull(server, data)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(data))
+	require.NoError(t, <-blocked)
+}
@@ -5,8 +5,20 @@ import (
 	"errors"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"net"
+	"self_developed_rpc/rpc/balancer"
+	"self_developed_rpc/rpc/breaker"
+	"self_developed_rpc/rpc/compress/gzip"
+	"self_developed_rpc/rpc/compress/zlib"
+	"self_developed_rpc/rpc/message"
 	"self_developed_rpc/rpc/proto/gen"
+	"self_developed_rpc/rpc/registry"
+	"self_developed_rpc/rpc/registry/memory"
 	"self_developed_rpc/rpc/serialize/proto"
+	"self_developed_rpc/rpc/status"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -22,12 +34,16 @@ func TestInitClientProto(t *testing.T) {
 		err := server.Start("tcp", ":8081")
 		t.Log(err)
 	}()
+	defer func() {
+		_ = server.Shutdown(context.Background())
+	}()
 	time.Sleep(time.Second * 3)
 
 	// 初始化客户端
 	us := &UserService{}
 	client, err := NewClient("localhost:8081", ClientWithSerializer(&proto.Serializer{}))
 	require.NoError(t, err)
+	defer client.Close()
 	err = client.InitService(us)
 	require.NoError(t, err)
 
@@ -54,7 +70,7 @@ func TestInitClientProto(t *testing.T) {
 				service.Err = errors.New("error")
 				service.Msg = ""
 			},
-			wantErr:  errors.New("error"),
+			wantErr:  status.Errorf(status.Unknown, "error"),
 			wantResp: &GetByIdResp{},
 		},
 		{
@@ -63,7 +79,7 @@ func TestInitClientProto(t *testing.T) {
 				service.Err = errors.New("error")
 				service.Msg = "123"
 			},
-			wantErr: errors.New("error"),
+			wantErr: status.Errorf(status.Unknown, "error"),
 			wantResp: &GetByIdResp{
 				Msg: "123",
 			},
@@ -90,15 +106,19 @@ func TestInitClientJSON(t *testing.T) {
 	// 服务端注册方法
 	server.RegisterService(service)
 	go func() {
-		err := server.Start("tcp", ":8081")
+		err := server.Start("tcp", ":8082")
 		t.Log(err)
 	}()
+	defer func() {
+		_ = server.Shutdown(context.Background())
+	}()
 	time.Sleep(time.Second * 3)
 
 	// 初始化客户端
 	us := &UserService{}
-	client, err := NewClient("localhost:8081")
+	client, err := NewClient("localhost:8082")
 	require.NoError(t, err)
+	defer client.Close()
 	err = client.InitService(us)
 	require.NoError(t, err)
 
@@ -125,7 +145,7 @@ func TestInitClientJSON(t *testing.T) {
 				service.Err = errors.New("error")
 				service.Msg = ""
 			},
-			wantErr:  errors.New("error"),
+			wantErr:  status.Errorf(status.Unknown, "error"),
 			wantResp: &GetByIdResp{},
 		},
 		{
@@ -134,7 +154,7 @@ func TestInitClientJSON(t *testing.T) {
 				service.Err = errors.New("error")
 				service.Msg = "123"
 			},
-			wantErr: errors.New("error"),
+			wantErr: status.Errorf(status.Unknown, "error"),
 			wantResp: &GetByIdResp{
 				Msg: "123",
 			},
@@ -156,48 +176,734 @@ func TestInitClientJSON(t *testing.T) {
 func TestInitClientOneWay(t *testing.T) {
 	// 初始化服务端
 	server := NewServer()
-	service := &UserServiceServer{}
+	// 单向调用的业务和后面的调用并发执行，测试过程中不能修改 service
+	service := &UserServiceServer{Msg: "hello, world"}
 	// 服务端注册方法
 	server.RegisterService(service)
 	go func() {
-		err := server.Start("tcp", ":8081")
-		t.Log(err)
+		_ = server.Start("tcp", ":8083")
+	}()
+	defer func() {
+		_ = server.Shutdown(context.Background())
 	}()
 	time.Sleep(time.Second * 3)
 
 	// 初始化客户端
 	us := &UserService{}
-	client, err := NewClient("localhost:8081")
+	client, err := NewClient("localhost:8083")
 	require.NoError(t, err)
+	defer client.Close()
 	err = client.InitService(us)
 	require.NoError(t, err)
+	missing := &missingUserService{}
+	require.NoError(t, client.InitService(missing))
 
 	testCases := []struct {
 		name string
-		mock func()
+		call func(ctx context.Context) (*GetByIdResp, error)
+		ctx  context.Context
 
 		wantErr  error
 		wantResp *GetByIdResp
 	}{
 		{
 			name: "oneway",
+			call: func(ctx context.Context) (*GetByIdResp, error) {
+				return us.GetById(ctx, &GetByIdReq{Id: 123})
+			},
+			ctx: CtxWithOneWay(context.Background()),
+			// 业务的结果和错误都拿不到
+			wantResp: &GetByIdResp{},
+		},
+		{
+			name: "oneway service not found",
+			call: func(ctx context.Context) (*GetByIdResp, error) {
+				return missing.GetById(ctx, &GetByIdReq{Id: 123})
+			},
+			ctx:      CtxWithOneWay(context.Background()),
+			wantResp: &GetByIdResp{},
+		},
+		{
+			name: "ack",
+			call: func(ctx context.Context) (*GetByIdResp, error) {
+				return us.GetById(ctx, &GetByIdReq{Id: 123})
+			},
+			ctx:      CtxWithOneWayAck(context.Background()),
+			wantResp: &GetByIdResp{},
+		},
+		{
+			name: "ack service not found",
+			call: func(ctx context.Context) (*GetByIdResp, error) {
+				return missing.GetById(ctx, &GetByIdReq{Id: 123})
+			},
+			ctx:      CtxWithOneWayAck(context.Background()),
+			wantResp: &GetByIdResp{},
+			wantErr:  status.Errorf(status.NotFound, "micro: 你要调用的服务 missing-user-service 不存在"),
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			resp, er := tc.call(tc.ctx)
+			assert.Equal(t, tc.wantErr, er)
+			assert.Equal(t, tc.wantResp, resp)
+
+			// 单向调用没有留下多余的响应，同一个连接上的下一个调用拿到的是自己的结果
+			resp, er = us.GetById(context.Background(), &GetByIdReq{Id: 123})
+			require.NoError(t, er)
+			assert.Equal(t, &GetByIdResp{Msg: "hello, world"}, resp)
+		})
+	}
+
+}
+
+type missingUserService struct {
+	GetById func(ctx context.Context, req *GetByIdReq) (*GetByIdResp, error)
+}
+
+func (m *missingUserService) Name() string {
+	return "missing-user-service"
+}
+
+func TestInitClientCompress(t *testing.T) {
+	// 初始化服务端
+	server := NewServer(ServerWithCompressThreshold(0))
+	service := &UserServiceServer{}
+	// 服务端注册方法
+	server.RegisterService(service)
+	server.RegisterCompressor(&gzip.Compressor{})
+	go func() {
+		err := server.Start("tcp", ":8084")
+		t.Log(err)
+	}()
+	defer func() {
+		_ = server.Shutdown(context.Background())
+	}()
+	time.Sleep(time.Second * 3)
+
+	testCases := []struct {
+		name string
+		mock func()
+		opts []ClientOptions
+
+		wantErr  error
+		wantResp *GetByIdResp
+	}{
+		{
+			name: "compress",
 			mock: func() {
-				service.Err = errors.New("mock error")
+				service.Err = nil
+				service.Msg = strings.Repeat("hello, world", 100)
+			},
+			opts: []ClientOptions{ClientWithCompressor(&gzip.Compressor{}), ClientWithCompressThreshold(0)},
+			wantResp: &GetByIdResp{
+				Msg: strings.Repeat("hello, world", 100),
+			},
+		},
+		{
+			name: "below threshold",
+			mock: func() {
+				service.Err = nil
 				service.Msg = "hello, world"
 			},
-			wantResp: &GetByIdResp{},
-			wantErr:  errors.New("micro: 这是一个 oneway 调用，你不应该处理任何结果"),
+			opts: []ClientOptions{ClientWithCompressor(&gzip.Compressor{})},
+			wantResp: &GetByIdResp{
+				Msg: "hello, world",
+			},
+		},
+		{
+			// 握手的时候发现服务端不支持，退回到不压缩
+			name: "unsupported compressor",
+			mock: func() {
+				service.Err = nil
+				service.Msg = "hello, world"
+			},
+			opts: []ClientOptions{ClientWithCompressor(&zlib.Compressor{}), ClientWithCompressThreshold(0)},
+			wantResp: &GetByIdResp{
+				Msg: "hello, world",
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.mock()
+			us := &UserService{}
+			client, err := NewClient("localhost:8084", tc.opts...)
+			require.NoError(t, err)
+			defer client.Close()
+			err = client.InitService(us)
+			require.NoError(t, err)
+			resp, er := us.GetById(context.Background(), &GetByIdReq{Id: 123})
+			assert.Equal(t, tc.wantErr, er)
+			assert.Equal(t, tc.wantResp, resp)
+		})
+	}
+}
+
+func TestServeShutdown(t *testing.T) {
+	server := NewServer()
+	server.RegisterService(&sleepService{})
+	startErr := make(chan error, 1)
+	go func() {
+		startErr <- server.Start("tcp", ":8085")
+	}()
+	time.Sleep(time.Second)
+
+	client, err := NewClient("localhost:8085")
+	require.NoError(t, err)
+	defer client.Close()
+	ss := &sleepClient{}
+	require.NoError(t, client.InitService(ss))
+
+	callErr := make(chan error, 1)
+	go func() {
+		resp, er := ss.Sleep(context.Background(), &sleepReq{Duration: time.Millisecond * 500})
+		if er == nil && resp.Duration != time.Millisecond*500 {
+			er = errors.New("unexpected response")
+		}
+		callErr <- er
+	}()
+	time.Sleep(time.Millisecond * 100)
+
+	// 等待正在处理的请求结束
+	err = server.Shutdown(context.Background())
+	require.NoError(t, err)
+	assert.NoError(t, <-callErr)
+	assert.Equal(t, ErrServerClosed, <-startErr)
+
+	// 服务端已经关闭，不能再发起调用
+	_, err = ss.Sleep(context.Background(), &sleepReq{})
+	assert.Error(t, err)
+	assert.Equal(t, ErrServerClosed, server.Shutdown(context.Background()))
+}
+
+func TestServeShutdownTimeout(t *testing.T) {
+	server := NewServer()
+	server.RegisterService(&sleepService{})
+	go func() {
+		_ = server.Start("tcp", ":8086")
+	}()
+	time.Sleep(time.Second)
+
+	client, err := NewClient("localhost:8086")
+	require.NoError(t, err)
+	defer client.Close()
+	ss := &sleepClient{}
+	require.NoError(t, client.InitService(ss))
+
+	callErr := make(chan error, 1)
+	go func() {
+		_, er := ss.Sleep(context.Background(), &sleepReq{Duration: time.Second * 3})
+		callErr <- er
+	}()
+	time.Sleep(time.Millisecond * 100)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*100)
+	defer cancel()
+	err = server.Shutdown(ctx)
+	assert.Equal(t, context.DeadlineExceeded, err)
+	// 超时之后连接被强制关闭
+	assert.Error(t, <-callErr)
+}
+
+func TestClientClose(t *testing.T) {
+	server := NewServer()
+	server.RegisterService(&sleepService{})
+	go func() {
+		_ = server.Start("tcp", ":8087")
+	}()
+	defer func() {
+		_ = server.Shutdown(context.Background())
+	}()
+	time.Sleep(time.Second)
+
+	client, err := NewClient("localhost:8087")
+	require.NoError(t, err)
+	ss := &sleepClient{}
+	require.NoError(t, client.InitService(ss))
+	_, err = ss.Sleep(context.Background(), &sleepReq{})
+	require.NoError(t, err)
+
+	require.NoError(t, client.Close())
+	_, err = ss.Sleep(context.Background(), &sleepReq{})
+	assert.Equal(t, errClientClosed, err)
+}
+
+func TestInitClientVersion(t *testing.T) {
+	server := NewServer()
+	server.RegisterService(&metaService{})
+	go func() {
+		_ = server.Start("tcp", ":8088")
+	}()
+	defer func() {
+		_ = server.Shutdown(context.Background())
+	}()
+	time.Sleep(time.Second)
+
+	testCases := []struct {
+		name    string
+		version uint8
+		value   string
+	}{
+		{
+			name:    "v0",
+			version: message.Version0,
+			value:   "123",
+		},
+		{
+			name:    "v1 with newline",
+			version: message.Version1,
+			value:   "line1\nline2\r\n",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			client, err := NewClient("localhost:8088", ClientWithProtocolVersion(tc.version))
+			require.NoError(t, err)
+			defer client.Close()
+			ms := &metaClient{}
+			require.NoError(t, client.InitService(ms))
+			ctx := AppendToOutgoing(context.Background(), "token", tc.value)
+			resp, err := ms.Get(ctx, &metaReq{Key: "token"})
+			require.NoError(t, err)
+			assert.Equal(t, tc.value, resp.Value)
+		})
+	}
+}
+
+func TestRPCGen(t *testing.T) {
+	// 服务端用生成的分发器，客户端生成的和反射的混用，线上的格式必须一致
+	server := NewServer()
+	service := &UserServiceServer{}
+	require.NoError(t, server.RegisterDispatcher(NewUserServiceDispatcher(service)))
+	go func() {
+		_ = server.Start("tcp", ":8090")
+	}()
+	defer func() {
+		_ = server.Shutdown(context.Background())
+	}()
+	time.Sleep(time.Second)
+
+	client, err := NewClient("localhost:8090")
+	require.NoError(t, err)
+	defer client.Close()
+	generated := NewUserServiceClient(client)
+	reflected := &UserService{}
+	require.NoError(t, client.InitService(reflected))
+
+	testCases := []struct {
+		name string
+		mock func()
+
+		wantErr  error
+		wantResp *GetByIdResp
+	}{
+		{
+			name: "no error",
+			mock: func() {
+				service.Err = nil
+				service.Msg = "hello, world"
+			},
+			wantResp: &GetByIdResp{Msg: "hello, world"},
+		},
+		{
+			name: "error and msg",
+			mock: func() {
+				service.Err = errors.New("error")
+				service.Msg = "123"
+			},
+			wantErr:  status.Errorf(status.Unknown, "error"),
+			wantResp: &GetByIdResp{Msg: "123"},
 		},
 	}
 
 	for _, tc := range testCases {
 		t.Run(tc.name, func(t *testing.T) {
 			tc.mock()
-			resp, er := us.GetById(CtxWithOneWay(context.Background()), &GetByIdReq{Id: 123})
-			//resp, er := us.GetById(context.Background(), &GetByIdReq{Id: 123})
+			resp, er := generated.GetById(context.Background(), &GetByIdReq{Id: 123})
 			assert.Equal(t, tc.wantErr, er)
 			assert.Equal(t, tc.wantResp, resp)
+
+			resp, er = reflected.GetById(context.Background(), &GetByIdReq{Id: 123})
+			assert.Equal(t, tc.wantErr, er)
+			assert.Equal(t, tc.wantResp, resp)
+		})
+	}
+
+	err = client.Call(context.Background(), "user-service", "Unknown", &GetByIdReq{}, &GetByIdResp{})
+	assert.Equal(t, status.Unimplemented, status.Convert(err).Code())
+}
+
+func TestClientWithRegistry(t *testing.T) {
+	r := memory.NewRegistry()
+	defer r.Close()
+	servers := make([]*Serve, 0, 2)
+	for _, addr := range []string{"localhost:8094", "localhost:8095"} {
+		server := NewServer(ServerWithRegistry(r), ServerWithAdvertiseAddr(addr))
+		require.NoError(t, server.RegisterService(&UserServiceServer{Msg: addr}))
+		addr := addr
+		go func() {
+			_ = server.Start("tcp", addr)
+		}()
+		servers = append(servers, server)
+	}
+	defer func() {
+		_ = servers[1].Shutdown(context.Background())
+	}()
+	time.Sleep(time.Second)
+
+	client, err := NewClientWithRegistry("registry:///user-service", r)
+	require.NoError(t, err)
+	defer client.Close()
+	us := &UserService{}
+	require.NoError(t, client.InitService(us))
+
+	resp, err := us.GetById(context.Background(), &GetByIdReq{Id: 123})
+	require.NoError(t, err)
+	assert.Equal(t, "localhost:8094", resp.Msg)
+
+	// 下线之后客户端切换到另一个实例
+	require.NoError(t, servers[0].Shutdown(context.Background()))
+	assert.Eventually(t, func() bool {
+		resp, err = us.GetById(context.Background(), &GetByIdReq{Id: 123})
+		return err == nil && resp.Msg == "localhost:8095"
+	}, time.Second, time.Millisecond*10)
+
+	t.Run("no instance", func(t *testing.T) {
+		c, err := NewClientWithRegistry("registry:///missing-user-service", r)
+		require.NoError(t, err)
+		defer c.Close()
+		mu := &missingUserService{}
+		require.NoError(t, c.InitService(mu))
+		_, err = mu.GetById(context.Background(), &GetByIdReq{Id: 123})
+		assert.Equal(t, status.Unavailable, status.Convert(err).Code())
+	})
+
+	t.Run("invalid target", func(t *testing.T) {
+		_, err := NewClientWithRegistry("localhost:8095", r)
+		assert.Error(t, err)
+		_, err = NewClientWithRegistry("registry:///", r)
+		assert.Error(t, err)
+	})
+}
+
+func TestClientWithBalancer(t *testing.T) {
+	addrs := []string{"localhost:8096", "localhost:8097", "localhost:8098"}
+	instances := make([]registry.Instance, 0, len(addrs))
+	for _, addr := range addrs {
+		server := NewServer()
+		require.NoError(t, server.RegisterService(&UserServiceServer{Msg: addr}))
+		addr := addr
+		go func() {
+			_ = server.Start("tcp", addr)
+		}()
+		defer func() {
+			_ = server.Shutdown(context.Background())
+		}()
+		instances = append(instances, registry.Instance{Addr: addr})
+	}
+	time.Sleep(time.Second)
+
+	testCases := []struct {
+		name string
+		b    balancer.Balancer
+		ctx  context.Context
+
+		// wantServers 调用 6 次之后每个实例被调用的次数
+		wantServers map[string]int
+	}{
+		{
+			name: "round robin",
+			b:    balancer.NewRoundRobin(),
+			ctx:  context.Background(),
+			wantServers: map[string]int{
+				"localhost:8096": 2,
+				"localhost:8097": 2,
+				"localhost:8098": 2,
+			},
+		},
+		{
+			name: "consistent hash",
+			b:    balancer.NewConsistentHash("user-id"),
+			ctx:  AppendToOutgoing(context.Background(), "user-id", "123"),
+		},
+		{
+			// 没有元数据的时候使用 GetByIdReq.Id 上的 hashkey 标签
+			name: "consistent hash by request",
+			b:    balancer.NewConsistentHash(""),
+			ctx:  context.Background(),
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			client, err := NewClientWithInstances(instances, ClientWithBalancer(tc.b))
+			require.NoError(t, err)
+			defer client.Close()
+			us := &UserService{}
+			require.NoError(t, client.InitService(us))
+
+			servers := make(map[string]int, len(addrs))
+			for i := 0; i < 6; i++ {
+				resp, err := us.GetById(tc.ctx, &GetByIdReq{Id: 123})
+				require.NoError(t, err)
+				servers[resp.Msg]++
+			}
+			if tc.wantServers != nil {
+				assert.Equal(t, tc.wantServers, servers)
+				return
+			}
+			// 一致性哈希总是落到同一个实例
+			assert.Len(t, servers, 1)
 		})
 	}
 
+	// 不同的 Id 分散到不同的实例上，同一个 Id 总是落到同一个实例
+	client, err := NewClientWithInstances(instances, ClientWithBalancer(balancer.NewConsistentHash("")))
+	require.NoError(t, err)
+	defer client.Close()
+	us := &UserService{}
+	require.NoError(t, client.InitService(us))
+	picked := make(map[int]string, 30)
+	servers := make(map[string]int, len(addrs))
+	for i := 0; i < 60; i++ {
+		id := i % 30
+		resp, err := us.GetById(context.Background(), &GetByIdReq{Id: id})
+		require.NoError(t, err)
+		if addr, ok := picked[id]; ok {
+			assert.Equal(t, addr, resp.Msg)
+		}
+		picked[id] = resp.Msg
+		servers[resp.Msg]++
+	}
+	assert.Len(t, servers, len(addrs))
+
+	_, err = NewClientWithInstances(nil)
+	assert.Error(t, err)
+}
+
+func TestClientWithBreaker(t *testing.T) {
+	server := NewServer()
+	service := &flakyService{failures: 2}
+	require.NoError(t, server.RegisterService(service))
+	go func() {
+		_ = server.Start("tcp", ":8100")
+	}()
+	defer func() {
+		_ = server.Shutdown(context.Background())
+	}()
+	time.Sleep(time.Second)
+
+	type transition struct {
+		addr, method string
+		from, to     breaker.State
+	}
+	var mu sync.Mutex
+	var transitions []transition
+	onStateChange := func(addr, serviceName, methodName string, from, to breaker.State) {
+		mu.Lock()
+		defer mu.Unlock()
+		transitions = append(transitions, transition{addr: addr, method: serviceName + "." + methodName, from: from, to: to})
+	}
+	cfg := breaker.Config{ConsecutiveFailures: 2, OpenTimeout: 200 * time.Millisecond}
+	// 8101 上没有服务端
+	client, err := NewClientWithInstances([]registry.Instance{{Addr: "localhost:8100"}, {Addr: "localhost:8101"}},
+		ClientWithBalancer(balancer.NewConsistentHash("addr")), ClientWithBreaker(cfg, onStateChange))
+	require.NoError(t, err)
+	defer client.Close()
+	fc := &flakyClient{}
+	require.NoError(t, client.InitService(fc))
+	// call 找一个落到 addr 上的 key 发起调用
+	call := func(addr string) error {
+		key := 0
+		for ; ; key++ {
+			ep, err := client.balancer.Pick(balancer.Info{Meta: map[string]string{"addr": strconv.Itoa(key)}})
+			require.NoError(t, err)
+			if ep.Addr() == addr {
+				break
+			}
+		}
+		_, err := fc.Get(AppendToOutgoing(context.Background(), "addr", strconv.Itoa(key)), &metaReq{})
+		return err
+	}
+
+	// 连续失败两次之后熔断，不会再调到服务端
+	for i := 0; i < 2; i++ {
+		assert.Equal(t, status.Unavailable, status.Convert(call("localhost:8100")).Code())
+	}
+	err = call("localhost:8100")
+	assert.Equal(t, status.Errorf(status.Unavailable, "rpc: 实例 localhost:8100 的 flaky-service.Get 已经熔断"), err)
+	assert.Len(t, service.attempts, 2)
+
+	// 过了 OpenTimeout 之后试探成功，恢复正常
+	time.Sleep(200 * time.Millisecond)
+	require.NoError(t, call("localhost:8100"))
+	require.NoError(t, call("localhost:8100"))
+
+	// 连不上的实例熔断之后也不会再建立连接
+	for i := 0; i < 2; i++ {
+		assert.Error(t, call("localhost:8101"))
+	}
+	err = call("localhost:8101")
+	assert.Equal(t, status.Errorf(status.Unavailable, "rpc: 实例 localhost:8101 的 flaky-service.Get 已经熔断"), err)
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, []transition{
+		{addr: "localhost:8100", method: "flaky-service.Get", from: breaker.Closed, to: breaker.Open},
+		{addr: "localhost:8100", method: "flaky-service.Get", from: breaker.Open, to: breaker.HalfOpen},
+		{addr: "localhost:8100", method: "flaky-service.Get", from: breaker.HalfOpen, to: breaker.Closed},
+		{addr: "localhost:8101", method: "flaky-service.Get", from: breaker.Closed, to: breaker.Open},
+	}, transitions)
+}
+
+// startHangingServer 接受连接之后一直不回复握手，返回监听的地址
+func startHangingServer(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = l.Close()
+	})
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			t.Cleanup(func() {
+				_ = conn.Close()
+			})
+		}
+	}()
+	return l.Addr().String()
+}
+
+func TestClientDialContext(t *testing.T) {
+	addr := startHangingServer(t)
+	client, err := NewClientWithInstances([]registry.Instance{{Addr: addr}})
+	require.NoError(t, err)
+	defer client.Close()
+	sc := &sleepClient{}
+	require.NoError(t, client.InitService(sc))
+
+	testCases := []struct {
+		name string
+		ctx  func() (context.Context, context.CancelFunc)
+
+		wantErr  error
+		wantCode status.Code
+	}{
+		{
+			name: "deadline",
+			ctx: func() (context.Context, context.CancelFunc) {
+				return context.WithTimeout(context.Background(), time.Millisecond*100)
+			},
+			wantErr:  context.DeadlineExceeded,
+			wantCode: status.DeadlineExceeded,
+		},
+		{
+			name: "canceled",
+			ctx: func() (context.Context, context.CancelFunc) {
+				ctx, cancel := context.WithCancel(context.Background())
+				time.AfterFunc(time.Millisecond*100, cancel)
+				return ctx, cancel
+			},
+			wantErr:  context.Canceled,
+			wantCode: status.Canceled,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, cancel := tc.ctx()
+			defer cancel()
+			start := time.Now()
+			// 握手一直没有完成，调用在 ctx 结束的时候返回，而不是等握手超时
+			_, err := sc.Sleep(ctx, &sleepReq{})
+			assert.Less(t, time.Since(start), time.Millisecond*500)
+			assert.ErrorIs(t, err, tc.wantErr)
+			assert.Equal(t, tc.wantCode, status.Convert(err).Code())
+		})
+	}
+}
+
+func TestClientDialNotBlocking(t *testing.T) {
+	hanging := startHangingServer(t)
+	server := NewServer()
+	require.NoError(t, server.RegisterService(&sleepService{}))
+	go func() {
+		_ = server.Start("tcp", ":8102")
+	}()
+	defer func() {
+		_ = server.Shutdown(context.Background())
+	}()
+	time.Sleep(time.Second)
+
+	client, err := NewClientWithInstances([]registry.Instance{{Addr: hanging}})
+	require.NoError(t, err)
+	defer client.Close()
+	sc := &sleepClient{}
+	require.NoError(t, client.InitService(sc))
+
+	// 没有超时时间的调用一直在等握手
+	stuck := make(chan error, 1)
+	go func() {
+		_, err := sc.Sleep(context.Background(), &sleepReq{})
+		stuck <- err
+	}()
+	time.Sleep(time.Millisecond * 50)
+
+	// 同一个实例上等连接的调用各自按照自己的 ctx 返回，不会排队
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*200)
+			defer cancel()
+			start := time.Now()
+			_, err := sc.Sleep(ctx, &sleepReq{})
+			assert.Equal(t, context.DeadlineExceeded, err)
+			assert.Less(t, time.Since(start), time.Millisecond*500)
+		}()
+	}
+	wg.Wait()
+
+	// 切换到正常的实例不用等正在建立的连接
+	start := time.Now()
+	client.setInstances([]registry.Instance{{Addr: "localhost:8102"}})
+	assert.Less(t, time.Since(start), time.Millisecond*100)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*200)
+	defer cancel()
+	_, err = sc.Sleep(ctx, &sleepReq{})
+	require.NoError(t, err)
+
+	// 下线的实例放弃建立连接，等它的调用马上返回
+	select {
+	case err = <-stuck:
+		assert.Equal(t, status.Unavailable, status.Convert(err).Code())
+	case <-time.After(time.Millisecond * 500):
+		t.Fatal("下线的实例还在建立连接")
+	}
+
+	// 关闭客户端也不用等正在建立的连接
+	closing, err := NewClientWithInstances([]registry.Instance{{Addr: hanging}})
+	require.NoError(t, err)
+	cs := &sleepClient{}
+	require.NoError(t, closing.InitService(cs))
+	go func() {
+		_, err := cs.Sleep(context.Background(), &sleepReq{})
+		stuck <- err
+	}()
+	time.Sleep(time.Millisecond * 50)
+	start = time.Now()
+	require.NoError(t, closing.Close())
+	assert.Less(t, time.Since(start), time.Millisecond*100)
+	select {
+	case err = <-stuck:
+		assert.Error(t, err)
+	case <-time.After(time.Millisecond * 500):
+		t.Fatal("关闭之后还在建立连接")
+	}
 }
@@ -0,0 +1,248 @@
+package rpc
+
+import (
+	"context"
+	"io"
+	"reflect"
+	"self_developed_rpc/rpc/message"
+	"self_developed_rpc/rpc/status"
+)
+
+// streamOpener 打开一个流，只有服务端流需要 req
+type streamOpener func(ctx context.Context, serviceName, methodName string, kind streamKind, req any) (ClientStream, error)
+
+// streamFunc 为流式字段生成实现
+func streamFunc(serviceName string, field reflect.StructField, kind streamKind, open streamOpener) reflect.Value {
+	wrapperTyp := field.Type.Out(0)
+	return reflect.MakeFunc(field.Type, func(args []reflect.Value) []reflect.Value {
+		ctx := args[0].Interface().(context.Context)
+		var req any
+		if len(args) > 1 {
+			req = args[1].Interface()
+		}
+		cs, err := open(ctx, serviceName, field.Name, kind, req)
+		if err != nil {
+			return []reflect.Value{reflect.Zero(wrapperTyp), reflect.ValueOf(err)}
+		}
+		wrapper := reflect.New(wrapperTyp.Elem())
+		wrapper.Elem().Field(0).Set(reflect.ValueOf(cs))
+		return []reflect.Value{wrapper, reflect.Zero(errorType)}
+	})
+}
+
+// newStream 发送打开流的请求，请求的 MessageId 就是流的 id
+// 流不经过客户端拦截器，ctx 控制整个流的生命周期
+func (c *Client) newStream(ctx context.Context, serviceName, methodName string, kind streamKind, reqVal any) (ClientStream, error) {
+	// 哈希 key 只用来选实例，不影响流的生命周期
+	pickCtx, err := withHashKey(ctx, c.hashKey, serviceName, methodName, reqVal)
+	if err != nil {
+		return nil, err
+	}
+	req, err := newRequest(ctx, c.serializer, serviceName, methodName, reqVal)
+	if err != nil {
+		return nil, err
+	}
+	// 服务端靠它区分流式调用，避免把流帧发给等待普通响应的调用方
+	if req.Meta == nil {
+		req.Meta = make(map[string]string, 1)
+	}
+	req.Meta["stream"] = kind.String()
+	_, cc, err := c.pick(pickCtx, req)
+	if err != nil {
+		return nil, err
+	}
+	req.Version = cc.version
+	req.SetHeadLength()
+	if err = c.compress(cc, req); err != nil {
+		return nil, err
+	}
+	req.MessageId = c.nextMessageId()
+	cs := &clientStream{
+		streamState: newStreamState(c.streamWindow),
+		ctx:         ctx,
+		c:           c,
+		cc:          cc,
+		id:          req.MessageId,
+	}
+	if kind == serverStreaming {
+		// 服务端流不会再发送消息
+		cs.closeSend(errSendClosed)
+	}
+	// 不管调用方有没有在读写，ctx 结束的时候都要通知服务端
+	cs.stop = context.AfterFunc(ctx, func() {
+		cs.cancel(ctx.Err())
+	})
+	if err = cc.openStream(ctx, cs, message.EncodeReq(req)); err != nil {
+		cs.stop()
+		return nil, err
+	}
+	if c.streamWindow > defaultStreamWindow {
+		cs.writeFrame(message.NewWindowUpdate(cs.id, c.streamWindow-defaultStreamWindow))
+	}
+	return cs, nil
+}
+
+// clientStream 读协程把收到的帧交给它，调用方从它这里读写
+type clientStream struct {
+	*streamState
+	ctx context.Context
+	c   *Client
+	cc  *clientConn
+	id  uint32
+	// stop 取消对 ctx 的监听
+	stop func() bool
+}
+
+func (cs *clientStream) Context() context.Context {
+	return cs.ctx
+}
+
+func (cs *clientStream) SendMsg(msg any) error {
+	data, err := cs.c.serializer.Encode(msg)
+	if err != nil {
+		return err
+	}
+	f := &message.Frame{
+		StreamId:   cs.id,
+		Type:       message.FrameData,
+		Serializer: cs.c.serializer.Code(),
+	}
+	if f.Data, f.Compresser, err = cs.c.compressData(cs.cc, data); err != nil {
+		return err
+	}
+	f.SetHeadLength()
+	f.SetBodyLength()
+	if err = cs.acquire(cs.ctx, f.Size()); err != nil {
+		return cs.sendErrOf(err)
+	}
+	if err = cs.cc.write(cs.ctx, message.EncodeFrame(f)); err != nil {
+		return cs.sendErrOf(err)
+	}
+	return nil
+}
+
+// sendErrOf 服务端结束了流之后再发送，返回 io.EOF，具体的原因通过 RecvMsg 拿到
+func (cs *clientStream) sendErrOf(err error) error {
+	if err == errSendClosed || err == errStreamClosed {
+		return err
+	}
+	if ctxErr := cs.ctx.Err(); ctxErr != nil {
+		return ctxErr
+	}
+	return io.EOF
+}
+
+func (cs *clientStream) CloseSend() error {
+	if cs.sendClosed() {
+		return nil
+	}
+	cs.closeSend(errSendClosed)
+	end := &message.Frame{StreamId: cs.id, Type: message.FrameEnd}
+	end.SetHeadLength()
+	return cs.cc.write(cs.ctx, message.EncodeFrame(end))
+}
+
+func (cs *clientStream) RecvMsg(msg any) error {
+	f, increment, err := cs.recv(cs.ctx)
+	if err != nil {
+		if ctxErr := cs.ctx.Err(); ctxErr != nil && err == ctxErr {
+			cs.cancel(err)
+		}
+		return err
+	}
+	if increment > 0 {
+		cs.writeFrame(message.NewWindowUpdate(cs.id, increment))
+	}
+	data, err := cs.c.decompressData(f.Compresser, f.Data)
+	if err != nil {
+		return err
+	}
+	return cs.c.serializer.Decode(data, msg)
+}
+
+func (cs *clientStream) Close() error {
+	cs.cancel(errStreamClosed)
+	return nil
+}
+
+// cancel 放弃这个流，流还没有结束的话通知服务端
+func (cs *clientStream) cancel(err error) {
+	if !cs.cc.removeStream(cs.id) {
+		// 流已经结束了，还没读走的消息只有调用方主动关闭的时候才丢弃
+		if err == errStreamClosed {
+			cs.abort(err)
+		}
+		return
+	}
+	cs.stop()
+	cs.abort(err)
+	f := &message.Frame{StreamId: cs.id, Type: message.FrameCancel}
+	f.SetHeadLength()
+	cs.writeFrame(f)
+}
+
+// reset 服务端不遵守流控，在读协程里面结束流并通知服务端
+// 取消帧交给另外的协程发送，读协程不能阻塞在写上面
+func (cs *clientStream) reset(err error) {
+	cs.stop()
+	cs.abort(err)
+	f := &message.Frame{StreamId: cs.id, Type: message.FrameCancel}
+	f.SetHeadLength()
+	go cs.writeFrame(f)
+}
+
+// writeFrame 写控制帧，不受调用方 ctx 的影响
+func (cs *clientStream) writeFrame(f *message.Frame) {
+	_ = cs.cc.write(context.Background(), message.EncodeFrame(f))
+}
+
+// handle 读协程收到帧之后调用，流结束的时候返回 true
+func (cs *clientStream) handle(f *message.Frame) bool {
+	switch f.Type {
+	case message.FrameData:
+		if !cs.push(f) {
+			cs.reset(status.Errorf(status.ResourceExhausted, "rpc: 服务端发送的数据超过了流控窗口"))
+			return true
+		}
+	case message.FrameWindowUpdate:
+		if !cs.addCredit(f.Increment()) {
+			cs.reset(status.Errorf(status.ResourceExhausted, "rpc: 服务端给的发送额度超过了上限"))
+			return true
+		}
+	case message.FrameEnd:
+		var err error = io.EOF
+		if len(f.Error) > 0 {
+			err = status.Unmarshal(f.Error).Err()
+		}
+		cs.stop()
+		cs.closeRecv(err)
+		cs.closeSend(err)
+		return true
+	case message.FrameCancel:
+		cs.stop()
+		cs.abort(status.Errorf(status.Canceled, "rpc: 服务端取消了流"))
+		return true
+	}
+	return false
+}
+
+// respToFrames 流式调用收到了普通的响应，一般是服务端在调用业务之前就出错了
+// 比如服务不存在，或者对端把它当成了普通方法
+func respToFrames(resp *message.Response) []*message.Frame {
+	frames := make([]*message.Frame, 0, 2)
+	if len(resp.Data) > 0 {
+		frames = append(frames, &message.Frame{
+			StreamId:   resp.MessageId,
+			Type:       message.FrameData,
+			Compresser: resp.Compresser,
+			Serializer: resp.Serializer,
+			Data:       resp.Data,
+		})
+	}
+	return append(frames, &message.Frame{
+		StreamId:   resp.MessageId,
+		Type:       message.FrameEnd,
+		Serializer: resp.Serializer,
+		Error:      resp.Error,
+	})
+}
@@ -5,11 +5,16 @@ import (
 	"errors"
 	"fmt"
 	"github.com/golang/mock/gomock"
+	"self_developed_rpc/rpc/balancer"
 	"self_developed_rpc/rpc/message"
+	"self_developed_rpc/rpc/registry"
 	"self_developed_rpc/rpc/serialize/json"
+	"strconv"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestSetStructFunc(t *testing.T) {
@@ -42,11 +47,15 @@ func TestSetStructFunc(t *testing.T) {
 			mock: func(ctrl *gomock.Controller) Proxy {
 				proxy := NewMockProxy(ctrl)
 				data, _ := s.Encode(&GetByIdReq{Id: 1})
-				proxy.EXPECT().Invoke(gomock.Any(), &message.Request{
+				req := &message.Request{
+					Serializer:  s.Code(),
 					ServiceName: "user-service",
 					MethodName:  "GetById",
 					Data:        data,
-				}).Return(&message.Response{
+				}
+				req.SetHeadLength()
+				req.SetBodyLength()
+				proxy.EXPECT().Invoke(gomock.Any(), req).Return(&message.Response{
 					Data: []byte(`{"Msg":"hello, world"}`),
 				}, nil)
 				return proxy
@@ -58,7 +67,7 @@ func TestSetStructFunc(t *testing.T) {
 		t.Run(tt.name, func(t *testing.T) {
 			ctrl := gomock.NewController(t)
 			defer ctrl.Finish()
-			err := setStructFunc(tt.service, tt.mock(ctrl), s)
+			err := setStructFunc(tt.service, tt.mock(ctrl), s, nil, nil)
 			if err != nil {
 				assert.Equal(t, tt.wantErr, err)
 				return
@@ -72,3 +81,184 @@ func TestSetStructFunc(t *testing.T) {
 		})
 	}
 }
+
+func TestSetStructFuncTimeout(t *testing.T) {
+	s := &json.Serializer{}
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	proxy := NewMockProxy(ctrl)
+	proxy.EXPECT().Invoke(gomock.Any(), gomock.Any()).DoAndReturn(
+		func(ctx context.Context, req *message.Request) (*message.Response, error) {
+			timeout, err := strconv.ParseInt(req.Meta["timeout"], 10, 64)
+			require.NoError(t, err)
+			assert.True(t, time.Duration(timeout) > 0 && time.Duration(timeout) <= time.Second)
+			return &message.Response{}, nil
+		})
+	us := &UserService{}
+	require.NoError(t, setStructFunc(us, proxy, s, nil, nil))
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	_, err := us.GetById(ctx, &GetByIdReq{Id: 1})
+	require.NoError(t, err)
+
+	// 已经超时的请求不会发出去
+	ctx, cancel = context.WithTimeout(context.Background(), -time.Second)
+	defer cancel()
+	_, err = us.GetById(ctx, &GetByIdReq{Id: 1})
+	assert.Equal(t, context.DeadlineExceeded, err)
+}
+
+func TestSetStructFuncMeta(t *testing.T) {
+	s := &json.Serializer{}
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	proxy := NewMockProxy(ctrl)
+	proxy.EXPECT().Invoke(gomock.Any(), gomock.Any()).DoAndReturn(
+		func(ctx context.Context, req *message.Request) (*message.Response, error) {
+			assert.Equal(t, map[string]string{"trace-id": "123", "one-way": "true"}, req.Meta)
+			return &message.Response{}, nil
+		})
+	us := &UserService{}
+	require.NoError(t, setStructFunc(us, proxy, s, nil, nil))
+
+	ctx := AppendToOutgoing(context.Background(), "trace-id", "123", "one-way", "false")
+	_, err := us.GetById(CtxWithOneWay(ctx), &GetByIdReq{Id: 1})
+	require.NoError(t, err)
+}
+
+func TestNewRequestReservedMeta(t *testing.T) {
+	s := &json.Serializer{}
+	testCases := []struct {
+		name string
+		ctx  context.Context
+
+		wantMeta map[string]string
+	}{
+		{
+			// 用户设置的 one-way 会让服务端不回复，调用方一直等下去
+			name:     "one-way",
+			ctx:      AppendToOutgoing(context.Background(), "trace-id", "123", "one-way", "true"),
+			wantMeta: map[string]string{"trace-id": "123"},
+		},
+		{
+			name:     "timeout",
+			ctx:      AppendToOutgoing(context.Background(), "trace-id", "123", "timeout", "1"),
+			wantMeta: map[string]string{"trace-id": "123"},
+		},
+		{
+			name:     "stream",
+			ctx:      NewOutgoingContext(context.Background(), map[string]string{"trace-id": "123", "stream": "bidi"}),
+			wantMeta: map[string]string{"trace-id": "123"},
+		},
+		{
+			name:     "attempt",
+			ctx:      NewOutgoingContext(context.Background(), map[string]string{"trace-id": "123", "attempt": "2"}),
+			wantMeta: map[string]string{"trace-id": "123"},
+		},
+		{
+			// 框架设置的值不受影响
+			name:     "framework one-way",
+			ctx:      CtxWithOneWayAck(AppendToOutgoing(context.Background(), "one-way", "true")),
+			wantMeta: map[string]string{"one-way": "ack"},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req, err := newRequest(tc.ctx, s, "user-service", "GetById", &GetByIdReq{Id: 1})
+			require.NoError(t, err)
+			assert.Equal(t, tc.wantMeta, req.Meta)
+		})
+	}
+	// ctx 里的元数据没有被修改
+	ctx := AppendToOutgoing(context.Background(), "one-way", "true")
+	_, err := newRequest(ctx, s, "user-service", "GetById", &GetByIdReq{Id: 1})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"one-way": "true"}, outgoingMeta(ctx))
+}
+
+type mixedService struct {
+	// 非函数字段和未导出的字段都会被跳过
+	Timeout time.Duration
+	getById func(ctx context.Context, req *GetByIdReq) (*GetByIdResp, error)
+	GetById func(ctx context.Context, req *GetByIdReq) (*GetByIdResp, error)
+}
+
+func (m *mixedService) Name() string {
+	return "user-service"
+}
+
+type invalidService struct {
+	GetById  func(ctx context.Context, req *GetByIdReq) (*GetByIdResp, error)
+	NoCtx    func(req *GetByIdReq) (*GetByIdResp, error)
+	NoErr    func(ctx context.Context, req *GetByIdReq) *GetByIdResp
+	ValueReq func(ctx context.Context, req GetByIdReq) (*GetByIdResp, error)
+}
+
+func (i *invalidService) Name() string {
+	return "invalid-service"
+}
+
+func TestSetStructFuncSignature(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	proxy := NewMockProxy(ctrl)
+
+	ms := &mixedService{Timeout: time.Second}
+	require.NoError(t, setStructFunc(ms, proxy, &json.Serializer{}, nil, nil))
+	assert.NotNil(t, ms.GetById)
+	assert.Nil(t, ms.getById)
+	assert.Equal(t, time.Second, ms.Timeout)
+
+	is := &invalidService{}
+	err := setStructFunc(is, proxy, &json.Serializer{}, nil, nil)
+	assert.Equal(t, errors.New("rpc: 服务 invalid-service 的字段 [NoCtx NoErr ValueReq] 签名不对，"+
+		"必须是 func(ctx context.Context, req *Req) (*Resp, error) 或者 "+
+		"func(ctx context.Context, req *Req) (*rpc.StreamReader[*Resp], error) 或者 "+
+		"func(ctx context.Context) (*rpc.StreamWriter[*Req, *Resp], error) 或者 "+
+		"func(ctx context.Context) (*rpc.StreamReadWriter[*Req, *Resp], error)"), err)
+	// 有问题的时候一个字段都不设置
+	assert.Nil(t, is.GetById)
+}
+
+// recordBalancer 记录每次 Update 拿到的地址和权重
+type recordBalancer struct {
+	updates [][]string
+	weights [][]uint32
+}
+
+func (r *recordBalancer) Update(endpoints []balancer.Endpoint) {
+	addrs := make([]string, 0, len(endpoints))
+	weights := make([]uint32, 0, len(endpoints))
+	for _, ep := range endpoints {
+		addrs = append(addrs, ep.Addr())
+		weights = append(weights, ep.Weight())
+	}
+	r.updates = append(r.updates, addrs)
+	r.weights = append(r.weights, weights)
+}
+
+func (r *recordBalancer) Pick(info balancer.Info) (balancer.Endpoint, error) {
+	return nil, balancer.ErrNoEndpoint
+}
+
+func TestClientSetInstancesSorted(t *testing.T) {
+	b := &recordBalancer{}
+	instances := []registry.Instance{
+		{Addr: "localhost:8083"},
+		{Addr: "localhost:8081", Weight: 2},
+		{Addr: "localhost:8082"},
+		// 重复的地址以第一个为准
+		{Addr: "localhost:8081", Weight: 5},
+	}
+	client, err := NewClientWithInstances(instances, ClientWithBalancer(b))
+	require.NoError(t, err)
+	defer client.Close()
+	assert.Equal(t, [][]string{{"localhost:8081", "localhost:8082", "localhost:8083"}}, b.updates)
+	assert.Equal(t, [][]uint32{{2, 1, 1}}, b.weights)
+	// 调用方的列表不受影响
+	assert.Equal(t, "localhost:8083", instances[0].Addr)
+
+	client.setInstances([]registry.Instance{{Addr: "localhost:8085"}, {Addr: "localhost:8084"}})
+	assert.Equal(t, []string{"localhost:8084", "localhost:8085"}, b.updates[1])
+}
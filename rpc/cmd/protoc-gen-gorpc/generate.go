@@ -0,0 +1,124 @@
+package main
+
+import (
+	"path"
+	"strings"
+
+	"google.golang.org/protobuf/compiler/protogen"
+)
+
+const (
+	contextPackage   = protogen.GoImportPath("context")
+	rpcPackage       = protogen.GoImportPath("self_developed_rpc/rpc")
+	protoSerializer  = protogen.GoImportPath("self_developed_rpc/rpc/serialize/proto")
+	generatedSuffix  = ".rpc.go"
+	subPackageSuffix = "rpc"
+)
+
+// generateFile 为 f 里面的 service 生成代码，没有 service 的时候什么都不做
+func generateFile(plugin *protogen.Plugin, f *protogen.File) *protogen.GeneratedFile {
+	if len(f.Services) == 0 {
+		return nil
+	}
+	// user.proto 的消息在 gen 包里面，服务生成在 gen/genrpc 里面
+	pkgName := f.GoPackageName + subPackageSuffix
+	dir, file := path.Split(f.GeneratedFilenamePrefix)
+	filename := path.Join(dir, string(pkgName), file+generatedSuffix)
+	importPath := protogen.GoImportPath(path.Join(string(f.GoImportPath), string(pkgName)))
+
+	g := plugin.NewGeneratedFile(filename, importPath)
+	g.P("// Code generated by protoc-gen-gorpc. DO NOT EDIT.")
+	g.P("// source: ", f.Desc.Path())
+	g.P()
+	g.P("package ", pkgName)
+	g.P()
+	for _, s := range f.Services {
+		generateService(g, s)
+	}
+	return g
+}
+
+func generateService(g *protogen.GeneratedFile, s *protogen.Service) {
+	name := s.GoName
+	nameConst := name + "Name"
+	serverType := name + "Server"
+	implType := strings.ToLower(name[:1]) + name[1:] + "Server"
+
+	g.P("// ", nameConst, " 是 ", s.Desc.FullName(), " 在线上使用的服务名")
+	g.P("const ", nameConst, " = ", `"`, s.Desc.FullName(), `"`)
+	g.P()
+
+	// 客户端
+	g.AnnotateSymbol(name, protogen.Annotation{Location: s.Location})
+	g.P("// ", name, " 是 ", s.Desc.FullName(), " 的客户端，通过 Client.InitService 初始化")
+	g.P("// 服务端默认使用 proto 序列化协议，客户端需要配合 ClientWithSerializer 使用")
+	g.P("type ", name, " struct {")
+	for _, m := range s.Methods {
+		g.P(append([]any{m.GoName, " func"}, clientSignature(m)...)...)
+	}
+	g.P("}")
+	g.P()
+	g.P("func (s *", name, ") Name() string {")
+	g.P("return ", nameConst)
+	g.P("}")
+	g.P()
+
+	// 服务端接口
+	g.P("// ", serverType, " 是 ", s.Desc.FullName(), " 的服务端需要实现的接口")
+	g.P("type ", serverType, " interface {")
+	for _, m := range s.Methods {
+		g.AnnotateSymbol(serverType+"."+m.GoName, protogen.Annotation{Location: m.Location})
+		g.P(append([]any{m.Comments.Leading, m.GoName}, serverSignature(m)...)...)
+	}
+	g.P("}")
+	g.P()
+
+	// 注册
+	g.P("// Register", serverType, " 把 impl 注册到 s 上面，同时注册 proto 序列化协议")
+	g.P("func Register", serverType, "(s *", rpcPackage.Ident("Serve"), ", impl ", serverType, ") error {")
+	g.P("s.RegisterSerialize(&", protoSerializer.Ident("Serializer"), "{})")
+	g.P("return s.RegisterService(", implType, "{", serverType, ": impl})")
+	g.P("}")
+	g.P()
+	g.P("// ", implType, " 只暴露 ", serverType, " 里面的方法，业务实现上多余的方法不会被注册")
+	g.P("type ", implType, " struct {")
+	g.P(serverType)
+	g.P("}")
+	g.P()
+	g.P("func (", implType, ") Name() string {")
+	g.P("return ", nameConst)
+	g.P("}")
+	g.P()
+}
+
+// clientSignature 按照 rpc 的流类型返回客户端字段的签名，要和 setStructFunc 支持的签名保持一致
+func clientSignature(m *protogen.Method) []any {
+	ctx := contextPackage.Ident("Context")
+	in, out := m.Input.GoIdent, m.Output.GoIdent
+	switch {
+	case m.Desc.IsStreamingClient() && m.Desc.IsStreamingServer():
+		return []any{"(ctx ", ctx, ") (*", rpcPackage.Ident("StreamReadWriter"), "[*", in, ", *", out, "], error)"}
+	case m.Desc.IsStreamingClient():
+		return []any{"(ctx ", ctx, ") (*", rpcPackage.Ident("StreamWriter"), "[*", in, ", *", out, "], error)"}
+	case m.Desc.IsStreamingServer():
+		return []any{"(ctx ", ctx, ", req *", in, ") (*", rpcPackage.Ident("StreamReader"), "[*", out, "], error)"}
+	default:
+		return []any{"(ctx ", ctx, ", req *", in, ") (*", out, ", error)"}
+	}
+}
+
+// serverSignature 按照 rpc 的流类型返回服务端方法的签名，要和 RegisterService 支持的签名保持一致
+func serverSignature(m *protogen.Method) []any {
+	ctx := contextPackage.Ident("Context")
+	in, out := m.Input.GoIdent, m.Output.GoIdent
+	switch {
+	case m.Desc.IsStreamingClient() && m.Desc.IsStreamingServer():
+		return []any{"(ctx ", ctx, ", stream ", rpcPackage.Ident("BidiStream"), "[*", in, ", *", out, "]) error"}
+	case m.Desc.IsStreamingClient():
+		return []any{"(ctx ", ctx, ", stream ", rpcPackage.Ident("RecvStream"), "[*", in, "]) (*", out, ", error)"}
+	case m.Desc.IsStreamingServer():
+		return []any{"(ctx ", ctx, ", req *", in, ", stream ", rpcPackage.Ident("Stream"), "[*", out, "]) error"}
+	default:
+		return []any{"(ctx ", ctx, ", req *", in, ") (*", out, ", error)"}
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/compiler/protogen"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/pluginpb"
+	"self_developed_rpc/rpc/proto/gen"
+)
+
+var update = flag.Bool("update", false, "重新生成 testdata 里面的 golden 文件")
+
+func TestGenerateUpToDate(t *testing.T) {
+	want, err := os.ReadFile("../../proto/gen/genrpc/user.rpc.go")
+	require.NoError(t, err)
+
+	files := run(t, protodesc.ToFileDescriptorProto(gen.File_user_proto))
+	require.Len(t, files, 1)
+	assert.Equal(t, "gen/genrpc/user.rpc.go", files[0].GetName())
+	assert.Equal(t, string(want), files[0].GetContent(), "生成的代码过期了，请重新执行 protoc")
+}
+
+func TestGenerateWithoutService(t *testing.T) {
+	fd := protodesc.ToFileDescriptorProto(gen.File_user_proto)
+	fd.Service = nil
+	assert.Empty(t, run(t, fd))
+}
+
+func TestGenerateStream(t *testing.T) {
+	fd := protodesc.ToFileDescriptorProto(gen.File_user_proto)
+	method := func(name string, clientStreaming, serverStreaming bool) *descriptorpb.MethodDescriptorProto {
+		return &descriptorpb.MethodDescriptorProto{
+			Name:            proto.String(name),
+			InputType:       proto.String(".user.GetByIdReq"),
+			OutputType:      proto.String(".user.GetByIdResp"),
+			ClientStreaming: proto.Bool(clientStreaming),
+			ServerStreaming: proto.Bool(serverStreaming),
+		}
+	}
+	fd.Service[0].Method = append(fd.Service[0].Method,
+		method("ListById", false, true),
+		method("BatchGetById", true, false),
+		method("ChatById", true, true),
+	)
+
+	files := run(t, fd)
+	require.Len(t, files, 1)
+	golden := "testdata/stream.rpc.go.golden"
+	if *update {
+		require.NoError(t, os.WriteFile(golden, []byte(files[0].GetContent()), 0644))
+	}
+	want, err := os.ReadFile(golden)
+	require.NoError(t, err)
+	assert.Equal(t, string(want), files[0].GetContent())
+}
+
+// run 模拟 protoc 调用插件，返回生成的文件
+func run(t *testing.T, fd *descriptorpb.FileDescriptorProto) []*pluginpb.CodeGeneratorResponse_File {
+	plugin, err := protogen.Options{}.New(&pluginpb.CodeGeneratorRequest{
+		FileToGenerate: []string{fd.GetName()},
+		Parameter:      proto.String("module=self_developed_rpc/rpc/proto"),
+		ProtoFile:      []*descriptorpb.FileDescriptorProto{fd},
+	})
+	require.NoError(t, err)
+	for _, f := range plugin.Files {
+		if f.Generate {
+			generateFile(plugin, f)
+		}
+	}
+	resp := plugin.Response()
+	require.Nil(t, resp.Error)
+	return resp.File
+}
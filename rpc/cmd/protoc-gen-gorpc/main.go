@@ -0,0 +1,29 @@
+// protoc-gen-gorpc 是 protoc 插件，根据 .proto 文件里面的 service 生成：
+//
+//   - 函数字段风格的客户端结构体，可以直接交给 Client.InitService 初始化
+//   - 服务端需要实现的接口
+//   - 注册服务端实现的辅助函数，默认注册 proto 序列化协议
+//
+// 生成的代码依赖 rpc 包，而 rpc 包可能依赖 protoc-gen-go 生成的消息，
+// 为了避免循环引用，代码生成在消息所在包下面的子包里面，比如 gen/genrpc。
+//
+//	protoc --go_out=. --go_opt=module=self_developed_rpc/rpc/proto \
+//		--gorpc_out=. --gorpc_opt=module=self_developed_rpc/rpc/proto user.proto
+package main
+
+import (
+	"google.golang.org/protobuf/compiler/protogen"
+	"google.golang.org/protobuf/types/pluginpb"
+)
+
+func main() {
+	protogen.Options{}.Run(func(plugin *protogen.Plugin) error {
+		plugin.SupportedFeatures = uint64(pluginpb.CodeGeneratorResponse_FEATURE_PROTO3_OPTIONAL)
+		for _, f := range plugin.Files {
+			if f.Generate {
+				generateFile(plugin, f)
+			}
+		}
+		return nil
+	})
+}
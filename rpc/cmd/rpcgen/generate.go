@@ -0,0 +1,372 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"go/ast"
+	"go/format"
+	"go/parser"
+	"go/printer"
+	"go/token"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+// rpcImportPath 是框架本身的导入路径，生成的代码依赖它
+const rpcImportPath = "self_developed_rpc/rpc"
+
+const unarySignature = "func(ctx context.Context, req *Req) (*Resp, error)"
+
+type config struct {
+	// dir 服务定义所在的目录
+	dir string
+	// typeName 服务定义的类型名
+	typeName string
+	// serviceName 为空的时候从 Name 方法里面解析
+	serviceName string
+	// importPath 是 dir 的导入路径，用来判断生成的代码是不是就在 rpc 包里面
+	importPath string
+	// output 是输出文件名，解析的时候要跳过它
+	output string
+}
+
+type method struct {
+	Name string
+	Req  string
+	Resp string
+}
+
+type service struct {
+	Package string
+	// Base 是生成的类型名的前缀，UserServiceServer 对应 UserService
+	Base        string
+	TypeName    string
+	ServiceName string
+	// Impl 是分发器持有的业务实现的类型
+	Impl string
+	// RPC 是引用框架类型时候的前缀，生成的代码就在 rpc 包里面的时候为空
+	RPC     string
+	Imports []string
+	Methods []method
+}
+
+func generate(cfg config) ([]byte, error) {
+	fset := token.NewFileSet()
+	pkgs, err := parser.ParseDir(fset, cfg.dir, func(fi os.FileInfo) bool {
+		return !strings.HasSuffix(fi.Name(), "_test.go") && fi.Name() != cfg.output
+	}, 0)
+	if err != nil {
+		return nil, err
+	}
+	if len(pkgs) != 1 {
+		return nil, fmt.Errorf("目录 %s 下面应该有且只有一个包", cfg.dir)
+	}
+	var pkg *ast.Package
+	for _, p := range pkgs {
+		pkg = p
+	}
+
+	svc := &service{
+		Package:     pkg.Name,
+		Base:        strings.TrimSuffix(cfg.typeName, "Server"),
+		TypeName:    cfg.typeName,
+		ServiceName: cfg.serviceName,
+		RPC:         "rpc.",
+	}
+	if svc.Base == "" {
+		svc.Base = cfg.typeName
+	}
+	if cfg.importPath == rpcImportPath {
+		svc.RPC = ""
+	}
+
+	p := &parsed{fset: fset, imports: map[string]struct{}{}}
+	typ, file := findType(pkg, cfg.typeName)
+	switch t := typ.(type) {
+	case nil:
+		return nil, fmt.Errorf("找不到类型 %s", cfg.typeName)
+	case *ast.InterfaceType:
+		svc.Impl = cfg.typeName
+		for _, field := range t.Methods.List {
+			ft, ok := field.Type.(*ast.FuncType)
+			if !ok {
+				return nil, fmt.Errorf("接口 %s 不支持内嵌接口", cfg.typeName)
+			}
+			for _, name := range field.Names {
+				if err = p.addMethod(file, name.Name, ft); err != nil {
+					return nil, err
+				}
+			}
+		}
+	default:
+		svc.Impl = "*" + cfg.typeName
+		for _, f := range pkg.Files {
+			for _, decl := range f.Decls {
+				fd, ok := decl.(*ast.FuncDecl)
+				if !ok || fd.Recv == nil || receiverName(fd.Recv) != cfg.typeName {
+					continue
+				}
+				if fd.Name.Name == "Name" && svc.ServiceName == "" {
+					svc.ServiceName = literalName(fd)
+				}
+				if err = p.addMethod(f, fd.Name.Name, fd.Type); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+	if len(p.invalid) > 0 {
+		return nil, fmt.Errorf("服务 %s 的方法 %v 签名不对，必须是 %s", cfg.typeName, p.invalid, unarySignature)
+	}
+	if svc.ServiceName == "" {
+		return nil, fmt.Errorf("无法从 %s 解析服务名，请通过 -name 指定", cfg.typeName)
+	}
+	sort.Slice(p.methods, func(i, j int) bool {
+		return p.methods[i].Name < p.methods[j].Name
+	})
+	svc.Methods = p.methods
+
+	imports := []string{strconv.Quote("context")}
+	if svc.RPC != "" {
+		imports = append(imports, strconv.Quote(rpcImportPath))
+	}
+	imports = append(imports, strconv.Quote(rpcImportPath+"/status"))
+	for spec := range p.imports {
+		imports = append(imports, spec)
+	}
+	sort.Strings(imports[1:])
+	svc.Imports = imports
+
+	var buf bytes.Buffer
+	if err = tpl.Execute(&buf, svc); err != nil {
+		return nil, err
+	}
+	return format.Source(buf.Bytes())
+}
+
+// parsed 收集解析出来的方法和它们用到的导入
+type parsed struct {
+	fset    *token.FileSet
+	methods []method
+	invalid []string
+	// imports 是方法签名里面用到的导入，key 是 import 语句
+	imports map[string]struct{}
+}
+
+func (p *parsed) addMethod(file *ast.File, name string, ft *ast.FuncType) error {
+	if name == "Name" || !ast.IsExported(name) {
+		return nil
+	}
+	params, results := flatten(ft.Params), flatten(ft.Results)
+	if len(params) != 2 || len(results) != 2 ||
+		!isSelector(params[0], "context", "Context") || !isIdent(results[1], "error") {
+		p.invalid = append(p.invalid, name)
+		return nil
+	}
+	req, ok1 := params[1].(*ast.StarExpr)
+	resp, ok2 := results[0].(*ast.StarExpr)
+	if !ok1 || !ok2 {
+		p.invalid = append(p.invalid, name)
+		return nil
+	}
+	reqTyp, err := p.render(file, req.X)
+	if err != nil {
+		return err
+	}
+	respTyp, err := p.render(file, resp.X)
+	if err != nil {
+		return err
+	}
+	p.methods = append(p.methods, method{Name: name, Req: reqTyp, Resp: respTyp})
+	return nil
+}
+
+// render 把类型表达式输出成源码，顺便记录用到的导入
+func (p *parsed) render(file *ast.File, expr ast.Expr) (string, error) {
+	var err error
+	ast.Inspect(expr, func(n ast.Node) bool {
+		sel, ok := n.(*ast.SelectorExpr)
+		if !ok {
+			return true
+		}
+		x, ok := sel.X.(*ast.Ident)
+		if !ok {
+			return true
+		}
+		spec := findImport(file, x.Name)
+		if spec == "" {
+			err = fmt.Errorf("找不到 %s 对应的导入", x.Name)
+			return false
+		}
+		p.imports[spec] = struct{}{}
+		return false
+	})
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	if err = printer.Fprint(&buf, p.fset, expr); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// findImport 返回 name 对应的 import 语句，有别名的时候带上别名
+func findImport(file *ast.File, name string) string {
+	for _, imp := range file.Imports {
+		path, _ := strconv.Unquote(imp.Path.Value)
+		if imp.Name != nil {
+			if imp.Name.Name == name {
+				return imp.Name.Name + " " + imp.Path.Value
+			}
+			continue
+		}
+		if filepath.Base(path) == name {
+			return imp.Path.Value
+		}
+	}
+	return ""
+}
+
+func findType(pkg *ast.Package, name string) (ast.Expr, *ast.File) {
+	for _, f := range pkg.Files {
+		for _, decl := range f.Decls {
+			gd, ok := decl.(*ast.GenDecl)
+			if !ok || gd.Tok != token.TYPE {
+				continue
+			}
+			for _, spec := range gd.Specs {
+				ts := spec.(*ast.TypeSpec)
+				if ts.Name.Name == name {
+					return ts.Type, f
+				}
+			}
+		}
+	}
+	return nil, nil
+}
+
+func receiverName(recv *ast.FieldList) string {
+	typ := recv.List[0].Type
+	if star, ok := typ.(*ast.StarExpr); ok {
+		typ = star.X
+	}
+	if id, ok := typ.(*ast.Ident); ok {
+		return id.Name
+	}
+	return ""
+}
+
+// literalName 解析 func (u *T) Name() string { return "xxx" } 里面的 xxx
+func literalName(fd *ast.FuncDecl) string {
+	if fd.Body == nil || len(fd.Body.List) != 1 {
+		return ""
+	}
+	ret, ok := fd.Body.List[0].(*ast.ReturnStmt)
+	if !ok || len(ret.Results) != 1 {
+		return ""
+	}
+	lit, ok := ret.Results[0].(*ast.BasicLit)
+	if !ok || lit.Kind != token.STRING {
+		return ""
+	}
+	name, _ := strconv.Unquote(lit.Value)
+	return name
+}
+
+// flatten 把 (a, b int) 这种写法展开成一个参数一个类型
+func flatten(fl *ast.FieldList) []ast.Expr {
+	if fl == nil {
+		return nil
+	}
+	var res []ast.Expr
+	for _, f := range fl.List {
+		n := len(f.Names)
+		if n == 0 {
+			n = 1
+		}
+		for i := 0; i < n; i++ {
+			res = append(res, f.Type)
+		}
+	}
+	return res
+}
+
+func isSelector(expr ast.Expr, pkg, name string) bool {
+	sel, ok := expr.(*ast.SelectorExpr)
+	return ok && isIdent(sel.X, pkg) && sel.Sel.Name == name
+}
+
+func isIdent(expr ast.Expr, name string) bool {
+	id, ok := expr.(*ast.Ident)
+	return ok && id.Name == name
+}
+
+var tpl = template.Must(template.New("rpcgen").Parse(`// Code generated by rpcgen. DO NOT EDIT.
+
+package {{.Package}}
+
+import (
+{{- range .Imports}}
+	{{.}}
+{{- end}}
+)
+
+// {{.Base}}Client 是 {{.ServiceName}} 的客户端
+type {{.Base}}Client struct {
+	client *{{.RPC}}Client
+}
+
+func New{{.Base}}Client(client *{{.RPC}}Client) *{{.Base}}Client {
+	return &{{.Base}}Client{client: client}
+}
+
+func (c *{{.Base}}Client) Name() string {
+	return {{printf "%q" .ServiceName}}
+}
+{{range .Methods}}
+func (c *{{$.Base}}Client) {{.Name}}(ctx context.Context, req *{{.Req}}) (*{{.Resp}}, error) {
+	resp := &{{.Resp}}{}
+	err := c.client.Call(ctx, {{printf "%q" $.ServiceName}}, {{printf "%q" .Name}}, req, resp)
+	return resp, err
+}
+{{end}}
+// {{.Base}}Dispatcher 把 {{.ServiceName}} 的请求分发给 {{.TypeName}}
+// 通过 Serve.RegisterDispatcher 注册
+type {{.Base}}Dispatcher struct {
+	impl {{.Impl}}
+}
+
+var _ {{.RPC}}Dispatcher = (*{{.Base}}Dispatcher)(nil)
+
+func New{{.Base}}Dispatcher(impl {{.Impl}}) *{{.Base}}Dispatcher {
+	return &{{.Base}}Dispatcher{impl: impl}
+}
+
+func (d *{{.Base}}Dispatcher) Name() string {
+	return {{printf "%q" .ServiceName}}
+}
+
+func (d *{{.Base}}Dispatcher) Dispatch(ctx context.Context, methodName string, decode func(req any) error) (any, error) {
+	switch methodName {
+{{- range .Methods}}
+	case {{printf "%q" .Name}}:
+		req := &{{.Req}}{}
+		if err := decode(req); err != nil {
+			return nil, err
+		}
+		resp, err := d.impl.{{.Name}}(ctx, req)
+		if resp == nil {
+			return nil, err
+		}
+		return resp, err
+{{- end}}
+	default:
+		return nil, status.Errorf(status.Unimplemented, "micro: 服务 %s 没有方法 %s", {{printf "%q" .ServiceName}}, methodName)
+	}
+}
+`))
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGenerateUpToDate(t *testing.T) {
+	want, err := os.ReadFile("../../userserviceserver_rpcgen.go")
+	require.NoError(t, err)
+	got, err := generate(config{
+		dir:        "../..",
+		typeName:   "UserServiceServer",
+		importPath: rpcImportPath,
+		output:     "userserviceserver_rpcgen.go",
+	})
+	require.NoError(t, err)
+	assert.Equal(t, string(want), string(got), "生成的代码过期了，请执行 go generate")
+}
+
+func TestGenerate(t *testing.T) {
+	testCases := []struct {
+		name string
+		src  string
+		cfg  config
+
+		wantErr error
+		// wantContains 生成的代码里面必须包含的片段
+		wantContains []string
+	}{
+		{
+			name: "interface",
+			src: `package order
+
+import (
+	"context"
+	p "example.com/order/pb"
+)
+
+type OrderServer interface {
+	Create(ctx context.Context, req *p.CreateReq) (*p.CreateResp, error)
+	Cancel(context.Context, *CancelReq) (*CancelResp, error)
+}
+
+type CancelReq struct{}
+type CancelResp struct{}
+`,
+			cfg: config{typeName: "OrderServer", serviceName: "order-service"},
+			wantContains: []string{
+				`p "example.com/order/pb"`,
+				`"self_developed_rpc/rpc"`,
+				"client *rpc.Client",
+				"var _ rpc.Dispatcher = (*OrderDispatcher)(nil)",
+				"impl OrderServer",
+				`c.client.Call(ctx, "order-service", "Create", req, resp)`,
+				"req := &CancelReq{}",
+				"resp, err := d.impl.Create(ctx, req)",
+			},
+		},
+		{
+			name: "interface without name",
+			src: `package order
+
+import "context"
+
+type OrderServer interface {
+	Cancel(context.Context, *CancelReq) (*CancelResp, error)
+}
+
+type CancelReq struct{}
+type CancelResp struct{}
+`,
+			cfg:     config{typeName: "OrderServer"},
+			wantErr: errors.New("无法从 OrderServer 解析服务名，请通过 -name 指定"),
+		},
+		{
+			name: "invalid signature",
+			src: `package order
+
+import "context"
+
+type OrderServer struct{}
+
+func (o OrderServer) Name() string { return "order-service" }
+func (o OrderServer) Cancel(ctx context.Context, req CancelReq) (*CancelResp, error) { return nil, nil }
+func (o OrderServer) Get(ctx context.Context, req *CancelReq) (*CancelResp, error) { return nil, nil }
+func (o OrderServer) helper() {}
+
+type CancelReq struct{}
+type CancelResp struct{}
+`,
+			cfg: config{typeName: "OrderServer"},
+			wantErr: errors.New("服务 OrderServer 的方法 [Cancel] 签名不对，" +
+				"必须是 func(ctx context.Context, req *Req) (*Resp, error)"),
+		},
+		{
+			name:    "type not found",
+			src:     "package order\n",
+			cfg:     config{typeName: "OrderServer"},
+			wantErr: errors.New("找不到类型 OrderServer"),
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			require.NoError(t, os.WriteFile(filepath.Join(dir, "order.go"), []byte(tc.src), 0o644))
+			tc.cfg.dir = dir
+			got, err := generate(tc.cfg)
+			assert.Equal(t, tc.wantErr, err)
+			if err != nil {
+				return
+			}
+			for _, s := range tc.wantContains {
+				assert.Contains(t, string(got), s)
+			}
+		})
+	}
+}
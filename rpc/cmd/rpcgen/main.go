@@ -0,0 +1,67 @@
+// rpcgen 读取一个服务定义（接口或者实现了方法的结构体），生成类型安全的客户端
+// 和基于 switch 的服务端分发器，调用的时候都不需要反射。
+//
+// 一般配合 go:generate 使用：
+//
+//	//go:generate go run self_developed_rpc/rpc/cmd/rpcgen -type UserServiceServer
+//
+// 生成的客户端通过 rpc.Client.Call 发起调用，分发器通过 rpc.Serve.RegisterDispatcher
+// 注册，和反射版本的 InitService / RegisterService 在线上是完全兼容的。
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+func main() {
+	typeName := flag.String("type", "", "服务定义的类型名，可以是接口或者结构体，必填")
+	serviceName := flag.String("name", "", "服务名，默认从类型的 Name 方法里面解析")
+	output := flag.String("output", "", "输出文件，默认是 <类型名小写>_rpcgen.go")
+	flag.Parse()
+	if *typeName == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	dir := "."
+	if flag.NArg() > 0 {
+		dir = flag.Arg(0)
+	}
+	out := *output
+	if out == "" {
+		out = strings.ToLower(*typeName) + "_rpcgen.go"
+	}
+	if !filepath.IsAbs(out) {
+		out = filepath.Join(dir, out)
+	}
+
+	src, err := generate(config{
+		dir:         dir,
+		typeName:    *typeName,
+		serviceName: *serviceName,
+		importPath:  importPath(dir),
+		output:      filepath.Base(out),
+	})
+	if err != nil {
+		log.Fatalf("rpcgen: %v", err)
+	}
+	if err = os.WriteFile(out, src, 0o644); err != nil {
+		log.Fatalf("rpcgen: %v", err)
+	}
+}
+
+// importPath 返回 dir 对应的包导入路径，拿不到的时候返回空字符串
+func importPath(dir string) string {
+	cmd := exec.Command("go", "list", "-f", "{{.ImportPath}}", ".")
+	cmd.Dir = dir
+	out, err := cmd.Output()
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(out))
+}
@@ -0,0 +1,52 @@
+package compress_test
+
+import (
+	"self_developed_rpc/rpc/compress"
+	"self_developed_rpc/rpc/compress/flate"
+	"self_developed_rpc/rpc/compress/gzip"
+	"self_developed_rpc/rpc/compress/zlib"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompressor(t *testing.T) {
+	testCases := []struct {
+		name string
+		c    compress.Compressor
+		data []byte
+	}{
+		{
+			name: "gzip",
+			c:    &gzip.Compressor{},
+			data: []byte(strings.Repeat(`{"Msg":"hello, world"}`, 100)),
+		},
+		{
+			name: "zlib",
+			c:    &zlib.Compressor{},
+			data: []byte(strings.Repeat(`{"Msg":"hello, world"}`, 100)),
+		},
+		{
+			name: "flate",
+			c:    &flate.Compressor{},
+			data: []byte(strings.Repeat(`{"Msg":"hello, world"}`, 100)),
+		},
+		{
+			name: "empty",
+			c:    &gzip.Compressor{},
+			data: []byte{},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			bs, err := tc.c.Compress(tc.data)
+			require.NoError(t, err)
+			data, err := tc.c.Decompress(bs)
+			require.NoError(t, err)
+			assert.Equal(t, tc.data, data)
+		})
+	}
+}
@@ -0,0 +1,35 @@
+package flate
+
+import (
+	"bytes"
+	"compress/flate"
+	"io"
+)
+
+type Compressor struct {
+}
+
+func (c *Compressor) Code() byte {
+	return 3
+}
+
+func (c *Compressor) Compress(data []byte) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	w, err := flate.NewWriter(buf, flate.DefaultCompression)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = w.Write(data); err != nil {
+		return nil, err
+	}
+	if err = w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (c *Compressor) Decompress(data []byte) ([]byte, error) {
+	r := flate.NewReader(bytes.NewReader(data))
+	defer r.Close()
+	return io.ReadAll(r)
+}
@@ -0,0 +1,35 @@
+package gzip
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+)
+
+type Compressor struct {
+}
+
+func (c *Compressor) Code() byte {
+	return 1
+}
+
+func (c *Compressor) Compress(data []byte) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	w := gzip.NewWriter(buf)
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (c *Compressor) Decompress(data []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
@@ -0,0 +1,9 @@
+package compress
+
+// Compressor 压缩算法，Code 会写入协议头的 Compresser 字段
+// Code 为 0 表示不压缩，实现不能使用 0
+type Compressor interface {
+	Code() byte
+	Compress(data []byte) ([]byte, error)
+	Decompress(data []byte) ([]byte, error)
+}
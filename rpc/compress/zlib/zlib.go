@@ -0,0 +1,35 @@
+package zlib
+
+import (
+	"bytes"
+	"compress/zlib"
+	"io"
+)
+
+type Compressor struct {
+}
+
+func (c *Compressor) Code() byte {
+	return 2
+}
+
+func (c *Compressor) Compress(data []byte) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	w := zlib.NewWriter(buf)
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (c *Compressor) Decompress(data []byte) ([]byte, error) {
+	r, err := zlib.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
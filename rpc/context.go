@@ -5,13 +5,102 @@ import "context"
 type onewayKey struct {
 }
 
+// oneWayMode 单向调用的模式，通过元数据 "one-way" 传给服务端
+type oneWayMode string
+
+const (
+	// oneWayNone 普通调用
+	oneWayNone oneWayMode = ""
+	// oneWayFire 服务端不会回复，客户端写成功就返回
+	oneWayFire oneWayMode = "true"
+	// oneWayAck 服务端收到请求之后马上确认，不等业务执行完
+	oneWayAck oneWayMode = "ack"
+)
+
+// CtxWithOneWay 发起单向调用，服务端不会回复，请求写出去之后就返回 nil
+// 业务的结果和错误都拿不到，ctx 的超时时间同样会限制服务端的执行时间
 func CtxWithOneWay(ctx context.Context) context.Context {
 	// 推荐：使用结构体作为key
-	return context.WithValue(ctx, onewayKey{}, true)
+	return context.WithValue(ctx, onewayKey{}, oneWayFire)
+}
+
+// CtxWithOneWayAck 发起需要确认的单向调用，服务端收到请求之后马上回复，不等业务执行完
+// 服务不存在或者服务端正在关闭的时候返回错误，业务的结果和错误同样拿不到
+func CtxWithOneWayAck(ctx context.Context) context.Context {
+	return context.WithValue(ctx, onewayKey{}, oneWayAck)
+}
+
+func oneWayOf(ctx context.Context) oneWayMode {
+	mode, _ := ctx.Value(onewayKey{}).(oneWayMode)
+	return mode
+}
+
+type outgoingKey struct {
+}
+
+type incomingKey struct {
+}
+
+// reservedMetaKeys 框架自己使用的元数据，用户设置的同名元数据不会发给服务端
+var reservedMetaKeys = []string{"one-way", "timeout", "stream", "attempt"}
+
+// NewOutgoingContext 设置要传给服务端的元数据，会覆盖 ctx 里已有的元数据
+// reservedMetaKeys 里面的 key 发送的时候会被去掉
+func NewOutgoingContext(ctx context.Context, md map[string]string) context.Context {
+	return context.WithValue(ctx, outgoingKey{}, copyMeta(md))
+}
+
+// AppendToOutgoing 追加要传给服务端的元数据，kv 是 key, value 交替出现的列表
+// 和 NewOutgoingContext 一样，框架使用的 key 发送的时候会被去掉
+func AppendToOutgoing(ctx context.Context, kv ...string) context.Context {
+	if len(kv)%2 == 1 {
+		panic("rpc: AppendToOutgoing 的参数个数必须是偶数")
+	}
+	md := copyMeta(outgoingMeta(ctx))
+	if md == nil {
+		md = make(map[string]string, len(kv)/2)
+	}
+	for i := 0; i < len(kv); i += 2 {
+		md[kv[i]] = kv[i+1]
+	}
+	return context.WithValue(ctx, outgoingKey{}, md)
+}
+
+// FromIncomingContext 服务端获取客户端传过来的元数据
+// 返回的是副本，可以随意修改
+func FromIncomingContext(ctx context.Context) (map[string]string, bool) {
+	md, ok := ctx.Value(incomingKey{}).(map[string]string)
+	if !ok {
+		return nil, false
+	}
+	return copyMeta(md), true
+}
+
+// userMeta 返回要发送的用户元数据的副本，去掉了框架使用的 key
+func userMeta(ctx context.Context) map[string]string {
+	md := copyMeta(outgoingMeta(ctx))
+	for _, key := range reservedMetaKeys {
+		delete(md, key)
+	}
+	return md
+}
+
+func outgoingMeta(ctx context.Context) map[string]string {
+	md, _ := ctx.Value(outgoingKey{}).(map[string]string)
+	return md
+}
+
+func newIncomingContext(ctx context.Context, md map[string]string) context.Context {
+	return context.WithValue(ctx, incomingKey{}, md)
 }
 
-func isOneWay(ctx context.Context) bool {
-	val := ctx.Value(onewayKey{})
-	oneway, ok := val.(bool)
-	return ok && oneway
+func copyMeta(md map[string]string) map[string]string {
+	if md == nil {
+		return nil
+	}
+	res := make(map[string]string, len(md))
+	for k, v := range md {
+		res[k] = v
+	}
+	return res
 }
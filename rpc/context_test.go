@@ -0,0 +1,74 @@
+package rpc
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOutgoingContext(t *testing.T) {
+	testCases := []struct {
+		name   string
+		ctx    func() context.Context
+		wantMd map[string]string
+	}{
+		{
+			name: "no meta",
+			ctx: func() context.Context {
+				return context.Background()
+			},
+		},
+		{
+			name: "new",
+			ctx: func() context.Context {
+				return NewOutgoingContext(context.Background(), map[string]string{"trace-id": "123"})
+			},
+			wantMd: map[string]string{"trace-id": "123"},
+		},
+		{
+			name: "append",
+			ctx: func() context.Context {
+				ctx := NewOutgoingContext(context.Background(), map[string]string{"trace-id": "123"})
+				return AppendToOutgoing(ctx, "trace-id", "456", "shadow", "true")
+			},
+			wantMd: map[string]string{"trace-id": "456", "shadow": "true"},
+		},
+		{
+			name: "new overwrite",
+			ctx: func() context.Context {
+				ctx := AppendToOutgoing(context.Background(), "shadow", "true")
+				return NewOutgoingContext(ctx, map[string]string{"trace-id": "123"})
+			},
+			wantMd: map[string]string{"trace-id": "123"},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.wantMd, outgoingMeta(tc.ctx()))
+		})
+	}
+}
+
+func TestAppendToOutgoingNotShared(t *testing.T) {
+	parent := AppendToOutgoing(context.Background(), "a", "1")
+	child := AppendToOutgoing(parent, "b", "2")
+	assert.Equal(t, map[string]string{"a": "1"}, outgoingMeta(parent))
+	assert.Equal(t, map[string]string{"a": "1", "b": "2"}, outgoingMeta(child))
+}
+
+func TestFromIncomingContext(t *testing.T) {
+	_, ok := FromIncomingContext(context.Background())
+	assert.False(t, ok)
+
+	md := map[string]string{"trace-id": "123"}
+	ctx := newIncomingContext(context.Background(), md)
+	res, ok := FromIncomingContext(ctx)
+	assert.True(t, ok)
+	assert.Equal(t, md, res)
+	// 修改返回值不影响 ctx 里面的元数据
+	res["trace-id"] = "456"
+	res, _ = FromIncomingContext(ctx)
+	assert.Equal(t, "123", res["trace-id"])
+}
@@ -0,0 +1,238 @@
+package rpc
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"self_developed_rpc/rpc/compress"
+	"self_developed_rpc/rpc/message"
+	"self_developed_rpc/rpc/status"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 建立连接之后，客户端先发一个握手帧，带上自己支持的协议版本、序列化协议和压缩算法
+// 服务端从中选出双方都支持的组合返回，之后这个连接上的请求都按照这个组合来
+// 握手帧本身用 Version0 编码，MessageId 为 0，任何版本的服务端都能解析
+// 老版本的服务端不认识握手帧，会返回服务不存在，这个时候客户端退回到 Version0
+const handshakeServiceName = "rpc.handshake"
+
+const handshakeTimeout = time.Second * 3
+
+// legacyNotFound 是还没有 status 包的服务端在服务不存在的时候直接写回去的错误信息
+const legacyNotFound = "你要调用的服务不存在"
+
+// supportedVersions 按照优先级从高到低排列
+var supportedVersions = []uint8{message.Version1, message.Version0}
+
+// handshakeResult 双方选定的组合，Compressor 为 0 表示不压缩
+type handshakeResult struct {
+	Version    uint8 `json:"version"`
+	Serializer uint8 `json:"serializer"`
+	Compressor uint8 `json:"compressor"`
+}
+
+func encodeCodes(codes []uint8) string {
+	strs := make([]string, 0, len(codes))
+	for _, c := range codes {
+		strs = append(strs, strconv.Itoa(int(c)))
+	}
+	return strings.Join(strs, ",")
+}
+
+func decodeCodes(val string) ([]uint8, error) {
+	if val == "" {
+		return nil, nil
+	}
+	strs := strings.Split(val, ",")
+	res := make([]uint8, 0, len(strs))
+	for _, str := range strs {
+		c, err := strconv.ParseUint(str, 10, 8)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, uint8(c))
+	}
+	return res, nil
+}
+
+// handshake 客户端发起握手，最多等 handshakeTimeout，ctx 的截止时间更早的话以 ctx 为准
+func (c *Client) handshake(ctx context.Context, conn net.Conn) (handshakeResult, error) {
+	versions := make([]uint8, 0, len(supportedVersions))
+	for _, v := range supportedVersions {
+		// c.version 是允许使用的最高版本
+		if v <= c.version {
+			versions = append(versions, v)
+		}
+	}
+	var compressors []uint8
+	if c.compressor != nil {
+		compressors = append(compressors, c.compressor.Code())
+	}
+	req := &message.Request{
+		Version:     message.Version0,
+		ServiceName: handshakeServiceName,
+		Meta: map[string]string{
+			"versions":    encodeCodes(versions),
+			"serializers": encodeCodes([]uint8{c.serializer.Code()}),
+			"compressors": encodeCodes(compressors),
+		},
+	}
+	req.SetHeadLength()
+	req.SetBodyLength()
+
+	deadline := time.Now().Add(handshakeTimeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	if err := conn.SetDeadline(deadline); err != nil {
+		return handshakeResult{}, err
+	}
+	// ctx 取消的时候打断正在进行的读写
+	stop := context.AfterFunc(ctx, func() {
+		_ = conn.SetDeadline(time.Now())
+	})
+	data, err := exchangeHandshake(conn, req, c.maxFrameSize)
+	if !stop() {
+		// 连接的超时时间已经被改掉了，这个连接不能再用
+		return handshakeResult{}, ctx.Err()
+	}
+	if err != nil {
+		return handshakeResult{}, err
+	}
+	if err = conn.SetDeadline(time.Time{}); err != nil {
+		return handshakeResult{}, err
+	}
+	resp, err := message.DecodeResp(data)
+	if err != nil {
+		return handshakeResult{}, err
+	}
+
+	if len(resp.Error) > 0 {
+		st := status.Unmarshal(resp.Error)
+		if !isLegacyServer(st) {
+			// 比如双方没有共同支持的组合，或者服务端出错了
+			return handshakeResult{}, st.Err()
+		}
+		// 老版本的服务端，只能用最早的协议
+		return handshakeResult{
+			Version:    message.Version0,
+			Serializer: c.serializer.Code(),
+			Compressor: compressors0(compressors),
+		}, nil
+	}
+	var res handshakeResult
+	if err = json.Unmarshal(resp.Data, &res); err != nil {
+		return handshakeResult{}, fmt.Errorf("rpc: 解析握手响应失败 %w", err)
+	}
+	return res, nil
+}
+
+// exchangeHandshake 发送握手帧并且读取响应
+func exchangeHandshake(conn net.Conn, req *message.Request, maxFrameSize uint32) ([]byte, error) {
+	if _, err := conn.Write(message.EncodeReq(req)); err != nil {
+		return nil, err
+	}
+	// 这时候读协程还没有启动，直接从连接上读，ReadMsg 不会多读
+	return ReadMsg(conn, maxFrameSize)
+}
+
+// isLegacyServer 只有服务端不认识握手帧的时候才是老版本的服务端
+func isLegacyServer(st *status.Status) bool {
+	switch st.Code() {
+	case status.NotFound, status.Unimplemented:
+		return true
+	case status.Unknown:
+		return st.Message() == legacyNotFound
+	}
+	return false
+}
+
+// compressors0 老版本的服务端用请求的压缩算法来压缩响应，所以可以继续用客户端的压缩算法
+func compressors0(compressors []uint8) uint8 {
+	if len(compressors) == 0 {
+		return 0
+	}
+	return compressors[0]
+}
+
+// handshake 服务端从客户端提供的选项里面，按照客户端给出的顺序选出第一个自己也支持的
+func (s *Serve) handshake(sc *serverConn, req *message.Request) *message.Response {
+	resp := &message.Response{
+		MessageId:  req.MessageId,
+		Version:    req.Version,
+		Serializer: req.Serializer,
+	}
+	res, err := s.negotiate(req)
+	if err != nil {
+		resp.Error = status.Convert(err).Marshal()
+	} else {
+		sc.compressor = s.compressors[res.Compressor]
+		// 这里的字段都是可以序列化的，不会出错
+		resp.Data, _ = json.Marshal(res)
+	}
+	resp.SetHeadLength()
+	resp.SetBodyLength()
+	return resp
+}
+
+func (s *Serve) negotiate(req *message.Request) (handshakeResult, error) {
+	versions, err := decodeCodes(req.Meta["versions"])
+	if err != nil {
+		return handshakeResult{}, status.Errorf(status.InvalidArgument, "micro: 非法的握手数据 %v", err)
+	}
+	serializers, err := decodeCodes(req.Meta["serializers"])
+	if err != nil {
+		return handshakeResult{}, status.Errorf(status.InvalidArgument, "micro: 非法的握手数据 %v", err)
+	}
+	compressors, err := decodeCodes(req.Meta["compressors"])
+	if err != nil {
+		return handshakeResult{}, status.Errorf(status.InvalidArgument, "micro: 非法的握手数据 %v", err)
+	}
+
+	var res handshakeResult
+	var ok bool
+	if res.Version, ok = pick(versions, func(v uint8) bool {
+		for _, sv := range supportedVersions {
+			if sv == v {
+				return true
+			}
+		}
+		return false
+	}); !ok {
+		return handshakeResult{}, status.Errorf(status.FailedPrecondition,
+			"micro: 没有双方都支持的协议版本，客户端 %v，服务端 %v", versions, supportedVersions)
+	}
+	if res.Serializer, ok = pick(serializers, func(c uint8) bool {
+		_, exist := s.serializes[c]
+		return exist
+	}); !ok {
+		return handshakeResult{}, status.Errorf(status.FailedPrecondition,
+			"micro: 没有双方都支持的序列化协议，客户端 %v", serializers)
+	}
+	// 压缩算法没有交集的话就不压缩
+	res.Compressor, _ = pick(compressors, func(c uint8) bool {
+		_, exist := s.compressors[c]
+		return exist
+	})
+	return res, nil
+}
+
+func pick(codes []uint8, supported func(c uint8) bool) (uint8, bool) {
+	for _, c := range codes {
+		if supported(c) {
+			return c, true
+		}
+	}
+	return 0, false
+}
+
+// negotiatedCompressor 握手之后客户端使用的压缩算法
+func (c *Client) negotiatedCompressor(res handshakeResult) compress.Compressor {
+	if c.compressor == nil || res.Compressor != c.compressor.Code() {
+		return nil
+	}
+	return c.compressor
+}
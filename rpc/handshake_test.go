@@ -0,0 +1,217 @@
+package rpc
+
+import (
+	"context"
+	"net"
+	"self_developed_rpc/rpc/compress/gzip"
+	"self_developed_rpc/rpc/message"
+	"self_developed_rpc/rpc/serialize/json"
+	"self_developed_rpc/rpc/serialize/proto"
+	"self_developed_rpc/rpc/status"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServeNegotiate(t *testing.T) {
+	server := NewServer()
+	server.RegisterCompressor(&gzip.Compressor{})
+
+	testCases := []struct {
+		name string
+		meta map[string]string
+
+		wantRes  handshakeResult
+		wantCode status.Code
+	}{
+		{
+			name: "all",
+			meta: map[string]string{"versions": "1,0", "serializers": "1", "compressors": "1"},
+			wantRes: handshakeResult{
+				Version:    message.Version1,
+				Serializer: 1,
+				Compressor: 1,
+			},
+		},
+		{
+			name: "client order",
+			meta: map[string]string{"versions": "0,1", "serializers": "2,1", "compressors": "3,1"},
+			wantRes: handshakeResult{
+				Version:    message.Version0,
+				Serializer: 1,
+				Compressor: 1,
+			},
+		},
+		{
+			name: "no compressor",
+			meta: map[string]string{"versions": "1", "serializers": "1", "compressors": "2"},
+			wantRes: handshakeResult{
+				Version:    message.Version1,
+				Serializer: 1,
+			},
+		},
+		{
+			name:     "no version",
+			meta:     map[string]string{"versions": "5", "serializers": "1"},
+			wantCode: status.FailedPrecondition,
+		},
+		{
+			name:     "no serializer",
+			meta:     map[string]string{"versions": "1", "serializers": "2"},
+			wantCode: status.FailedPrecondition,
+		},
+		{
+			name:     "invalid",
+			meta:     map[string]string{"versions": "a", "serializers": "1"},
+			wantCode: status.InvalidArgument,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			res, err := server.negotiate(&message.Request{ServiceName: handshakeServiceName, Meta: tc.meta})
+			st, _ := status.FromError(err)
+			assert.Equal(t, tc.wantCode, st.Code())
+			assert.Equal(t, tc.wantRes, res)
+		})
+	}
+}
+
+func TestClientHandshakeFallback(t *testing.T) {
+	testCases := []struct {
+		name string
+		// respErr 服务端写回去的 Response.Error
+		respErr []byte
+
+		wantRes  handshakeResult
+		wantCode status.Code
+	}{
+		{
+			// 老版本的服务端直接把错误信息写回去
+			name:    "legacy server",
+			respErr: []byte(legacyNotFound),
+			wantRes: handshakeResult{Version: message.Version0, Serializer: 1, Compressor: 1},
+		},
+		{
+			name:    "not found",
+			respErr: status.New(status.NotFound, "micro: 你要调用的服务 rpc.handshake 不存在").Marshal(),
+			wantRes: handshakeResult{Version: message.Version0, Serializer: 1, Compressor: 1},
+		},
+		{
+			name:    "unimplemented",
+			respErr: status.New(status.Unimplemented, "micro: 不支持握手").Marshal(),
+			wantRes: handshakeResult{Version: message.Version0, Serializer: 1, Compressor: 1},
+		},
+		{
+			name:     "internal",
+			respErr:  status.New(status.Internal, "micro: 服务端出错了").Marshal(),
+			wantCode: status.Internal,
+		},
+		{
+			name:     "resource exhausted",
+			respErr:  status.New(status.ResourceExhausted, "micro: 同时处理的请求太多").Marshal(),
+			wantCode: status.ResourceExhausted,
+		},
+		{
+			name:     "garbled",
+			respErr:  []byte(`{"code":`),
+			wantCode: status.Unknown,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer client.Close()
+			go func() {
+				data, err := ReadMsg(server, 0)
+				if err != nil {
+					return
+				}
+				req, err := message.DecodeReq(data)
+				if err != nil {
+					return
+				}
+				resp := &message.Response{
+					MessageId: req.MessageId,
+					Error:     tc.respErr,
+				}
+				resp.SetHeadLength()
+				resp.SetBodyLength()
+				_, _ = server.Write(message.EncodeResp(resp))
+			}()
+
+			c := &Client{
+				serializer:   &json.Serializer{},
+				compressor:   &gzip.Compressor{},
+				maxFrameSize: defaultMaxFrameSize,
+				version:      message.Version1,
+			}
+			res, err := c.handshake(context.Background(), client)
+			st, _ := status.FromError(err)
+			assert.Equal(t, tc.wantCode, st.Code())
+			assert.Equal(t, tc.wantRes, res)
+		})
+	}
+}
+
+func TestServeLateHandshake(t *testing.T) {
+	server := NewServer()
+	require.NoError(t, server.RegisterService(&sleepService{}))
+	client, conn := net.Pipe()
+	defer client.Close()
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- server.handleConn(&serverConn{conn: conn})
+	}()
+
+	write := func(req *message.Request) {
+		req.SetHeadLength()
+		req.SetBodyLength()
+		_, err := client.Write(message.EncodeReq(req))
+		require.NoError(t, err)
+	}
+	write(&message.Request{
+		MessageId:   1,
+		Serializer:  1,
+		ServiceName: "sleep-service",
+		MethodName:  "Sleep",
+		Data:        []byte(`{}`),
+	})
+	data, err := ReadMsg(client, 0)
+	require.NoError(t, err)
+	resp, err := message.DecodeResp(data)
+	require.NoError(t, err)
+	assert.Empty(t, resp.Error)
+
+	// 已经处理过请求了，再握手会修改其它协程正在读的压缩算法，直接断开连接
+	write(&message.Request{
+		ServiceName: handshakeServiceName,
+		Meta:        map[string]string{"versions": "1", "serializers": "1", "compressors": "1"},
+	})
+	assert.Equal(t, errLateHandshake, <-errCh)
+}
+
+func TestClientHandshakeNoOverlap(t *testing.T) {
+	server := NewServer()
+	go func() {
+		_ = server.Start("tcp", ":8089")
+	}()
+	defer func() {
+		_ = server.Shutdown(context.Background())
+	}()
+	time.Sleep(time.Second)
+
+	// 服务端没有注册 proto 序列化协议，建立连接的时候就失败
+	_, err := NewClient("localhost:8089", ClientWithSerializer(&proto.Serializer{}))
+	st, _ := status.FromError(err)
+	assert.Equal(t, status.FailedPrecondition, st.Code())
+
+	client, err := NewClient("localhost:8089", ClientWithProtocolVersion(message.Version0))
+	require.NoError(t, err)
+	defer client.Close()
+	_, cc, err := client.pick(context.Background(), &message.Request{})
+	require.NoError(t, err)
+	assert.Equal(t, message.Version0, cc.version)
+}
@@ -0,0 +1,104 @@
+package rpc
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strconv"
+	"sync"
+)
+
+// HashKeyFunc 从请求里面取出一致性哈希用的 key，ok 为 false 的时候再看请求结构体上的 rpc:"hashkey" 标签
+// req 是还没有序列化的请求，流式调用里只有服务端流有请求
+type HashKeyFunc func(serviceName, methodName string, req any) (key string, ok bool)
+
+// hashKeyTag 标记请求结构体里面作为哈希 key 的字段，字段只能是字符串或者整数
+//
+//	type GetByIdReq struct {
+//		Id int `rpc:"hashkey"`
+//	}
+const hashKeyTag = "hashkey"
+
+type hashKeyCtxKey struct {
+}
+
+// withHashKey 把请求的哈希 key 放到 ctx 里面，负载均衡的时候通过 balancer.Info 拿到
+func withHashKey(ctx context.Context, fn HashKeyFunc, serviceName, methodName string, req any) (context.Context, error) {
+	if fn != nil {
+		if key, ok := fn(serviceName, methodName, req); ok {
+			return context.WithValue(ctx, hashKeyCtxKey{}, key), nil
+		}
+	}
+	key, ok, err := hashKeyOf(req)
+	if err != nil || !ok {
+		return ctx, err
+	}
+	return context.WithValue(ctx, hashKeyCtxKey{}, key), nil
+}
+
+func hashKeyFromCtx(ctx context.Context) string {
+	key, _ := ctx.Value(hashKeyCtxKey{}).(string)
+	return key
+}
+
+// hashKeyFields 缓存每个请求类型的哈希 key 字段，值是 hashKeyField
+var hashKeyFields sync.Map
+
+type hashKeyField struct {
+	// index 为 nil 说明没有标记 hashkey 的字段
+	index []int
+	err   error
+}
+
+// hashKeyOf 读取 req 里面标记了 hashkey 的字段，req 为 nil 或者没有这样的字段的时候 ok 为 false
+func hashKeyOf(req any) (key string, ok bool, err error) {
+	val := reflect.ValueOf(req)
+	if val.Kind() != reflect.Pointer || val.IsNil() || val.Elem().Kind() != reflect.Struct {
+		return "", false, nil
+	}
+	field := hashKeyFieldOf(val.Type().Elem())
+	if field.err != nil || field.index == nil {
+		return "", false, field.err
+	}
+	f := val.Elem().FieldByIndex(field.index)
+	switch f.Kind() {
+	case reflect.String:
+		return f.String(), true, nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.FormatInt(f.Int(), 10), true, nil
+	default:
+		return strconv.FormatUint(f.Uint(), 10), true, nil
+	}
+}
+
+// hashKeyFieldOf 找到 typ 里面标记了 hashkey 的字段，只看第一层的字段
+func hashKeyFieldOf(typ reflect.Type) hashKeyField {
+	if res, ok := hashKeyFields.Load(typ); ok {
+		return res.(hashKeyField)
+	}
+	res := findHashKeyField(typ)
+	hashKeyFields.Store(typ, res)
+	return res
+}
+
+func findHashKeyField(typ reflect.Type) hashKeyField {
+	var index []int
+	for i := 0; i < typ.NumField(); i++ {
+		f := typ.Field(i)
+		if f.Tag.Get("rpc") != hashKeyTag {
+			continue
+		}
+		if index != nil {
+			return hashKeyField{err: fmt.Errorf("rpc: 请求 %s 只能有一个 hashkey 字段", typ)}
+		}
+		switch f.Type.Kind() {
+		case reflect.String,
+			reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+			reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			index = f.Index
+		default:
+			return hashKeyField{err: fmt.Errorf("rpc: 请求 %s 的 hashkey 字段 %s 必须是字符串或者整数", typ, f.Name)}
+		}
+	}
+	return hashKeyField{index: index}
+}
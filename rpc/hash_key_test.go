@@ -0,0 +1,121 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"self_developed_rpc/rpc/serialize/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type stringKeyReq struct {
+	Name string `rpc:"hashkey"`
+}
+
+type uintKeyReq struct {
+	Id uint64 `rpc:"hashkey"`
+}
+
+type invalidKeyReq struct {
+	Ids []int `rpc:"hashkey"`
+}
+
+type twoKeysReq struct {
+	Id   int    `rpc:"hashkey"`
+	Name string `rpc:"hashkey"`
+}
+
+func TestHashKeyOf(t *testing.T) {
+	testCases := []struct {
+		name string
+		req  any
+
+		wantKey string
+		wantOk  bool
+		wantErr error
+	}{
+		{
+			name:    "int",
+			req:     &GetByIdReq{Id: -123},
+			wantKey: "-123",
+			wantOk:  true,
+		},
+		{
+			name:    "string",
+			req:     &stringKeyReq{Name: "Tom"},
+			wantKey: "Tom",
+			wantOk:  true,
+		},
+		{
+			name:    "uint",
+			req:     &uintKeyReq{Id: 123},
+			wantKey: "123",
+			wantOk:  true,
+		},
+		{
+			name: "no tag",
+			req:  &sleepReq{},
+		},
+		{
+			name: "nil",
+			req:  (*GetByIdReq)(nil),
+		},
+		{
+			name: "no request",
+		},
+		{
+			name:    "invalid type",
+			req:     &invalidKeyReq{},
+			wantErr: errors.New("rpc: 请求 rpc.invalidKeyReq 的 hashkey 字段 Ids 必须是字符串或者整数"),
+		},
+		{
+			name:    "two keys",
+			req:     &twoKeysReq{},
+			wantErr: errors.New("rpc: 请求 rpc.twoKeysReq 只能有一个 hashkey 字段"),
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			key, ok, err := hashKeyOf(tc.req)
+			assert.Equal(t, tc.wantErr, err)
+			assert.Equal(t, tc.wantOk, ok)
+			assert.Equal(t, tc.wantKey, key)
+		})
+	}
+}
+
+func TestWithHashKey(t *testing.T) {
+	fn := func(serviceName, methodName string, req any) (string, bool) {
+		if methodName != "Custom" {
+			return "", false
+		}
+		return "custom", true
+	}
+	// 自定义的函数优先
+	ctx, err := withHashKey(context.Background(), fn, "user-service", "Custom", &GetByIdReq{Id: 1})
+	require.NoError(t, err)
+	assert.Equal(t, "custom", hashKeyFromCtx(ctx))
+	// 返回 false 的时候使用标签
+	ctx, err = withHashKey(context.Background(), fn, "user-service", "GetById", &GetByIdReq{Id: 1})
+	require.NoError(t, err)
+	assert.Equal(t, "1", hashKeyFromCtx(ctx))
+	ctx, err = withHashKey(context.Background(), nil, "user-service", "GetById", &sleepReq{})
+	require.NoError(t, err)
+	assert.Equal(t, "", hashKeyFromCtx(ctx))
+}
+
+type invalidKeyClient struct {
+	Get func(ctx context.Context, req *invalidKeyReq) (*GetByIdResp, error)
+}
+
+func (i *invalidKeyClient) Name() string {
+	return "invalid-key-service"
+}
+
+func TestSetStructFuncHashKey(t *testing.T) {
+	// 初始化的时候就检查 hashkey 标签
+	err := setStructFunc(&invalidKeyClient{}, nil, &json.Serializer{}, nil, nil)
+	assert.Equal(t, errors.New("rpc: 请求 rpc.invalidKeyReq 的 hashkey 字段 Ids 必须是字符串或者整数"), err)
+}
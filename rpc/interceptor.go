@@ -0,0 +1,52 @@
+package rpc
+
+import (
+	"context"
+	"self_developed_rpc/rpc/message"
+)
+
+// Invoker 客户端发起调用，最里层就是 Proxy.Invoke
+type Invoker func(ctx context.Context, req *message.Request) (*message.Response, error)
+
+// ClientInterceptor 客户端拦截器，req 里面有服务名和方法名
+// 调用 invoker 继续执行后面的拦截器和真正的调用，不调用就相当于拦截了这次请求
+type ClientInterceptor func(ctx context.Context, req *message.Request, invoker Invoker) (*message.Response, error)
+
+// Handler 服务端处理请求，最里层就是 Serve.Invoke
+type Handler func(ctx context.Context, req *message.Request) (*message.Response, error)
+
+// ServerInterceptor 服务端拦截器，用法和 ClientInterceptor 一样
+type ServerInterceptor func(ctx context.Context, req *message.Request, handler Handler) (*message.Response, error)
+
+// proxyFunc 让函数可以作为 Proxy 使用
+type proxyFunc func(ctx context.Context, req *message.Request) (*message.Response, error)
+
+func (f proxyFunc) Invoke(ctx context.Context, req *message.Request) (*message.Response, error) {
+	return f(ctx, req)
+}
+
+// chainClientInterceptors 第一个拦截器在最外层
+func chainClientInterceptors(p Proxy, interceptors []ClientInterceptor) Proxy {
+	if len(interceptors) == 0 {
+		return p
+	}
+	invoker := Invoker(p.Invoke)
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		interceptor, next := interceptors[i], invoker
+		invoker = func(ctx context.Context, req *message.Request) (*message.Response, error) {
+			return interceptor(ctx, req, next)
+		}
+	}
+	return proxyFunc(invoker)
+}
+
+// chainServerInterceptors 第一个拦截器在最外层
+func chainServerInterceptors(handler Handler, interceptors []ServerInterceptor) Handler {
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		interceptor, next := interceptors[i], handler
+		handler = func(ctx context.Context, req *message.Request) (*message.Response, error) {
+			return interceptor(ctx, req, next)
+		}
+	}
+	return handler
+}
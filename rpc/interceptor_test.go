@@ -0,0 +1,146 @@
+package rpc
+
+import (
+	"context"
+	"self_developed_rpc/rpc/compress/gzip"
+	"self_developed_rpc/rpc/message"
+	"self_developed_rpc/rpc/status"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestChainClientInterceptors(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	var logs []string
+	build := func(name string) ClientInterceptor {
+		return func(ctx context.Context, req *message.Request, invoker Invoker) (*message.Response, error) {
+			logs = append(logs, name+" before "+req.MethodName)
+			resp, err := invoker(ctx, req)
+			logs = append(logs, name+" after")
+			return resp, err
+		}
+	}
+	proxy := NewMockProxy(ctrl)
+	proxy.EXPECT().Invoke(gomock.Any(), gomock.Any()).DoAndReturn(
+		func(ctx context.Context, req *message.Request) (*message.Response, error) {
+			logs = append(logs, "invoke")
+			return &message.Response{}, nil
+		})
+
+	p := chainClientInterceptors(proxy, []ClientInterceptor{build("first"), build("second")})
+	_, err := p.Invoke(context.Background(), &message.Request{MethodName: "GetById"})
+	require.NoError(t, err)
+	assert.Equal(t, []string{
+		"first before GetById", "second before GetById", "invoke", "second after", "first after",
+	}, logs)
+}
+
+func TestServeUse(t *testing.T) {
+	server := NewServer()
+	server.RegisterService(&metaService{})
+	server.Use(func(ctx context.Context, req *message.Request, handler Handler) (*message.Response, error) {
+		if req.Meta["token"] != "123" {
+			// 拦截请求，不调用 handler
+			return nil, status.Errorf(status.PermissionDenied, "micro: 没有权限")
+		}
+		return handler(ctx, req)
+	})
+
+	testCases := []struct {
+		name    string
+		meta    map[string]string
+		wantErr []byte
+	}{
+		{
+			name:    "reject",
+			wantErr: status.New(status.PermissionDenied, "micro: 没有权限").Marshal(),
+		},
+		{
+			name: "pass",
+			meta: map[string]string{"token": "123"},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := &message.Request{
+				MessageId:   1,
+				Serializer:  1,
+				ServiceName: "meta-service",
+				MethodName:  "Get",
+				Meta:        tc.meta,
+				Data:        []byte(`{"Key":"token"}`),
+			}
+			resp := server.handleReq(&serverConn{}, req)
+			assert.Equal(t, uint32(1), resp.MessageId)
+			assert.Equal(t, tc.wantErr, resp.Error)
+		})
+	}
+}
+
+func TestServeUseContext(t *testing.T) {
+	c := &gzip.Compressor{}
+	server := NewServer()
+	server.RegisterCompressor(c)
+	require.NoError(t, server.RegisterService(&metaService{}))
+	var (
+		md          map[string]string
+		hasDeadline bool
+		data        string
+	)
+	// 拦截器看到的是解压之后的数据，ctx 里面有元数据和客户端的超时时间
+	server.Use(func(ctx context.Context, req *message.Request, handler Handler) (*message.Response, error) {
+		md, _ = FromIncomingContext(ctx)
+		_, hasDeadline = ctx.Deadline()
+		data = string(req.Data)
+		if md["token"] != "123" {
+			return nil, status.Errorf(status.PermissionDenied, "micro: 没有权限")
+		}
+		return handler(ctx, req)
+	})
+
+	compressed, err := c.Compress([]byte(`{"Key":"token"}`))
+	require.NoError(t, err)
+	req := &message.Request{
+		MessageId:   1,
+		Serializer:  1,
+		Compresser:  c.Code(),
+		ServiceName: "meta-service",
+		MethodName:  "Get",
+		Meta: map[string]string{
+			"token":   "123",
+			"timeout": strconv.FormatInt(int64(time.Second), 10),
+		},
+		Data: compressed,
+	}
+	resp := server.handleReq(&serverConn{}, req)
+	assert.Empty(t, resp.Error)
+	assert.Equal(t, "123", md["token"])
+	assert.True(t, hasDeadline)
+	assert.Equal(t, `{"Key":"token"}`, data)
+	assert.Equal(t, `{"Value":"123"}`, string(resp.Data))
+}
+
+func TestServeUsePanic(t *testing.T) {
+	server := NewServer()
+	require.NoError(t, server.RegisterService(&metaService{}))
+	server.Use(func(ctx context.Context, req *message.Request, handler Handler) (*message.Response, error) {
+		panic("拦截器出错了")
+	})
+	resp := server.handleReq(&serverConn{}, &message.Request{
+		MessageId:   1,
+		Serializer:  1,
+		ServiceName: "meta-service",
+		MethodName:  "Get",
+		Data:        []byte(`{"Key":"token"}`),
+	})
+	assert.Equal(t, uint32(1), resp.MessageId)
+	assert.Equal(t, status.Internal, status.Unmarshal(resp.Error).Code())
+}
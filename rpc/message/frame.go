@@ -0,0 +1,127 @@
+package message
+
+import "encoding/binary"
+
+// FrameType 流帧的类型
+type FrameType uint8
+
+const (
+	// FrameData 流上的一条消息
+	FrameData FrameType = 1
+	// FrameEnd 发送方不会再发数据了
+	// 客户端发出来表示半关闭，服务端发出来表示整个流结束，Error 不为空的时候是流的错误 trailer
+	FrameEnd FrameType = 2
+	// FrameWindowUpdate 接收方归还发送额度，Data 是 4 个字节的额度增量
+	FrameWindowUpdate FrameType = 3
+	// FrameCancel 客户端放弃这个流，服务端应该停止处理
+	FrameCancel FrameType = 4
+)
+
+// windowIncrementLength FrameWindowUpdate 的数据部分的长度
+const windowIncrementLength = 4
+
+// frameFlag 流帧和请求、响应共用固定头部，Version 的位置上设置最高位来区分
+// Version 目前只用到了低位，老版本的实现会把流帧当成不认识的版本
+const frameFlag uint8 = 0x80
+
+// Frame 是流上的帧，StreamId 就是打开流的那个请求的 MessageId
+// 编码格式和 Response 一样，Error 放在头部，Data 放在数据部分
+type Frame struct {
+	HeadLength uint32
+	BodyLength uint32
+	StreamId   uint32
+	Type       FrameType
+	Compresser uint8
+	Serializer uint8
+
+	Error []byte
+
+	Data []byte
+}
+
+// IsFrame 判断 data 是不是流帧，data 至少要有固定头部的长度
+func IsFrame(data []byte) bool {
+	return len(data) >= headerLength && data[12]&frameFlag != 0
+}
+
+// NewWindowUpdate 创建归还 increment 字节发送额度的帧
+func NewWindowUpdate(streamId, increment uint32) *Frame {
+	f := &Frame{
+		StreamId: streamId,
+		Type:     FrameWindowUpdate,
+		Data:     binary.BigEndian.AppendUint32(nil, increment),
+	}
+	f.SetHeadLength()
+	f.SetBodyLength()
+	return f
+}
+
+// Increment 返回 FrameWindowUpdate 携带的额度增量
+func (f *Frame) Increment() uint32 {
+	if f.Type != FrameWindowUpdate || len(f.Data) != windowIncrementLength {
+		return 0
+	}
+	return binary.BigEndian.Uint32(f.Data)
+}
+
+// Size 是帧编码之后的长度，流控按照它来计算额度
+func (f *Frame) Size() uint32 {
+	return f.HeadLength + f.BodyLength
+}
+
+func (f *Frame) SetHeadLength() {
+	f.HeadLength = uint32(headerLength + len(f.Error))
+}
+
+func (f *Frame) SetBodyLength() {
+	f.BodyLength = uint32(len(f.Data))
+}
+
+func EncodeFrame(f *Frame) []byte {
+	bs := make([]byte, f.HeadLength+f.BodyLength)
+	binary.BigEndian.PutUint32(bs[:4], f.HeadLength)
+	binary.BigEndian.PutUint32(bs[4:8], f.BodyLength)
+	binary.BigEndian.PutUint32(bs[8:12], f.StreamId)
+	bs[12] = frameFlag | uint8(f.Type)
+	bs[13] = f.Compresser
+	bs[14] = f.Serializer
+	cur := bs[headerLength:]
+	copy(cur, f.Error)
+	copy(cur[len(f.Error):], f.Data)
+	return bs
+}
+
+// DecodeFrame 不会 panic，数据不合法的时候返回 ErrMalformed
+func DecodeFrame(data []byte) (*Frame, error) {
+	headLength, bodyLength, err := decodeHeader(data)
+	if err != nil {
+		return nil, err
+	}
+	if data[12]&frameFlag == 0 {
+		return nil, malformed("不是流帧")
+	}
+	f := &Frame{
+		HeadLength: headLength,
+		BodyLength: bodyLength,
+		StreamId:   binary.BigEndian.Uint32(data[8:12]),
+		Type:       FrameType(data[12] &^ frameFlag),
+		Compresser: data[13],
+		Serializer: data[14],
+	}
+	switch f.Type {
+	case FrameData, FrameEnd, FrameCancel:
+	case FrameWindowUpdate:
+		if bodyLength != windowIncrementLength {
+			return nil, malformed("额度增量的长度 %d 不对", bodyLength)
+		}
+	default:
+		return nil, malformed("不认识的流帧类型 %d", f.Type)
+	}
+	if headLength > headerLength {
+		f.Error = data[headerLength:headLength]
+	}
+	if bodyLength > 0 {
+		f.Data = data[headLength:]
+	}
+	return f, nil
+}
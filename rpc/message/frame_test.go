@@ -0,0 +1,100 @@
+package message
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEncodeDecodeFrame(t *testing.T) {
+	testCases := []struct {
+		name  string
+		frame *Frame
+	}{
+		{
+			name: "data",
+			frame: &Frame{
+				StreamId:   123,
+				Type:       FrameData,
+				Compresser: 1,
+				Serializer: 2,
+				Data:       []byte("hello, world"),
+			},
+		},
+		{
+			name: "end",
+			frame: &Frame{
+				StreamId:   123,
+				Type:       FrameEnd,
+				Serializer: 2,
+			},
+		},
+		{
+			name:  "window update",
+			frame: NewWindowUpdate(123, 65536),
+		},
+		{
+			name: "cancel",
+			frame: &Frame{
+				StreamId: 123,
+				Type:     FrameCancel,
+			},
+		},
+		{
+			name: "end with error",
+			frame: &Frame{
+				StreamId:   123,
+				Type:       FrameEnd,
+				Serializer: 2,
+				Error:      []byte(`{"code":13,"message":"error"}`),
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.frame.SetHeadLength()
+			tc.frame.SetBodyLength()
+			data := EncodeFrame(tc.frame)
+			assert.True(t, IsFrame(data))
+			f, err := DecodeFrame(data)
+			require.NoError(t, err)
+			assert.Equal(t, tc.frame, f)
+
+			// 老的实现会把流帧当成不认识的版本
+			_, err = DecodeReq(data)
+			assert.ErrorIs(t, err, ErrUnsupportedVersion)
+		})
+	}
+}
+
+func TestDecodeFrameMalformed(t *testing.T) {
+	req := &Request{Version: Version1, ServiceName: "user-service", MethodName: "GetById"}
+	req.SetHeadLength()
+	data := EncodeReq(req)
+	assert.False(t, IsFrame(data))
+	_, err := DecodeFrame(data)
+	assert.ErrorIs(t, err, ErrMalformed)
+
+	f := &Frame{StreamId: 1, Type: 9}
+	f.SetHeadLength()
+	_, err = DecodeFrame(EncodeFrame(f))
+	assert.ErrorIs(t, err, ErrMalformed)
+
+	f = &Frame{StreamId: 1, Type: FrameWindowUpdate, Data: []byte{1, 2}}
+	f.SetHeadLength()
+	f.SetBodyLength()
+	_, err = DecodeFrame(EncodeFrame(f))
+	assert.ErrorIs(t, err, ErrMalformed)
+
+	_, err = DecodeFrame([]byte{0, 0})
+	assert.ErrorIs(t, err, ErrMalformed)
+}
+
+func TestWindowUpdate(t *testing.T) {
+	f := NewWindowUpdate(12, 1024)
+	assert.Equal(t, uint32(1024), f.Increment())
+	assert.Equal(t, uint32(headerLength+4), f.Size())
+	assert.Equal(t, uint32(0), (&Frame{Type: FrameData, Data: f.Data}).Increment())
+}
@@ -0,0 +1,107 @@
+package message
+
+import "encoding/binary"
+
+// Version1 的头部编码：
+// 服务名长度 | 服务名 | 方法名长度 | 方法名 | 元数据个数 | (key 长度 | key | value 长度 | value)...
+// 长度和个数都是 uvarint，字符串里面可以出现任意字节
+
+func uvarintLen(x uint64) int {
+	res := 1
+	for x >= 0x80 {
+		x >>= 7
+		res++
+	}
+	return res
+}
+
+func stringLenV1(str string) int {
+	return uvarintLen(uint64(len(str))) + len(str)
+}
+
+func headLengthV1(req *Request) int {
+	res := stringLenV1(req.ServiceName)
+	res += stringLenV1(req.MethodName)
+	res += uvarintLen(uint64(len(req.Meta)))
+	for key, value := range req.Meta {
+		res += stringLenV1(key)
+		res += stringLenV1(value)
+	}
+	return res
+}
+
+func putStringV1(cur []byte, str string) []byte {
+	n := binary.PutUvarint(cur, uint64(len(str)))
+	copy(cur[n:], str)
+	return cur[n+len(str):]
+}
+
+func encodeHeaderV1(cur []byte, req *Request) []byte {
+	cur = putStringV1(cur, req.ServiceName)
+	cur = putStringV1(cur, req.MethodName)
+	n := binary.PutUvarint(cur, uint64(len(req.Meta)))
+	cur = cur[n:]
+	for key, value := range req.Meta {
+		cur = putStringV1(cur, key)
+		cur = putStringV1(cur, value)
+	}
+	return cur
+}
+
+func readUvarintV1(header []byte) (uint64, []byte, error) {
+	val, n := binary.Uvarint(header)
+	if n <= 0 {
+		return 0, nil, malformed("长度字段不合法")
+	}
+	return val, header[n:], nil
+}
+
+func readStringV1(header []byte) (string, []byte, error) {
+	length, header, err := readUvarintV1(header)
+	if err != nil {
+		return "", nil, err
+	}
+	if length > uint64(len(header)) {
+		return "", nil, malformed("字符串长度 %d 超过了头部剩余长度 %d", length, len(header))
+	}
+	return string(header[:length]), header[length:], nil
+}
+
+func decodeHeaderV1(header []byte, req *Request) error {
+	var err error
+	req.ServiceName, header, err = readStringV1(header)
+	if err != nil {
+		return err
+	}
+	req.MethodName, header, err = readStringV1(header)
+	if err != nil {
+		return err
+	}
+	cnt, header, err := readUvarintV1(header)
+	if err != nil {
+		return err
+	}
+	// 每个键值对至少两个字节，避免按照伪造的个数分配过大的 map
+	if cnt > uint64(len(header))/2 {
+		return malformed("元数据个数 %d 超过了头部剩余长度", cnt)
+	}
+	if cnt > 0 {
+		req.Meta = make(map[string]string, cnt)
+	}
+	for i := uint64(0); i < cnt; i++ {
+		var key, value string
+		key, header, err = readStringV1(header)
+		if err != nil {
+			return err
+		}
+		value, header, err = readStringV1(header)
+		if err != nil {
+			return err
+		}
+		req.Meta[key] = value
+	}
+	if len(header) > 0 {
+		return malformed("头部有多余的数据")
+	}
+	return nil
+}
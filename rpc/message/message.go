@@ -3,14 +3,53 @@ package message
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
+	"fmt"
 )
 
-// 头部不定长字段的分隔符
+// headerLength 头部固定部分的长度
+const headerLength = 15
+
+// ErrMalformed 数据不符合协议格式
+var ErrMalformed = errors.New("message: 非法的数据")
+
+func malformed(format string, args ...any) error {
+	return fmt.Errorf("%w, %s", ErrMalformed, fmt.Sprintf(format, args...))
+}
+
+// decodeHeader 校验并解析头部固定部分，返回 HeadLength 和 BodyLength
+func decodeHeader(data []byte) (uint32, uint32, error) {
+	if len(data) < headerLength {
+		return 0, 0, malformed("长度 %d 小于固定头部长度", len(data))
+	}
+	headLength := binary.BigEndian.Uint32(data[:4])
+	bodyLength := binary.BigEndian.Uint32(data[4:8])
+	if headLength < headerLength {
+		return 0, 0, malformed("头部长度 %d 小于固定头部长度", headLength)
+	}
+	if uint64(headLength)+uint64(bodyLength) != uint64(len(data)) {
+		return 0, 0, malformed("头部长度 %d 加上数据长度 %d 和实际长度 %d 不一致", headLength, bodyLength, len(data))
+	}
+	return headLength, bodyLength, nil
+}
+
+// 头部不定长字段的分隔符，只有 Version0 使用
 const (
 	splitter     = '\n'
 	pairSplitter = '\r'
 )
 
+// Version 决定了请求头部不定长字段的编码方式
+const (
+	// Version0 用分隔符隔开服务名、方法名和元数据，这些字段里面不能出现分隔符
+	Version0 uint8 = 0
+	// Version1 每个字符串前面带上长度，可以放任意内容
+	Version1 uint8 = 1
+)
+
+// ErrUnsupportedVersion 不认识的协议版本
+var ErrUnsupportedVersion = errors.New("message: 不支持的协议版本")
+
 type Request struct {
 	// 头部
 	// 消息长度
@@ -40,7 +79,16 @@ type Request struct {
 func (req *Request) SetHeadLength() {
 	// uint32 => 4个字节
 	res := 15
-	res += len(req.ServiceName)
+	if req.Version == Version1 {
+		res += headLengthV1(req)
+	} else {
+		res += headLengthV0(req)
+	}
+	req.HeadLength = uint32(res)
+}
+
+func headLengthV0(req *Request) int {
+	res := len(req.ServiceName)
 	// 分隔符
 	res++
 	res += len(req.MethodName)
@@ -52,7 +100,7 @@ func (req *Request) SetHeadLength() {
 		res += len(value)
 		res++
 	}
-	req.HeadLength = uint32(res)
+	return res
 }
 
 func (req *Request) SetBodyLength() {
@@ -71,6 +119,19 @@ func EncodeReq(req *Request) []byte {
 	cur[14] = req.Serializer
 	cur = cur[15:]
 
+	if req.Version == Version1 {
+		cur = encodeHeaderV1(cur, req)
+	} else {
+		cur = encodeHeaderV0(cur, req)
+	}
+	if req.BodyLength > 0 {
+		// 剩下的数据
+		copy(cur, req.Data)
+	}
+	return bs
+}
+
+func encodeHeaderV0(cur []byte, req *Request) []byte {
 	copy(cur, req.ServiceName)
 	cur[len(req.ServiceName)] = splitter
 	cur = cur[len(req.ServiceName)+1:]
@@ -88,29 +149,55 @@ func EncodeReq(req *Request) []byte {
 		cur[len(value)] = splitter
 		cur = cur[len(value)+1:]
 	}
-	if req.BodyLength > 0 {
-		// 剩下的数据
-		copy(cur, req.Data)
-	}
-	return bs
+	return cur
 }
 
-func DecodeReq(data []byte) *Request {
+// DecodeReq 不会 panic，数据不合法的时候返回 ErrMalformed
+func DecodeReq(data []byte) (*Request, error) {
+	headLength, bodyLength, err := decodeHeader(data)
+	if err != nil {
+		return nil, err
+	}
 	req := &Request{}
-	req.HeadLength = binary.BigEndian.Uint32(data[:4])
-	req.HeadLength = binary.BigEndian.Uint32(data[:4])
-	req.BodyLength = binary.BigEndian.Uint32(data[4:8])
+	req.HeadLength = headLength
+	req.BodyLength = bodyLength
 	req.MessageId = binary.BigEndian.Uint32(data[8:12])
 	req.Version = data[12]
 	req.Compresser = data[13]
 	req.Serializer = data[14]
-	meta := data[15:req.HeadLength]
+	header := data[15:req.HeadLength]
+
+	switch req.Version {
+	case Version0:
+		err = decodeHeaderV0(header, req)
+	case Version1:
+		err = decodeHeaderV1(header, req)
+	default:
+		err = fmt.Errorf("%w %d", ErrUnsupportedVersion, req.Version)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if req.BodyLength > 0 {
+		// 剩下的就是数据了
+		req.Data = data[req.HeadLength:]
+	}
+	return req, nil
+}
 
+func decodeHeaderV0(meta []byte, req *Request) error {
 	index := bytes.IndexByte(meta, splitter)
+	if index == -1 {
+		return malformed("缺少服务名")
+	}
 	req.ServiceName = string(meta[:index])
 	meta = meta[index+1:]
 
 	index = bytes.IndexByte(meta, splitter)
+	if index == -1 {
+		return malformed("缺少方法名")
+	}
 	req.MethodName = string(meta[:index])
 	meta = meta[index+1:]
 
@@ -124,19 +211,20 @@ func DecodeReq(data []byte) *Request {
 		for index != -1 {
 			pair := meta[:index]
 			pairIndex := bytes.IndexByte(pair, pairSplitter)
+			if pairIndex == -1 {
+				return malformed("元数据缺少键值分隔符")
+			}
 			metaMap[string(pair[:pairIndex])] = string(pair[pairIndex+1:])
 
 			meta = meta[index+1:]
 			index = bytes.IndexByte(meta, splitter)
 		}
+		if len(meta) > 0 {
+			return malformed("元数据没有以分隔符结尾")
+		}
 		req.Meta = metaMap
 	}
-
-	if req.BodyLength > 0 {
-		// 剩下的就是数据了
-		req.Data = data[req.HeadLength:]
-	}
-	return req
+	return nil
 }
 
 type Response struct {
@@ -184,11 +272,15 @@ func EncodeResp(resp *Response) []byte {
 	return bs
 }
 
-func DecodeResp(data []byte) *Response {
+// DecodeResp 不会 panic，数据不合法的时候返回 ErrMalformed
+func DecodeResp(data []byte) (*Response, error) {
+	headLength, bodyLength, err := decodeHeader(data)
+	if err != nil {
+		return nil, err
+	}
 	resp := &Response{}
-	resp.HeadLength = binary.BigEndian.Uint32(data[:4])
-	resp.HeadLength = binary.BigEndian.Uint32(data[:4])
-	resp.BodyLength = binary.BigEndian.Uint32(data[4:8])
+	resp.HeadLength = headLength
+	resp.BodyLength = bodyLength
 	resp.MessageId = binary.BigEndian.Uint32(data[8:12])
 	resp.Version = data[12]
 	resp.Compresser = data[13]
@@ -202,7 +294,7 @@ func DecodeResp(data []byte) *Response {
 		// 剩下的就是数据了
 		resp.Data = data[resp.HeadLength:]
 	}
-	return resp
+	return resp, nil
 }
 
 func (r *Response) SetHeadLength() {
@@ -2,7 +2,10 @@
 package message
 
 import (
+	"encoding/binary"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"strings"
 	"testing"
 )
 
@@ -15,7 +18,7 @@ func TestEncodeDecodeRequest(t *testing.T) {
 			name: "with meta",
 			req: &Request{
 				MessageId:   123,
-				Version:     12,
+				Version:     Version0,
 				Compresser:  25,
 				Serializer:  17,
 				ServiceName: "user-service",
@@ -32,7 +35,7 @@ func TestEncodeDecodeRequest(t *testing.T) {
 			name: "no meta",
 			req: &Request{
 				MessageId:   123,
-				Version:     12,
+				Version:     Version0,
 				Compresser:  25,
 				Serializer:  17,
 				ServiceName: "user-service",
@@ -44,7 +47,7 @@ func TestEncodeDecodeRequest(t *testing.T) {
 			name: "empty value",
 			req: &Request{
 				MessageId:   123,
-				Version:     12,
+				Version:     Version0,
 				Compresser:  25,
 				Serializer:  17,
 				ServiceName: "user-service",
@@ -56,6 +59,48 @@ func TestEncodeDecodeRequest(t *testing.T) {
 				},
 			},
 		},
+		{
+			name: "v1 with meta",
+			req: &Request{
+				MessageId:   123,
+				Version:     Version1,
+				Compresser:  25,
+				Serializer:  17,
+				ServiceName: "user-service",
+				MethodName:  "GetById",
+				Meta: map[string]string{
+					"trace-id": "123",
+					"token":    "line1\nline2\r\n",
+					"json":     `{"a":"b"}`,
+				},
+				Data: []byte("hello, world"),
+			},
+		},
+		{
+			name: "v1 no meta",
+			req: &Request{
+				MessageId:   123,
+				Version:     Version1,
+				Compresser:  25,
+				Serializer:  17,
+				ServiceName: "user\nservice",
+				MethodName:  "GetById",
+				Data:        []byte("hello, world"),
+			},
+		},
+		{
+			name: "v1 long value",
+			req: &Request{
+				MessageId:   123,
+				Version:     Version1,
+				ServiceName: "user-service",
+				MethodName:  "GetById",
+				Meta: map[string]string{
+					"token": strings.Repeat("a", 1000),
+					"":      "",
+				},
+			},
+		},
 	}
 
 	for _, tc := range testCases {
@@ -63,7 +108,8 @@ func TestEncodeDecodeRequest(t *testing.T) {
 			tc.req.SetHeadLength()
 			tc.req.SetBodyLength()
 			bs := EncodeReq(tc.req)
-			req := DecodeReq(bs)
+			req, err := DecodeReq(bs)
+			require.NoError(t, err)
 			assert.Equal(t, tc.req, req)
 		})
 	}
@@ -112,8 +158,164 @@ func TestEncodeDecodeResponse(t *testing.T) {
 			tc.resp.SetHeadLength()
 			tc.resp.SetBodyLength()
 			bs := EncodeResp(tc.resp)
-			resp := DecodeResp(bs)
+			resp, err := DecodeResp(bs)
+			require.NoError(t, err)
 			assert.Equal(t, tc.resp, resp)
 		})
 	}
 }
+
+func TestDecodeMalformed(t *testing.T) {
+	header := func(headLength, bodyLength uint32, rest string) []byte {
+		bs := make([]byte, 15, 15+len(rest))
+		binary.BigEndian.PutUint32(bs[:4], headLength)
+		binary.BigEndian.PutUint32(bs[4:8], bodyLength)
+		return append(bs, rest...)
+	}
+
+	testCases := []struct {
+		name string
+		data []byte
+	}{
+		{
+			name: "short",
+			data: []byte("hello"),
+		},
+		{
+			name: "head length too small",
+			data: header(3, 0, ""),
+		},
+		{
+			name: "length mismatch",
+			data: header(100, 0, "user-service\nGetById\n"),
+		},
+		{
+			name: "no service name",
+			data: header(15+12, 0, "user-service"),
+		},
+		{
+			name: "no method name",
+			data: header(15+13+7, 0, "user-service\nGetById"),
+		},
+		{
+			name: "no pair splitter",
+			data: header(15+21+4, 0, "user-service\nGetById\nabc\n"),
+		},
+		{
+			name: "meta without splitter",
+			data: header(15+21+3, 0, "user-service\nGetById\na\rb"),
+		},
+		{
+			name: "unsupported version",
+			data: func() []byte {
+				bs := header(15+21, 0, "user-service\nGetById\n")
+				bs[12] = 12
+				return bs
+			}(),
+		},
+		{
+			name: "v1 string too long",
+			data: func() []byte {
+				bs := header(15+3, 0, "\x10ab")
+				bs[12] = Version1
+				return bs
+			}(),
+		},
+		{
+			name: "v1 too many meta",
+			data: func() []byte {
+				bs := header(15+5, 0, "\x00\x00\xff\xff\x03")
+				bs[12] = Version1
+				return bs
+			}(),
+		},
+		{
+			name: "v1 trailing bytes",
+			data: func() []byte {
+				bs := header(15+4, 0, "\x00\x00\x00a")
+				bs[12] = Version1
+				return bs
+			}(),
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := DecodeReq(tc.data)
+			assert.Error(t, err)
+		})
+	}
+
+	_, err := DecodeResp(header(15, 10, ""))
+	assert.ErrorIs(t, err, ErrMalformed)
+}
+
+func FuzzEncodeDecodeRequest(f *testing.F) {
+	f.Add(uint32(123), uint8(12), uint8(25), uint8(17), "user-service", "GetById", "trace-id", "123", []byte("hello, world"))
+	f.Add(uint32(0), uint8(0), uint8(0), uint8(0), "", "", "", "", []byte{})
+	f.Add(uint32(1), Version1, uint8(0), uint8(1), "user\nservice", "Get\rById", "token", "a\nb", []byte("hello"))
+	f.Fuzz(func(t *testing.T, messageId uint32, version, compresser, serializer uint8,
+		serviceName, methodName, key, value string, data []byte) {
+		version %= 2
+		// Version0 的分隔符不能出现在头部的字符串里面
+		for _, str := range []string{serviceName, methodName, key, value} {
+			if version == Version0 && strings.ContainsAny(str, string([]byte{splitter, pairSplitter})) {
+				t.Skip()
+			}
+		}
+		req := &Request{
+			MessageId:   messageId,
+			Version:     version,
+			Compresser:  compresser,
+			Serializer:  serializer,
+			ServiceName: serviceName,
+			MethodName:  methodName,
+			Data:        data,
+		}
+		if key != "" {
+			req.Meta = map[string]string{key: value}
+		}
+		if len(data) == 0 {
+			req.Data = nil
+		}
+		req.SetHeadLength()
+		req.SetBodyLength()
+		res, err := DecodeReq(EncodeReq(req))
+		require.NoError(t, err)
+		assert.Equal(t, req, res)
+	})
+}
+
+func FuzzDecodeRequest(f *testing.F) {
+	req := &Request{
+		ServiceName: "user-service",
+		MethodName:  "GetById",
+		Meta:        map[string]string{"trace-id": "123"},
+		Data:        []byte("hello, world"),
+	}
+	req.SetHeadLength()
+	req.SetBodyLength()
+	f.Add(EncodeReq(req))
+	req.Version = Version1
+	req.SetHeadLength()
+	f.Add(EncodeReq(req))
+	f.Add([]byte{})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		// 只要不 panic 就行
+		_, _ = DecodeReq(data)
+	})
+}
+
+func FuzzDecodeResponse(f *testing.F) {
+	resp := &Response{
+		Error: []byte("123"),
+		Data:  []byte("hello, world"),
+	}
+	resp.SetHeadLength()
+	resp.SetBodyLength()
+	f.Add(EncodeResp(resp))
+	f.Add([]byte{})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		_, _ = DecodeResp(data)
+	})
+}
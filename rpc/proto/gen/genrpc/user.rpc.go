@@ -0,0 +1,44 @@
+// Code generated by protoc-gen-gorpc. DO NOT EDIT.
+// source: user.proto
+
+package genrpc
+
+import (
+	context "context"
+	rpc "self_developed_rpc/rpc"
+	gen "self_developed_rpc/rpc/proto/gen"
+	proto "self_developed_rpc/rpc/serialize/proto"
+)
+
+// UserServiceName 是 user.UserService 在线上使用的服务名
+const UserServiceName = "user.UserService"
+
+// UserService 是 user.UserService 的客户端，通过 Client.InitService 初始化
+// 服务端默认使用 proto 序列化协议，客户端需要配合 ClientWithSerializer 使用
+type UserService struct {
+	GetById func(ctx context.Context, req *gen.GetByIdReq) (*gen.GetByIdResp, error)
+}
+
+func (s *UserService) Name() string {
+	return UserServiceName
+}
+
+// UserServiceServer 是 user.UserService 的服务端需要实现的接口
+type UserServiceServer interface {
+	GetById(ctx context.Context, req *gen.GetByIdReq) (*gen.GetByIdResp, error)
+}
+
+// RegisterUserServiceServer 把 impl 注册到 s 上面，同时注册 proto 序列化协议
+func RegisterUserServiceServer(s *rpc.Serve, impl UserServiceServer) error {
+	s.RegisterSerialize(&proto.Serializer{})
+	return s.RegisterService(userServiceServer{UserServiceServer: impl})
+}
+
+// userServiceServer 只暴露 UserServiceServer 里面的方法，业务实现上多余的方法不会被注册
+type userServiceServer struct {
+	UserServiceServer
+}
+
+func (userServiceServer) Name() string {
+	return UserServiceName
+}
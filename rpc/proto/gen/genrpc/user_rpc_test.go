@@ -0,0 +1,52 @@
+package genrpc
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"self_developed_rpc/rpc"
+	"self_developed_rpc/rpc/proto/gen"
+	"self_developed_rpc/rpc/serialize/proto"
+	"self_developed_rpc/rpc/status"
+)
+
+type userServer struct{}
+
+func (u *userServer) GetById(ctx context.Context, req *gen.GetByIdReq) (*gen.GetByIdResp, error) {
+	if req.Id == 0 {
+		return nil, status.Errorf(status.InvalidArgument, "id 不能为 0")
+	}
+	return &gen.GetByIdResp{User: &gen.User{Id: req.Id, Name: "Tom"}}, nil
+}
+
+// Helper 不在 UserServiceServer 里面，不应该被注册
+func (u *userServer) Helper() {}
+
+func TestUserService(t *testing.T) {
+	server := rpc.NewServer()
+	require.NoError(t, RegisterUserServiceServer(server, &userServer{}))
+	go func() {
+		_ = server.Start("tcp", ":8091")
+	}()
+	defer func() {
+		_ = server.Shutdown(context.Background())
+	}()
+	time.Sleep(time.Second)
+
+	client, err := rpc.NewClient("localhost:8091", rpc.ClientWithSerializer(&proto.Serializer{}))
+	require.NoError(t, err)
+	defer client.Close()
+	us := &UserService{}
+	require.NoError(t, client.InitService(us))
+
+	resp, err := us.GetById(context.Background(), &gen.GetByIdReq{Id: 12})
+	require.NoError(t, err)
+	assert.Equal(t, int64(12), resp.User.Id)
+	assert.Equal(t, "Tom", resp.User.Name)
+
+	_, err = us.GetById(context.Background(), &gen.GetByIdReq{})
+	assert.Equal(t, status.Errorf(status.InvalidArgument, "id 不能为 0"), err)
+}
@@ -0,0 +1,221 @@
+package file
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/url"
+	"os"
+	"path/filepath"
+	"self_developed_rpc/rpc/registry"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	errClosed    = errors.New("registry: 注册中心已关闭")
+	errEmptyName = errors.New("registry: 服务名和地址不能为空")
+)
+
+// defaultInterval 默认每秒扫描一次目录
+const defaultInterval = time.Second
+
+// Registry 基于文件的注册中心，同一台机器上的多个进程可以共用一个目录
+// 每个实例对应一个 JSON 文件，路径是 <dir>/<服务名>/<地址>.json，服务名和地址经过 escape 转义，
+// 订阅方定时扫描服务对应的目录，所以也可以手动放入或者删除文件。
+type Registry struct {
+	dir      string
+	interval time.Duration
+
+	mu     sync.Mutex
+	done   chan struct{}
+	closed bool
+}
+
+type Option func(r *Registry)
+
+// WithInterval 设置扫描目录的间隔
+func WithInterval(interval time.Duration) Option {
+	return func(r *Registry) {
+		r.interval = interval
+	}
+}
+
+// NewRegistry dir 不存在的时候会创建
+func NewRegistry(dir string, opts ...Option) (*Registry, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	res := &Registry{
+		dir:      dir,
+		interval: defaultInterval,
+		done:     make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(res)
+	}
+	return res, nil
+}
+
+// Register 先写临时文件再重命名，扫描的时候不会读到写了一半的文件
+func (r *Registry) Register(ctx context.Context, ins registry.Instance) error {
+	if r.isClosed() {
+		return errClosed
+	}
+	if ins.Name == "" || ins.Addr == "" {
+		return errEmptyName
+	}
+	dir := r.serviceDir(ins.Name)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	data, err := json.Marshal(ins)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(dir, ".*.tmp")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if er := tmp.Close(); er != nil && err == nil {
+		err = er
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), r.instanceFile(ins))
+	}
+	if err != nil {
+		_ = os.Remove(tmp.Name())
+	}
+	return err
+}
+
+func (r *Registry) Unregister(ctx context.Context, ins registry.Instance) error {
+	if r.isClosed() {
+		return errClosed
+	}
+	if ins.Name == "" || ins.Addr == "" {
+		return errEmptyName
+	}
+	err := os.Remove(r.instanceFile(ins))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+func (r *Registry) Subscribe(ctx context.Context, name string) (<-chan []registry.Instance, error) {
+	if r.isClosed() {
+		return nil, errClosed
+	}
+	if name == "" {
+		return nil, errEmptyName
+	}
+	list, err := r.list(name)
+	if err != nil {
+		return nil, err
+	}
+	ch := make(chan []registry.Instance, 1)
+	ch <- list
+	go r.watch(ctx, name, list, ch)
+	return ch, nil
+}
+
+// watch 定时扫描目录，列表有变化的时候推送
+func (r *Registry) watch(ctx context.Context, name string, last []registry.Instance, ch chan []registry.Instance) {
+	defer close(ch)
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		case <-r.done:
+			return
+		}
+		list, err := r.list(name)
+		// 扫描失败的时候保留之前的列表，等下一次扫描
+		if err != nil || slices.Equal(list, last) {
+			continue
+		}
+		// 调用方还没有读走上一个列表的话换成最新的
+		select {
+		case <-ch:
+		default:
+		}
+		ch <- list
+		last = list
+	}
+}
+
+// list 读取服务目录下所有的实例，目录不存在说明还没有实例，不合法的文件直接跳过
+func (r *Registry) list(name string) ([]registry.Instance, error) {
+	entries, err := os.ReadDir(r.serviceDir(name))
+	if errors.Is(err, os.ErrNotExist) {
+		return []registry.Instance{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	res := make([]registry.Instance, 0, len(entries))
+	for _, entry := range entries {
+		fileName := entry.Name()
+		if entry.IsDir() || strings.HasPrefix(fileName, ".") || filepath.Ext(fileName) != ".json" {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(r.serviceDir(name), fileName))
+		if err != nil {
+			continue
+		}
+		var ins registry.Instance
+		if err = json.Unmarshal(data, &ins); err != nil || ins.Addr == "" {
+			continue
+		}
+		// 以目录为准，手动写的文件可以不写服务名
+		ins.Name = name
+		res = append(res, ins)
+	}
+	registry.Sort(res)
+	return res, nil
+}
+
+// Close 停止所有的订阅，已经写入的文件不会删除
+func (r *Registry) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return errClosed
+	}
+	r.closed = true
+	close(r.done)
+	return nil
+}
+
+func (r *Registry) isClosed() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.closed
+}
+
+// serviceDir 服务名和地址都可能包含路径里不能用的字符，所以要转义
+func (r *Registry) serviceDir(name string) string {
+	return filepath.Join(r.dir, escape(name))
+}
+
+func (r *Registry) instanceFile(ins registry.Instance) string {
+	return filepath.Join(r.serviceDir(ins.Name), escape(ins.Addr)+".json")
+}
+
+// escape 把非空的名字转成一个不会逃出 dir 的路径片段
+// url.PathEscape 已经转义了 / 和 \，但是保留了 . 和 :。
+// 开头的 . 会让名字变成 . 或者 ..，或者被 list 当成临时文件跳过，: 在 Windows 上不能用在文件名里面
+func escape(name string) string {
+	res := strings.ReplaceAll(url.PathEscape(name), ":", "%3A")
+	if strings.HasPrefix(res, ".") {
+		res = "%2E" + res[1:]
+	}
+	return res
+}
@@ -0,0 +1,140 @@
+package memory
+
+import (
+	"context"
+	"errors"
+	"self_developed_rpc/rpc/registry"
+	"sync"
+)
+
+var errClosed = errors.New("registry: 注册中心已关闭")
+
+// Registry 进程内的注册中心，服务端和客户端在同一个进程里的时候使用，比如测试
+type Registry struct {
+	mu sync.Mutex
+	// instances 服务名到实例的映射，实例按照 Addr 去重
+	instances map[string]map[string]registry.Instance
+	// subs 每个服务的订阅者
+	subs map[string]map[*subscriber]struct{}
+	// done 关闭之后订阅的协程退出
+	done   chan struct{}
+	closed bool
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		instances: make(map[string]map[string]registry.Instance, 8),
+		subs:      make(map[string]map[*subscriber]struct{}, 8),
+		done:      make(chan struct{}),
+	}
+}
+
+func (r *Registry) Register(ctx context.Context, ins registry.Instance) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return errClosed
+	}
+	instances, ok := r.instances[ins.Name]
+	if !ok {
+		instances = make(map[string]registry.Instance, 4)
+		r.instances[ins.Name] = instances
+	}
+	instances[ins.Addr] = ins
+	r.notifyLocked(ins.Name)
+	return nil
+}
+
+func (r *Registry) Unregister(ctx context.Context, ins registry.Instance) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return errClosed
+	}
+	if _, ok := r.instances[ins.Name][ins.Addr]; !ok {
+		return nil
+	}
+	delete(r.instances[ins.Name], ins.Addr)
+	r.notifyLocked(ins.Name)
+	return nil
+}
+
+func (r *Registry) Subscribe(ctx context.Context, name string) (<-chan []registry.Instance, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return nil, errClosed
+	}
+	sub := &subscriber{ch: make(chan []registry.Instance, 1)}
+	sub.push(r.listLocked(name))
+	subs, ok := r.subs[name]
+	if !ok {
+		subs = make(map[*subscriber]struct{}, 4)
+		r.subs[name] = subs
+	}
+	subs[sub] = struct{}{}
+
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-r.done:
+			return
+		}
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		// 可能同时关闭了注册中心
+		if _, ok := r.subs[name][sub]; ok {
+			delete(r.subs[name], sub)
+			close(sub.ch)
+		}
+	}()
+	return sub.ch, nil
+}
+
+// Close 关闭所有订阅的 channel
+func (r *Registry) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return errClosed
+	}
+	r.closed = true
+	close(r.done)
+	for name, subs := range r.subs {
+		for sub := range subs {
+			close(sub.ch)
+		}
+		delete(r.subs, name)
+	}
+	return nil
+}
+
+func (r *Registry) notifyLocked(name string) {
+	for sub := range r.subs[name] {
+		// 每个订阅者拿到自己的副本，互相不影响
+		sub.push(r.listLocked(name))
+	}
+}
+
+func (r *Registry) listLocked(name string) []registry.Instance {
+	res := make([]registry.Instance, 0, len(r.instances[name]))
+	for _, ins := range r.instances[name] {
+		res = append(res, ins)
+	}
+	registry.Sort(res)
+	return res
+}
+
+// subscriber 的 channel 只保留最新的列表，推送不会阻塞注册中心
+type subscriber struct {
+	ch chan []registry.Instance
+}
+
+// push 只能在持有注册中心的锁的时候调用，这样丢掉旧的列表之后一定放得下新的
+func (s *subscriber) push(list []registry.Instance) {
+	select {
+	case <-s.ch:
+	default:
+	}
+	s.ch <- list
+}
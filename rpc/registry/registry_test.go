@@ -0,0 +1,188 @@
+package registry_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"self_developed_rpc/rpc/registry"
+	"self_developed_rpc/rpc/registry/file"
+	"self_developed_rpc/rpc/registry/memory"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRegistry(t *testing.T) {
+	testCases := []struct {
+		name string
+		r    func(t *testing.T) registry.Registry
+	}{
+		{
+			name: "memory",
+			r: func(t *testing.T) registry.Registry {
+				return memory.NewRegistry()
+			},
+		},
+		{
+			name: "file",
+			r: func(t *testing.T) registry.Registry {
+				r, err := file.NewRegistry(t.TempDir(), file.WithInterval(time.Millisecond*10))
+				require.NoError(t, err)
+				return r
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			r := tc.r(t)
+			ctx := context.Background()
+			ins1 := registry.Instance{Name: "user-service", Addr: "localhost:8082"}
+			ins2 := registry.Instance{Name: "user-service", Addr: "localhost:8081"}
+			other := registry.Instance{Name: "order-service", Addr: "localhost:8083"}
+
+			ch, err := r.Subscribe(ctx, "user-service")
+			require.NoError(t, err)
+			assert.Equal(t, []registry.Instance{}, next(t, ch))
+
+			require.NoError(t, r.Register(ctx, ins1))
+			assert.Equal(t, []registry.Instance{ins1}, next(t, ch))
+			// 按照地址排序
+			require.NoError(t, r.Register(ctx, ins2))
+			assert.Equal(t, []registry.Instance{ins2, ins1}, next(t, ch))
+
+			// 其它服务的变化不会推送，新的订阅者马上拿到当前的列表
+			require.NoError(t, r.Register(ctx, other))
+			subCtx, cancel := context.WithCancel(ctx)
+			ch2, err := r.Subscribe(subCtx, "user-service")
+			require.NoError(t, err)
+			assert.Equal(t, []registry.Instance{ins2, ins1}, next(t, ch2))
+
+			require.NoError(t, r.Unregister(ctx, ins2))
+			assert.Equal(t, []registry.Instance{ins1}, next(t, ch))
+			assert.Equal(t, []registry.Instance{ins1}, next(t, ch2))
+			// 注销不存在的实例不报错
+			require.NoError(t, r.Unregister(ctx, ins2))
+
+			// ctx 结束之后关闭 channel
+			cancel()
+			assertClosed(t, ch2)
+
+			// 关闭之后所有的订阅都结束了
+			require.NoError(t, r.Close())
+			assertClosed(t, ch)
+			assert.Error(t, r.Register(ctx, ins2))
+			_, err = r.Subscribe(ctx, "user-service")
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestFileRegistryManual(t *testing.T) {
+	dir := t.TempDir()
+	r, err := file.NewRegistry(dir, file.WithInterval(time.Millisecond*10))
+	require.NoError(t, err)
+	defer r.Close()
+
+	ch, err := r.Subscribe(context.Background(), "user-service")
+	require.NoError(t, err)
+	assert.Equal(t, []registry.Instance{}, next(t, ch))
+
+	// 手动放进去的文件可以不写服务名，不合法的文件直接跳过
+	serviceDir := filepath.Join(dir, "user-service")
+	require.NoError(t, os.MkdirAll(serviceDir, 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(serviceDir, "invalid.json"), []byte("{"), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(serviceDir, "a.json"), []byte(`{"addr":"localhost:8081"}`), 0o644))
+	assert.Equal(t, []registry.Instance{{Name: "user-service", Addr: "localhost:8081"}}, next(t, ch))
+
+	require.NoError(t, os.Remove(filepath.Join(serviceDir, "a.json")))
+	assert.Equal(t, []registry.Instance{}, next(t, ch))
+}
+
+func TestFileRegistryPathTraversal(t *testing.T) {
+	root := t.TempDir()
+	dir := filepath.Join(root, "registry")
+	r, err := file.NewRegistry(dir, file.WithInterval(time.Millisecond*10))
+	require.NoError(t, err)
+	defer r.Close()
+
+	testCases := []struct {
+		name string
+		ins  registry.Instance
+	}{
+		{
+			name: "dot dot",
+			ins:  registry.Instance{Name: "..", Addr: ".."},
+		},
+		{
+			name: "dot",
+			ins:  registry.Instance{Name: ".", Addr: "."},
+		},
+		{
+			name: "slash",
+			ins:  registry.Instance{Name: "../user-service", Addr: "../../localhost:8081"},
+		},
+		{
+			name: "backslash",
+			ins:  registry.Instance{Name: `..\user-service`, Addr: `..\..\localhost:8081`},
+		},
+		{
+			// 开头是 . 的文件会被当成临时文件跳过
+			name: "hidden",
+			ins:  registry.Instance{Name: ".user-service", Addr: ".localhost:8081"},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := context.Background()
+			require.NoError(t, r.Register(ctx, tc.ins))
+			ch, err := r.Subscribe(ctx, tc.ins.Name)
+			require.NoError(t, err)
+			assert.Equal(t, []registry.Instance{tc.ins}, next(t, ch))
+			require.NoError(t, r.Unregister(ctx, tc.ins))
+			assert.Equal(t, []registry.Instance{}, next(t, ch))
+		})
+	}
+
+	// 所有的文件都在 dir 下面，并且每个服务都有自己的目录
+	err = filepath.WalkDir(root, func(path string, d os.DirEntry, err error) error {
+		require.NoError(t, err)
+		if path == root {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, path)
+		require.NoError(t, err)
+		assert.NotContains(t, rel, "..", path)
+		if rel != "." {
+			assert.True(t, d.IsDir() == (filepath.Dir(rel) == "."), path)
+		}
+		return nil
+	})
+	require.NoError(t, err)
+
+	assert.Error(t, r.Register(context.Background(), registry.Instance{Name: "user-service"}))
+	_, err = r.Subscribe(context.Background(), "")
+	assert.Error(t, err)
+}
+
+func next(t *testing.T, ch <-chan []registry.Instance) []registry.Instance {
+	select {
+	case list, ok := <-ch:
+		require.True(t, ok)
+		return list
+	case <-time.After(time.Second):
+		t.Fatal("没有收到实例列表")
+		return nil
+	}
+}
+
+func assertClosed(t *testing.T, ch <-chan []registry.Instance) {
+	select {
+	case _, ok := <-ch:
+		assert.False(t, ok)
+	case <-time.After(time.Second):
+		t.Fatal("channel 没有关闭")
+	}
+}
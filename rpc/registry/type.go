@@ -0,0 +1,35 @@
+package registry
+
+import (
+	"context"
+	"sort"
+)
+
+// Instance 一个服务实例，Name 就是 Service.Name()，Addr 是客户端连接用的地址
+type Instance struct {
+	Name string `json:"name"`
+	Addr string `json:"addr"`
+	// Weight 负载均衡的权重，0 当成 1
+	Weight uint32 `json:"weight,omitempty"`
+}
+
+// Registry 注册中心，服务端通过它公布自己的地址，客户端通过服务名订阅地址的变化
+type Registry interface {
+	// Register 重复注册同一个实例会覆盖之前的
+	Register(ctx context.Context, ins Instance) error
+	// Unregister 注销不存在的实例不会返回错误
+	Unregister(ctx context.Context, ins Instance) error
+	// Subscribe 订阅服务的实例列表，列表按照 Addr 排序
+	// 返回的时候当前的列表就已经可以读了，之后每次变化都推送完整的列表，
+	// 调用方读得慢的时候中间的列表可能被跳过，但是一定能读到最新的。
+	// ctx 结束或者注册中心关闭之后 channel 会被关闭
+	Subscribe(ctx context.Context, name string) (<-chan []Instance, error)
+	Close() error
+}
+
+// Sort 按照 Addr 排序，实现 Subscribe 的时候使用，地址相同的实例保持原来的顺序
+func Sort(instances []Instance) {
+	sort.SliceStable(instances, func(i, j int) bool {
+		return instances[i].Addr < instances[j].Addr
+	})
+}
@@ -0,0 +1,232 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math"
+	"math/rand"
+	"net"
+	"self_developed_rpc/rpc/message"
+	"self_developed_rpc/rpc/status"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	defaultInitialBackoff = 100 * time.Millisecond
+	defaultMaxBackoff     = time.Second
+	defaultMultiplier     = 2
+	defaultJitter         = 0.2
+
+	// defaultRetryRatio 和 defaultRetryBurst 是默认的重试预算
+	defaultRetryRatio = 0.2
+	defaultRetryBurst = 10
+)
+
+// RetryPolicy 重试策略，通过 ClientWithRetryPolicy 设置，零值的字段使用默认值
+type RetryPolicy struct {
+	// MaxAttempts 包括第一次调用在内最多调用多少次，小于 2 的时候不重试
+	MaxAttempts int
+	// InitialBackoff 第一次重试之前等待的时间，默认是 100ms
+	InitialBackoff time.Duration
+	// MaxBackoff 等待时间的上限，默认是 1s
+	MaxBackoff time.Duration
+	// Multiplier 每重试一次等待时间乘上的倍数，默认是 2
+	Multiplier float64
+	// Jitter 等待时间随机浮动的比例，默认是 0.2，也就是在 80% 到 120% 之间浮动
+	// 避免大量客户端同时重试，小于 0 的时候不浮动
+	Jitter float64
+	// RetryableCodes 可以重试的错误码，默认只有 Unavailable
+	// 连接断开之类的网络错误当成 Unavailable
+	RetryableCodes []status.Code
+}
+
+// withDefaults 填上默认值
+func (p RetryPolicy) withDefaults() RetryPolicy {
+	if p.InitialBackoff <= 0 {
+		p.InitialBackoff = defaultInitialBackoff
+	}
+	if p.MaxBackoff <= 0 {
+		p.MaxBackoff = defaultMaxBackoff
+	}
+	p.MaxBackoff = max(p.MaxBackoff, p.InitialBackoff)
+	if p.Multiplier < 1 {
+		p.Multiplier = defaultMultiplier
+	}
+	switch {
+	case p.Jitter == 0:
+		p.Jitter = defaultJitter
+	case p.Jitter < 0:
+		p.Jitter = 0
+	case p.Jitter > 1:
+		p.Jitter = 1
+	}
+	if len(p.RetryableCodes) == 0 {
+		p.RetryableCodes = []status.Code{status.Unavailable}
+	} else {
+		p.RetryableCodes = slices.Clone(p.RetryableCodes)
+	}
+	return p
+}
+
+// backoff 第 attempt 次调用失败之后等待的时间，attempt 从 1 开始
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+	d := float64(p.InitialBackoff) * math.Pow(p.Multiplier, float64(attempt-1))
+	d = min(d, float64(p.MaxBackoff))
+	d *= 1 + p.Jitter*(2*rand.Float64()-1)
+	return time.Duration(d)
+}
+
+// retryBudget 限制重试次数占调用量的比例，避免服务端出问题的时候重试把流量放大好几倍
+// 每次调用存入 ratio 个令牌，每次重试取出一个，令牌最多攒 burst 个，刚开始的时候是满的
+type retryBudget struct {
+	mu     sync.Mutex
+	ratio  float64
+	burst  float64
+	tokens float64
+}
+
+func newRetryBudget(ratio float64, burst int) *retryBudget {
+	return &retryBudget{
+		ratio:  max(ratio, 0),
+		burst:  float64(max(burst, 1)),
+		tokens: float64(max(burst, 1)),
+	}
+}
+
+func (b *retryBudget) deposit() {
+	b.mu.Lock()
+	b.tokens = min(b.tokens+b.ratio, b.burst)
+	b.mu.Unlock()
+}
+
+// withdraw 返回 false 说明预算用完了，这次不能重试
+func (b *retryBudget) withdraw() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// retrier 按照重试策略重新发起失败的调用，在拦截器和 Client.Invoke 之间
+// 所以拦截器看到的还是一次调用，流式调用不会重试
+type retrier struct {
+	p Proxy
+	// policies 和 idempotent 的 key 是服务名，或者服务名/方法名
+	policies   map[string]RetryPolicy
+	idempotent map[string]bool
+	budget     *retryBudget
+}
+
+func (r *retrier) Invoke(ctx context.Context, req *message.Request) (*message.Response, error) {
+	r.budget.deposit()
+	policy, ok := r.policyOf(req.ServiceName, req.MethodName)
+	if !ok {
+		return r.p.Invoke(ctx, req)
+	}
+	for attempt := 1; ; attempt++ {
+		// Client.Invoke 会修改请求的编号和数据，每次调用都用一个新的请求
+		attemptReq, err := newAttempt(ctx, req, attempt)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := r.p.Invoke(ctx, attemptReq)
+		code := resultCode(resp, err)
+		if code == status.OK || attempt >= policy.MaxAttempts ||
+			!slices.Contains(policy.RetryableCodes, code) || ctx.Err() != nil {
+			return resp, err
+		}
+		// 等不到下一次调用就超时了，没有必要再等
+		backoff := policy.backoff(attempt)
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) <= backoff {
+			return resp, err
+		}
+		if !r.budget.withdraw() || !sleepCtx(ctx, backoff) {
+			return resp, err
+		}
+	}
+}
+
+// policyOf 方法上的策略优先于服务上的策略，没有标记为幂等的方法不重试
+func (r *retrier) policyOf(serviceName, methodName string) (RetryPolicy, bool) {
+	key := serviceName + "/" + methodName
+	if !r.idempotent[key] && !r.idempotent[serviceName] {
+		return RetryPolicy{}, false
+	}
+	policy, ok := r.policies[key]
+	if !ok {
+		policy, ok = r.policies[serviceName]
+	}
+	return policy, ok && policy.MaxAttempts > 1
+}
+
+// newAttempt 复制一份请求，重试的时候在元数据 "attempt" 里带上这是第几次调用，从 2 开始
+// 超时时间也要换成剩下的时间
+func newAttempt(ctx context.Context, req *message.Request, attempt int) (*message.Request, error) {
+	res := *req
+	if attempt == 1 {
+		return &res, nil
+	}
+	res.Meta = copyMeta(req.Meta)
+	if res.Meta == nil {
+		res.Meta = make(map[string]string, 1)
+	}
+	res.Meta["attempt"] = strconv.Itoa(attempt)
+	timeout, ok, err := remainingTimeout(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		res.Meta["timeout"] = timeout
+	}
+	res.SetHeadLength()
+	return &res, nil
+}
+
+// isTransportErr 连接断开、读写失败之类的网络错误，重新建立连接或者换个实例可能就好了
+func isTransportErr(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, net.ErrClosed) ||
+		errors.Is(err, errConnClosed)
+}
+
+// resultCode 返回调用失败的错误码，成功的时候返回 OK，重试和熔断都按照它判断调用的结果
+// 连接断开之类的网络错误当成 Unavailable，客户端关闭了当成 Canceled，
+// 序列化、压缩失败之类的本地错误换个实例也一样，当成 Unknown，既不重试也不算实例出错
+func resultCode(resp *message.Response, err error) status.Code {
+	if err != nil {
+		if errors.Is(err, errClientClosed) {
+			return status.Canceled
+		}
+		st, ok := status.FromError(err)
+		if !ok && isTransportErr(err) {
+			return status.Unavailable
+		}
+		return st.Code()
+	}
+	if len(resp.Error) > 0 {
+		return status.Unmarshal(resp.Error).Code()
+	}
+	return status.OK
+}
+
+// sleepCtx 返回 false 说明 ctx 在等待的过程中结束了
+func sleepCtx(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
@@ -0,0 +1,345 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"self_developed_rpc/rpc/message"
+	"self_developed_rpc/rpc/status"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	p := RetryPolicy{MaxAttempts: 5, Jitter: -1}.withDefaults()
+	assert.Equal(t, []status.Code{status.Unavailable}, p.RetryableCodes)
+	var backoffs []time.Duration
+	for attempt := 1; attempt <= 5; attempt++ {
+		backoffs = append(backoffs, p.backoff(attempt))
+	}
+	assert.Equal(t, []time.Duration{
+		100 * time.Millisecond, 200 * time.Millisecond, 400 * time.Millisecond,
+		800 * time.Millisecond, time.Second,
+	}, backoffs)
+
+	// 默认在 80% 到 120% 之间浮动
+	p = RetryPolicy{MaxAttempts: 5}.withDefaults()
+	for i := 0; i < 100; i++ {
+		d := p.backoff(2)
+		assert.GreaterOrEqual(t, d, 160*time.Millisecond)
+		assert.LessOrEqual(t, d, 240*time.Millisecond)
+	}
+}
+
+func TestRetryBudget(t *testing.T) {
+	b := newRetryBudget(0.5, 2)
+	assert.True(t, b.withdraw())
+	assert.True(t, b.withdraw())
+	assert.False(t, b.withdraw())
+	// 两次调用攒够一次重试
+	b.deposit()
+	assert.False(t, b.withdraw())
+	b.deposit()
+	assert.True(t, b.withdraw())
+	// 最多攒 burst 个
+	for i := 0; i < 10; i++ {
+		b.deposit()
+	}
+	assert.True(t, b.withdraw())
+	assert.True(t, b.withdraw())
+	assert.False(t, b.withdraw())
+}
+
+// failingProxy 按照顺序返回 results 里的结果，用完之后调用成功
+type failingProxy struct {
+	mu       sync.Mutex
+	results  []error
+	attempts []string
+}
+
+func (f *failingProxy) Invoke(ctx context.Context, req *message.Request) (*message.Response, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.attempts = append(f.attempts, req.Meta["attempt"])
+	// 模拟 Client.Invoke 修改请求
+	req.MessageId++
+	if len(f.results) == 0 {
+		return &message.Response{}, nil
+	}
+	err := f.results[0]
+	f.results = f.results[1:]
+	if st, ok := err.(*status.Error); ok {
+		// 远端返回的错误放在响应里
+		return &message.Response{Error: st.Status().Marshal()}, nil
+	}
+	return nil, err
+}
+
+func TestRetrier(t *testing.T) {
+	unavailable := status.Errorf(status.Unavailable, "服务端过载")
+	policy := RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond}.withDefaults()
+	testCases := []struct {
+		name       string
+		methodName string
+		policies   map[string]RetryPolicy
+		idempotent map[string]bool
+		budget     *retryBudget
+		results    []error
+
+		wantAttempts []string
+		wantCode     status.Code
+	}{
+		{
+			name:         "retry until success",
+			methodName:   "GetById",
+			policies:     map[string]RetryPolicy{"user-service": policy},
+			idempotent:   map[string]bool{"user-service": true},
+			results:      []error{unavailable, &net.OpError{Op: "read", Net: "tcp", Err: syscall.ECONNRESET}},
+			wantAttempts: []string{"", "2", "3"},
+		},
+		{
+			name:         "max attempts",
+			methodName:   "GetById",
+			policies:     map[string]RetryPolicy{"user-service": policy},
+			idempotent:   map[string]bool{"user-service/GetById": true},
+			results:      []error{unavailable, unavailable, unavailable},
+			wantAttempts: []string{"", "2", "3"},
+			wantCode:     status.Unavailable,
+		},
+		{
+			name:         "not idempotent",
+			methodName:   "Update",
+			policies:     map[string]RetryPolicy{"user-service": policy},
+			idempotent:   map[string]bool{"user-service/GetById": true},
+			results:      []error{unavailable},
+			wantAttempts: []string{""},
+			wantCode:     status.Unavailable,
+		},
+		{
+			name:         "not retryable code",
+			methodName:   "GetById",
+			policies:     map[string]RetryPolicy{"user-service": policy},
+			idempotent:   map[string]bool{"user-service": true},
+			results:      []error{status.Errorf(status.InvalidArgument, "id 不能为负数")},
+			wantAttempts: []string{""},
+			wantCode:     status.InvalidArgument,
+		},
+		{
+			// 本地的序列化错误重试也不会成功
+			name:         "serialize error",
+			methodName:   "GetById",
+			policies:     map[string]RetryPolicy{"user-service": RetryPolicy{MaxAttempts: 3, RetryableCodes: []status.Code{status.Unavailable, status.Internal}}.withDefaults()},
+			idempotent:   map[string]bool{"user-service": true},
+			results:      []error{errors.New("json: unsupported type: chan int")},
+			wantAttempts: []string{""},
+			wantCode:     status.Unknown,
+		},
+		{
+			name:         "client closed",
+			methodName:   "GetById",
+			policies:     map[string]RetryPolicy{"user-service": policy},
+			idempotent:   map[string]bool{"user-service": true},
+			results:      []error{errClientClosed},
+			wantAttempts: []string{""},
+			wantCode:     status.Canceled,
+		},
+		{
+			name:       "method policy first",
+			methodName: "GetById",
+			policies: map[string]RetryPolicy{
+				"user-service":         policy,
+				"user-service/GetById": {MaxAttempts: 1},
+			},
+			idempotent:   map[string]bool{"user-service": true},
+			results:      []error{unavailable},
+			wantAttempts: []string{""},
+			wantCode:     status.Unavailable,
+		},
+		{
+			name:         "budget",
+			methodName:   "GetById",
+			policies:     map[string]RetryPolicy{"user-service": policy},
+			idempotent:   map[string]bool{"user-service": true},
+			budget:       newRetryBudget(0, 1),
+			results:      []error{unavailable, unavailable},
+			wantAttempts: []string{"", "2"},
+			wantCode:     status.Unavailable,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			p := &failingProxy{results: tc.results}
+			budget := tc.budget
+			if budget == nil {
+				budget = newRetryBudget(defaultRetryRatio, defaultRetryBurst)
+			}
+			r := &retrier{p: p, policies: tc.policies, idempotent: tc.idempotent, budget: budget}
+			req := &message.Request{ServiceName: "user-service", MethodName: tc.methodName}
+			resp, err := r.Invoke(context.Background(), req)
+			assert.Equal(t, tc.wantCode, resultCode(resp, err))
+			assert.Equal(t, tc.wantAttempts, p.attempts)
+			if len(tc.wantAttempts) > 1 {
+				// 重试的时候原来的请求没有被修改
+				assert.Zero(t, req.MessageId)
+				assert.Nil(t, req.Meta)
+			}
+		})
+	}
+}
+
+func TestResultCode(t *testing.T) {
+	testCases := []struct {
+		name string
+		resp *message.Response
+		err  error
+
+		wantCode status.Code
+	}{
+		{
+			name:     "ok",
+			resp:     &message.Response{},
+			wantCode: status.OK,
+		},
+		{
+			name:     "remote error",
+			resp:     &message.Response{Error: status.New(status.NotFound, "not found").Marshal()},
+			wantCode: status.NotFound,
+		},
+		{
+			name:     "status",
+			err:      status.Errorf(status.ResourceExhausted, "rpc: 太多了"),
+			wantCode: status.ResourceExhausted,
+		},
+		{
+			name:     "net error",
+			err:      &net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED},
+			wantCode: status.Unavailable,
+		},
+		{
+			name:     "eof",
+			err:      io.EOF,
+			wantCode: status.Unavailable,
+		},
+		{
+			name:     "unexpected eof",
+			err:      io.ErrUnexpectedEOF,
+			wantCode: status.Unavailable,
+		},
+		{
+			name:     "conn closed",
+			err:      errConnClosed,
+			wantCode: status.Unavailable,
+		},
+		{
+			name:     "client closed",
+			err:      errClientClosed,
+			wantCode: status.Canceled,
+		},
+		{
+			name:     "wrapped deadline",
+			err:      fmt.Errorf("rpc: 调用失败 %w", context.DeadlineExceeded),
+			wantCode: status.DeadlineExceeded,
+		},
+		{
+			name:     "wrapped canceled",
+			err:      fmt.Errorf("rpc: 调用失败 %w", context.Canceled),
+			wantCode: status.Canceled,
+		},
+		{
+			name:     "serialize error",
+			err:      errors.New("json: unsupported type: chan int"),
+			wantCode: status.Unknown,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.wantCode, resultCode(tc.resp, tc.err))
+		})
+	}
+}
+
+func TestRetrierDeadline(t *testing.T) {
+	p := &failingProxy{results: []error{status.Errorf(status.Unavailable, "服务端过载")}}
+	r := &retrier{
+		p:          p,
+		policies:   map[string]RetryPolicy{"user-service": RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Second}.withDefaults()},
+		idempotent: map[string]bool{"user-service": true},
+		budget:     newRetryBudget(defaultRetryRatio, defaultRetryBurst),
+	}
+	// 等待重试的时候就会超时，直接返回上一次的错误
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	resp, err := r.Invoke(ctx, &message.Request{ServiceName: "user-service", MethodName: "GetById"})
+	require.NoError(t, err)
+	assert.Equal(t, status.Unavailable, status.Unmarshal(resp.Error).Code())
+	assert.Less(t, time.Since(start), 100*time.Millisecond)
+	assert.Equal(t, []string{""}, p.attempts)
+}
+
+type flakyService struct {
+	mu sync.Mutex
+	// failures 前面几次调用返回 Unavailable
+	failures int
+	// attempts 每次调用的元数据 "attempt"
+	attempts []string
+}
+
+func (f *flakyService) Name() string {
+	return "flaky-service"
+}
+
+func (f *flakyService) Get(ctx context.Context, req *metaReq) (*metaResp, error) {
+	md, _ := FromIncomingContext(ctx)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.attempts = append(f.attempts, md["attempt"])
+	if len(f.attempts) <= f.failures {
+		return nil, status.Errorf(status.Unavailable, "服务端过载")
+	}
+	return &metaResp{Value: md["timeout"]}, nil
+}
+
+type flakyClient struct {
+	Get func(ctx context.Context, req *metaReq) (*metaResp, error)
+}
+
+func (f *flakyClient) Name() string {
+	return "flaky-service"
+}
+
+func TestClientRetry(t *testing.T) {
+	server := NewServer()
+	service := &flakyService{failures: 2}
+	require.NoError(t, server.RegisterService(service))
+	go func() {
+		_ = server.Start("tcp", ":8099")
+	}()
+	defer func() {
+		_ = server.Shutdown(context.Background())
+	}()
+	time.Sleep(time.Second)
+
+	client, err := NewClient("localhost:8099",
+		ClientWithRetryPolicy(RetryPolicy{MaxAttempts: 3, InitialBackoff: 10 * time.Millisecond}, "flaky-service"),
+		ClientWithIdempotent("flaky-service", "Get"))
+	require.NoError(t, err)
+	defer client.Close()
+	fc := &flakyClient{}
+	require.NoError(t, client.InitService(fc))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	resp, err := fc.Get(ctx, &metaReq{})
+	require.NoError(t, err)
+	// 重试的时候带上的是剩下的超时时间
+	assert.NotEmpty(t, resp.Value)
+	assert.Equal(t, []string{"", "2", "3"}, service.attempts)
+}
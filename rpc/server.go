@@ -1,30 +1,144 @@
 package rpc
 
 import (
+	"bufio"
 	"context"
 	"errors"
+	"fmt"
+	"self_developed_rpc/rpc/compress"
 	"self_developed_rpc/rpc/message"
+	"self_developed_rpc/rpc/registry"
 	"self_developed_rpc/rpc/serialize"
 	"self_developed_rpc/rpc/serialize/json"
+	"self_developed_rpc/rpc/status"
 
+	"log"
 	"net"
 	"reflect"
+	"runtime/debug"
+	"strconv"
+	"sync"
+	"time"
 )
 
 type Serve struct {
-	services map[string]reflectionStub
+	services map[string]stub
 	// 服务端得支持多种序列化协议
 	serializes map[uint8]serialize.Serialize
+	// 压缩算法同理，响应使用和请求一样的压缩算法
+	compressors       map[uint8]compress.Compressor
+	compressThreshold int
+	// maxConcurrency 单个连接上同时处理的请求数上限
+	maxConcurrency int
+	// maxFrameSize 能接收的请求帧的最大长度
+	maxFrameSize uint32
+	// streamWindow 每个流的接收窗口
+	streamWindow uint32
+	// printStack 业务 panic 的时候是否打印堆栈
+	printStack   bool
+	interceptors []ServerInterceptor
+	// handler 是套上了拦截器的 invoke
+	handler Handler
+	// registry 不为 nil 的时候 Start 会注册所有的服务，advertiseAddr 是注册的地址
+	registry      registry.Registry
+	advertiseAddr string
+
+	mu       sync.Mutex
+	listener net.Listener
+	// instances 已经注册到注册中心的实例，Shutdown 的时候注销
+	instances []registry.Instance
+	conns     map[*serverConn]struct{}
+	// closing 为 true 之后不再接收新的连接和请求
+	closing bool
+	// inFlight 正在处理的请求
+	inFlight sync.WaitGroup
+}
+
+// ErrServerClosed 调用了 Shutdown 之后 Start 返回这个错误
+var ErrServerClosed = errors.New("rpc: 服务端已关闭")
+
+// errLateHandshake 握手帧在请求之后才到，服务端会关闭连接
+var errLateHandshake = errors.New("micro: 握手必须在第一个请求之前完成")
+
+// goAwayMessageId 服务端主动发给客户端的 MessageId 为 0 的响应，通知客户端不要再发新的请求
+const goAwayMessageId = 0
+
+// defaultMaxConcurrency 单个连接默认同时处理的请求数上限
+const defaultMaxConcurrency = 256
+
+// registryTimeout 启动的时候注册服务的超时时间
+const registryTimeout = time.Second * 3
+
+type ServerOption func(s *Serve)
+
+// ServerWithCompressThreshold 响应数据小于 threshold 字节时不压缩
+func ServerWithCompressThreshold(threshold int) ServerOption {
+	return func(s *Serve) {
+		s.compressThreshold = threshold
+	}
+}
+
+// ServerWithMaxConcurrency 设置单个连接上同时处理的请求数上限
+func ServerWithMaxConcurrency(n int) ServerOption {
+	return func(s *Serve) {
+		s.maxConcurrency = n
+	}
+}
+
+// ServerWithPanicStack 业务 panic 的时候打印堆栈
+func ServerWithPanicStack() ServerOption {
+	return func(s *Serve) {
+		s.printStack = true
+	}
+}
+
+// ServerWithMaxFrameSize 设置能接收的请求帧的最大长度，超过之后连接会被关闭
+func ServerWithMaxFrameSize(size uint32) ServerOption {
+	return func(s *Serve) {
+		s.maxFrameSize = size
+	}
+}
+
+// ServerWithStreamWindow 设置每个流的接收窗口，单位是字节，不能小于 64KB，也不能超过 2GB
+func ServerWithStreamWindow(window uint32) ServerOption {
+	return func(s *Serve) {
+		s.streamWindow = streamWindow(window)
+	}
+}
+
+// ServerWithRegistry Start 的时候把所有的服务注册到 r，Shutdown 的时候注销
+// 默认注册监听的地址，监听 ":8080" 这种地址的时候需要通过 ServerWithAdvertiseAddr 指定客户端能连上的地址
+func ServerWithRegistry(r registry.Registry) ServerOption {
+	return func(s *Serve) {
+		s.registry = r
+	}
+}
+
+// ServerWithAdvertiseAddr 设置注册到注册中心的地址
+func ServerWithAdvertiseAddr(addr string) ServerOption {
+	return func(s *Serve) {
+		s.advertiseAddr = addr
+	}
 }
 
-func NewServer() *Serve {
+func NewServer(opts ...ServerOption) *Serve {
 	res := &Serve{
-		services:   make(map[string]reflectionStub, 16),
-		serializes: make(map[uint8]serialize.Serialize, 4),
+		services:          make(map[string]stub, 16),
+		serializes:        make(map[uint8]serialize.Serialize, 4),
+		compressors:       make(map[uint8]compress.Compressor, 4),
+		compressThreshold: defaultCompressThreshold,
+		maxConcurrency:    defaultMaxConcurrency,
+		maxFrameSize:      defaultMaxFrameSize,
+		streamWindow:      defaultStreamWindow,
+		conns:             make(map[*serverConn]struct{}, 16),
 	}
+	res.handler = res.invoke
 	// 设置默认序列化协议
 	s := &json.Serializer{}
 	res.serializes[s.Code()] = s
+	for _, opt := range opts {
+		opt(res)
+	}
 	return res
 }
 
@@ -32,12 +146,41 @@ func (s *Serve) RegisterSerialize(sl serialize.Serialize) {
 	s.serializes[sl.Code()] = sl
 }
 
-func (s *Serve) RegisterService(service Service) {
-	s.services[service.Name()] = reflectionStub{
-		s:          service,
-		value:      reflect.ValueOf(service),
+func (s *Serve) RegisterCompressor(c compress.Compressor) {
+	s.compressors[c.Code()] = c
+}
+
+// Use 添加拦截器，需要在 Start 之前调用
+func (s *Serve) Use(interceptors ...ServerInterceptor) {
+	s.interceptors = append(s.interceptors, interceptors...)
+	s.handler = chainServerInterceptors(s.invoke, s.interceptors)
+}
+
+// RegisterService 注册服务，除了 Name 之外所有导出的方法都必须是
+// func(ctx context.Context, req *Req) (*Resp, error) 或者 serverSignatures 里面的流式方法
+// 签名不对的话返回错误，不会注册任何方法
+func (s *Serve) RegisterService(service Service) error {
+	if service == nil {
+		return errors.New("micro: 不支持 nil")
+	}
+	stub, err := newReflectionStub(service, s.serializes)
+	if err != nil {
+		return err
+	}
+	s.services[service.Name()] = stub
+	return nil
+}
+
+// RegisterDispatcher 注册 rpcgen 生成的分发器，调用的时候不走反射
+func (s *Serve) RegisterDispatcher(d Dispatcher) error {
+	if d == nil {
+		return errors.New("micro: 不支持 nil")
+	}
+	s.services[d.Name()] = &dispatcherStub{
+		d:          d,
 		serializes: s.serializes,
 	}
+	return nil
 }
 
 func (s *Serve) Start(network, address string) error {
@@ -45,105 +188,651 @@ func (s *Serve) Start(network, address string) error {
 	if err != nil {
 		return err
 	}
+	s.mu.Lock()
+	if s.closing {
+		s.mu.Unlock()
+		_ = listener.Close()
+		return ErrServerClosed
+	}
+	s.listener = listener
+	s.mu.Unlock()
+	if err = s.register(listener.Addr().String()); err != nil {
+		_ = listener.Close()
+		return err
+	}
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
+			if s.isClosing() {
+				return ErrServerClosed
+			}
 			return err
 		}
+		sc := &serverConn{conn: conn, streams: make(map[uint32]*serverStream, 4)}
+		if !s.trackConn(sc) {
+			_ = conn.Close()
+			return ErrServerClosed
+		}
 		go func() {
-			if err := s.handleConn(conn); err != nil {
+			if err := s.handleConn(sc); err != nil {
 				_ = conn.Close()
 			}
+			s.untrackConn(sc)
 		}()
 	}
 }
 
-func (s *Serve) handleConn(conn net.Conn) error {
+// Shutdown 优雅退出：
+// 1. 不再接收新的连接，通知客户端不要再发新的请求
+// 2. 等待正在处理的请求结束，或者 ctx 过期
+// 3. 关闭所有的连接
+func (s *Serve) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	if s.closing {
+		s.mu.Unlock()
+		return ErrServerClosed
+	}
+	s.closing = true
+	var err error
+	if s.listener != nil {
+		err = s.listener.Close()
+	}
+	conns := make([]*serverConn, 0, len(s.conns))
+	for sc := range s.conns {
+		conns = append(conns, sc)
+	}
+	instances := s.instances
+	s.instances = nil
+	s.mu.Unlock()
+
+	// 先从注册中心下线，客户端不会再选到这个实例
+	for _, ins := range instances {
+		if er := s.registry.Unregister(ctx, ins); er != nil && err == nil {
+			err = er
+		}
+	}
+
+	goAway := &message.Response{MessageId: goAwayMessageId}
+	goAway.SetHeadLength()
+	goAway.SetBodyLength()
+	bs := message.EncodeResp(goAway)
+	for _, sc := range conns {
+		_ = sc.write(bs)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		s.inFlight.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	for _, sc := range conns {
+		_ = sc.conn.Close()
+	}
+	return err
+}
+
+// register 把所有的服务注册到注册中心，有一个失败的话注销已经注册的
+func (s *Serve) register(addr string) error {
+	if s.registry == nil {
+		return nil
+	}
+	if s.advertiseAddr != "" {
+		addr = s.advertiseAddr
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), registryTimeout)
+	defer cancel()
+	instances := make([]registry.Instance, 0, len(s.services))
+	for name := range s.services {
+		ins := registry.Instance{Name: name, Addr: addr}
+		if err := s.registry.Register(ctx, ins); err != nil {
+			s.unregister(ctx, instances)
+			return fmt.Errorf("micro: 注册服务 %s 失败 %w", name, err)
+		}
+		instances = append(instances, ins)
+	}
+	s.mu.Lock()
+	closing := s.closing
+	if !closing {
+		s.instances = instances
+	}
+	s.mu.Unlock()
+	if closing {
+		// 注册的过程中调用了 Shutdown
+		s.unregister(ctx, instances)
+		return ErrServerClosed
+	}
+	return nil
+}
+
+func (s *Serve) unregister(ctx context.Context, instances []registry.Instance) {
+	for _, ins := range instances {
+		_ = s.registry.Unregister(ctx, ins)
+	}
+}
+
+func (s *Serve) isClosing() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closing
+}
+
+func (s *Serve) trackConn(sc *serverConn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closing {
+		return false
+	}
+	s.conns[sc] = struct{}{}
+	return true
+}
+
+func (s *Serve) untrackConn(sc *serverConn) {
+	s.mu.Lock()
+	delete(s.conns, sc)
+	s.mu.Unlock()
+}
+
+// beginRequest 开始处理一个请求，服务端正在关闭的话返回 false
+func (s *Serve) beginRequest() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closing {
+		return false
+	}
+	// 在锁里面 Add，保证 Shutdown 开始 Wait 之后不会再有新的请求
+	s.inFlight.Add(1)
+	return true
+}
+
+type serverConn struct {
+	conn net.Conn
+	// 写需要加锁，否则多个响应的帧会交错在一起
+	writeMu sync.Mutex
+	// handshaked 客户端发过握手帧，compressor 是握手选出来的压缩算法
+	// 老版本的客户端不会握手，这时候用请求的压缩算法压缩响应
+	handshaked bool
+	compressor compress.Compressor
+
+	// streams 正在进行的流，读循环把客户端发来的帧交给它们
+	mu      sync.Mutex
+	streams map[uint32]*serverStream
+}
+
+func (sc *serverConn) write(bs []byte) error {
+	sc.writeMu.Lock()
+	defer sc.writeMu.Unlock()
+	_, err := sc.conn.Write(bs)
+	return err
+}
+
+func (sc *serverConn) addStream(ss *serverStream) {
+	sc.mu.Lock()
+	sc.streams[ss.req.MessageId] = ss
+	sc.mu.Unlock()
+}
+
+func (sc *serverConn) removeStream(id uint32) {
+	sc.mu.Lock()
+	delete(sc.streams, id)
+	sc.mu.Unlock()
+}
+
+// dispatchFrame 找不到流的帧直接丢掉，流可能刚刚结束
+func (sc *serverConn) dispatchFrame(f *message.Frame) {
+	sc.mu.Lock()
+	ss, ok := sc.streams[f.StreamId]
+	sc.mu.Unlock()
+	if ok {
+		ss.handle(f)
+	}
+}
+
+// abortStreams 连接断开之后结束所有的流，业务可以通过 ctx 感知到
+func (sc *serverConn) abortStreams(err error) {
+	sc.mu.Lock()
+	streams := sc.streams
+	sc.streams = make(map[uint32]*serverStream)
+	sc.mu.Unlock()
+	for _, ss := range streams {
+		ss.cancel(err)
+		ss.abort(err)
+	}
+}
+
+// writeOrClose 写失败的时候关闭连接，读循环会随之退出
+func (sc *serverConn) writeOrClose(bs []byte) error {
+	err := sc.write(bs)
+	if err != nil {
+		_ = sc.conn.Close()
+	}
+	return err
+}
+
+// handleConn 每个请求交给独立的 goroutine 处理，慢请求不会阻塞同一个连接上的其它请求
+// 响应按照完成的先后顺序写回，客户端靠 MessageId 对应
+func (s *Serve) handleConn(sc *serverConn) error {
+	defer func() {
+		sc.abortStreams(status.Errorf(status.Unavailable, "micro: 连接已断开"))
+	}()
+	// 限制单个连接上同时处理的请求数，满了之后暂停读取
+	sem := make(chan struct{}, s.maxConcurrency)
+	reader := bufio.NewReader(sc.conn)
+	// requested 收到过握手以外的请求
+	requested := false
 	for {
-		data, err := ReadMsg(conn)
+		// 超长或者非法的帧会返回 FrameError，调用方会关闭连接
+		data, err := ReadMsg(reader, s.maxFrameSize)
+		if err != nil {
+			return err
+		}
+		if message.IsFrame(data) {
+			f, err := message.DecodeFrame(data)
+			if err != nil {
+				return err
+			}
+			sc.dispatchFrame(f)
+			continue
+		}
+		// 还原调用信息，解析失败说明对端不按协议来，直接断开连接
+		req, err := message.DecodeReq(data)
 		if err != nil {
 			return err
 		}
+		if req.ServiceName == handshakeServiceName && req.MessageId == 0 {
+			// 握手需要在处理其它请求之前完成，之后处理请求的协程会读 handshaked 和 compressor
+			if requested {
+				return errLateHandshake
+			}
+			sc.handshaked = true
+			if err = sc.write(message.EncodeResp(s.handshake(sc, req))); err != nil {
+				return err
+			}
+			continue
+		}
+		requested = true
 
-		// 还原调用信息
-		req := message.DecodeReq(data)
+		// 流式方法自己写响应帧
+		if st, kind, ok := s.streamStubOf(req); ok {
+			s.startStream(sc, sem, st, kind, req)
+			continue
+		}
+
+		sem <- struct{}{}
+		go func() {
+			defer func() {
+				<-sem
+			}()
+			mode := oneWayMode(req.Meta["one-way"])
+			if !s.beginRequest() {
+				if mode != oneWayFire {
+					_ = sc.writeOrClose(message.EncodeResp(s.rejectReq(req)))
+				}
+				return
+			}
+			defer s.inFlight.Done()
+			if mode != oneWayNone {
+				s.handleOneWay(sc, req, mode)
+				return
+			}
+			_ = sc.writeOrClose(message.EncodeResp(s.handleReq(sc, req)))
+		}()
+	}
+}
 
-		ctx := context.Background()
-		oneway, ok := req.Meta["one-way"]
-		if ok && oneway == "true" {
-			ctx = CtxWithOneWay(ctx)
+// startStream 流在读循环里面注册，保证紧跟着打开请求的帧能找到它
+// 流的生命周期可能很长，并发数满了的时候直接拒绝，不能暂停读取，否则别的流收不到客户端的帧
+func (s *Serve) startStream(sc *serverConn, sem chan struct{}, st streamStub, kind streamKind, req *message.Request) {
+	select {
+	case sem <- struct{}{}:
+	default:
+		_ = sc.writeOrClose(message.EncodeResp(errResp(req,
+			status.New(status.ResourceExhausted, "micro: 同时处理的请求太多"))))
+		return
+	}
+	ss := s.newServerStream(sc, req, kind)
+	go func() {
+		defer func() {
+			<-sem
+		}()
+		if !s.beginRequest() {
+			sc.removeStream(req.MessageId)
+			_ = sc.writeOrClose(message.EncodeResp(s.rejectReq(req)))
+			return
 		}
+		defer s.inFlight.Done()
+		s.serveStream(st, ss)
+	}()
+}
 
-		resp, err := s.Invoke(ctx, req)
-		// 这个你的业务 error
-		if err != nil {
-			// 所有的错误都在这里进行捕获塞入
-			resp.Error = []byte(err.Error())
+// rejectReq 服务端正在关闭，不再处理新的请求
+func (s *Serve) rejectReq(req *message.Request) *message.Response {
+	return errResp(req, status.New(status.Unavailable, "micro: 服务端正在关闭"))
+}
+
+// errResp 还没有调用业务就出错了
+func errResp(req *message.Request, st *status.Status) *message.Response {
+	resp := &message.Response{
+		MessageId:  req.MessageId,
+		Version:    req.Version,
+		Serializer: req.Serializer,
+		Error:      st.Marshal(),
+	}
+	resp.SetHeadLength()
+	resp.SetBodyLength()
+	return resp
+}
+
+// handleOneWay 单向调用不会把业务的结果写回去，请求照常经过拦截器
+// 需要确认的话先回复一个空的响应，服务不存在的时候回复错误并且不再调用
+func (s *Serve) handleOneWay(sc *serverConn, req *message.Request, mode oneWayMode) {
+	if mode == oneWayAck {
+		ack := &message.Response{
+			MessageId:  req.MessageId,
+			Version:    req.Version,
+			Serializer: req.Serializer,
 		}
+		_, ok := s.services[req.ServiceName]
+		if !ok {
+			ack.Error = status.Newf(status.NotFound, "micro: 你要调用的服务 %s 不存在", req.ServiceName).Marshal()
+		}
+		ack.SetHeadLength()
+		ack.SetBodyLength()
+		_ = sc.writeOrClose(message.EncodeResp(ack))
+		if !ok {
+			return
+		}
+	}
+	_ = s.handleReq(sc, req)
+}
 
-		resp.SetHeadLength()
-		resp.SetBodyLength()
+func (s *Serve) handleReq(sc *serverConn, req *message.Request) *message.Response {
+	resp, err := s.Invoke(context.Background(), req)
+	if er := s.compress(sc, req, resp); er != nil && err == nil {
+		err = er
+	}
+	// 这个你的业务 error
+	if err != nil {
+		// 所有的错误都在这里进行捕获塞入
+		resp.Error = status.Convert(err).Marshal()
+	}
 
-		_, err = conn.Write(message.EncodeResp(resp))
-		if err != nil {
-			return err
+	resp.SetHeadLength()
+	resp.SetBodyLength()
+	return resp
+}
+
+// compress 响应数据超过阈值才压缩
+func (s *Serve) compress(sc *serverConn, req *message.Request, resp *message.Response) error {
+	data, code, err := s.compressData(sc, req, resp.Data)
+	if err != nil {
+		resp.Data = nil
+		return err
+	}
+	resp.Data = data
+	resp.Compresser = code
+	return nil
+}
+
+// compressData 返回压缩之后的数据和压缩算法，没有压缩的时候压缩算法为 0
+func (s *Serve) compressData(sc *serverConn, req *message.Request, data []byte) ([]byte, uint8, error) {
+	compressor := sc.compressor
+	if !sc.handshaked {
+		compressor = s.compressors[req.Compresser]
+	}
+	if compressor == nil || len(data) == 0 || len(data) < s.compressThreshold {
+		return data, 0, nil
+	}
+	res, err := compressor.Compress(data)
+	if err != nil {
+		return nil, 0, status.Errorf(status.Internal, "micro: 压缩响应失败 %v", err)
+	}
+	return res, compressor.Code(), nil
+}
+
+// Invoke 处理一个请求，先解压数据、按照客户端的超时时间设置超时、带上元数据，再经过拦截器调用业务
+// 拦截器里面可以通过 FromIncomingContext 拿到元数据，拦截器 panic 也会转换成 Internal 错误
+func (s *Serve) Invoke(ctx context.Context, req *message.Request) (resp *message.Response, err error) {
+	defer func() {
+		if resp == nil {
+			// 拦截器可能直接返回了错误，或者 panic 了
+			resp = &message.Response{
+				MessageId:  req.MessageId,
+				Version:    req.Version,
+				Serializer: req.Serializer,
+			}
 		}
+	}()
+	defer s.recoverPanic(req, &err)
+
+	if err = s.decompress(req); err != nil {
+		return nil, err
+	}
+	ctx, cancel, err := withTimeout(ctx, req)
+	if err != nil {
+		return nil, err
 	}
+	defer cancel()
+	ctx = newIncomingContext(ctx, req.Meta)
+	return s.handler(ctx, req)
 }
 
-func (s *Serve) Invoke(ctx context.Context, req *message.Request) (*message.Response, error) {
+// invoke 是拦截器里面最内层的 handler，ctx 已经带上了超时时间和元数据
+func (s *Serve) invoke(ctx context.Context, req *message.Request) (*message.Response, error) {
 	resp := &message.Response{
 		MessageId:  req.MessageId,
 		Version:    req.Version,
-		Compresser: req.Compresser,
 		Serializer: req.Serializer,
 	}
 	service, ok := s.services[req.ServiceName]
 	if !ok {
-		return resp, errors.New("你要调用的服务不存在")
+		return resp, status.Errorf(status.NotFound, "micro: 你要调用的服务 %s 不存在", req.ServiceName)
 	}
 
-	if isOneWay(ctx) {
-		go func() {
-			_, _ = service.invoke(ctx, req)
-		}()
-		return resp, errors.New("micro: 微服务端服务端 oneway 请求")
+	type result struct {
+		data []byte
+		err  error
+	}
+	ch := make(chan result, 1)
+	// 超时之后响应先返回，业务还在执行，Shutdown 要等业务真正返回
+	// 通过 handleConn 进来的请求已经占了一个计数，这里 Add 不会和 Shutdown 的 Wait 冲突
+	s.inFlight.Add(1)
+	go func() {
+		defer s.inFlight.Done()
+		data, er := s.safeInvoke(ctx, service, req)
+		ch <- result{data: data, err: er}
+	}()
+	var respData []byte
+	var err error
+	select {
+	case res := <-ch:
+		respData, err = res.data, res.err
+	case <-ctx.Done():
+		// 超时之后不再等业务返回，业务可以通过 ctx 感知到超时并退出
+		return resp, ctx.Err()
 	}
-
-	respData, err := service.invoke(ctx, req)
 	resp.Data = respData
 
 	return resp, err
 }
 
+// decompress 按照请求里的压缩算法解压请求数据
+func (s *Serve) decompress(req *message.Request) error {
+	data, err := s.decompressData(req.Compresser, req.Data)
+	if err != nil {
+		return err
+	}
+	req.Data = data
+	return nil
+}
+
+// decompressData 按照 code 解压客户端发送的数据，code 为 0 表示没有压缩
+func (s *Serve) decompressData(code uint8, data []byte) ([]byte, error) {
+	if code == 0 {
+		return data, nil
+	}
+	compressor, ok := s.compressors[code]
+	if !ok {
+		return nil, status.Errorf(status.Unimplemented, "micro: 不支持的压缩算法")
+	}
+	return compressor.Decompress(data)
+}
+
+// withTimeout 按照客户端传过来的剩余时间设置超时
+func withTimeout(ctx context.Context, req *message.Request) (context.Context, context.CancelFunc, error) {
+	val, ok := req.Meta["timeout"]
+	if !ok {
+		ctx, cancel := context.WithCancel(ctx)
+		return ctx, cancel, nil
+	}
+	timeout, err := strconv.ParseInt(val, 10, 64)
+	if err != nil {
+		return nil, nil, status.Errorf(status.InvalidArgument, "micro: 非法的超时时间")
+	}
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(timeout))
+	return ctx, cancel, nil
+}
+
+// safeInvoke 把业务的 panic 转换成 Internal 错误，一个请求出问题不会搞挂整个服务端
+func (s *Serve) safeInvoke(ctx context.Context, stub stub, req *message.Request) (data []byte, err error) {
+	defer s.recoverPanic(req, &err)
+	return stub.invoke(ctx, req)
+}
+
+// recoverPanic 必须直接 defer 调用，panic 的时候把 err 设置成 Internal 错误
+func (s *Serve) recoverPanic(req *message.Request, err *error) {
+	if r := recover(); r != nil {
+		if s.printStack {
+			log.Printf("micro: 调用 %s.%s panic: %v\n%s", req.ServiceName, req.MethodName, r, debug.Stack())
+		} else {
+			log.Printf("micro: 调用 %s.%s panic: %v", req.ServiceName, req.MethodName, r)
+		}
+		*err = status.Errorf(status.Internal, "micro: 服务端处理请求 panic: %v", r)
+	}
+}
+
+// stub 负责把请求交给具体的业务方法
+type stub interface {
+	invoke(ctx context.Context, req *message.Request) ([]byte, error)
+}
+
+// dispatcherStub 把请求交给 rpcgen 生成的 Dispatcher
+type dispatcherStub struct {
+	d          Dispatcher
+	serializes map[uint8]serialize.Serialize
+}
+
+func (s *dispatcherStub) invoke(ctx context.Context, req *message.Request) ([]byte, error) {
+	serializer, ok := s.serializes[req.Serializer]
+	if !ok {
+		return nil, status.Errorf(status.Unimplemented, "micro: 不支持的序列化协议")
+	}
+	decode := func(val any) error {
+		if err := serializer.Decode(req.Data, val); err != nil {
+			return status.Errorf(status.InvalidArgument, "micro: 请求数据反序列化失败 %v", err)
+		}
+		return nil
+	}
+	resp, err := s.d.Dispatch(ctx, req.MethodName, decode)
+	if resp == nil {
+		return nil, err
+	}
+	res, er := serializer.Encode(resp)
+	if er != nil {
+		return nil, status.Errorf(status.Internal, "micro: 响应数据序列化失败 %v", er)
+	}
+	return res, err
+}
+
 type reflectionStub struct {
-	s          Service
-	value      reflect.Value
+	s Service
+	// methods 注册的时候就解析好，不用每次请求都反射查找
+	methods    map[string]reflectionMethod
 	serializes map[uint8]serialize.Serialize
 }
 
-func (s *reflectionStub) invoke(ctx context.Context, req *message.Request) ([]byte, error) {
+type reflectionMethod struct {
+	// method 是绑定了接收器的方法
+	method reflect.Value
+	kind   streamKind
+	// reqType 是请求的结构体类型，不是指针，客户端流和双向流为 nil
+	reqType reflect.Type
+	// wrapperType 是流式方法的 Stream[*Resp] 这类参数的类型，普通方法为 nil
+	wrapperType reflect.Type
+}
+
+func newReflectionStub(service Service, serializes map[uint8]serialize.Serialize) (*reflectionStub, error) {
+	val := reflect.ValueOf(service)
+	typ := val.Type()
+	methods := make(map[string]reflectionMethod, typ.NumMethod())
+	var invalid []string
+	for i := 0; i < typ.NumMethod(); i++ {
+		name := typ.Method(i).Name
+		if name == "Name" {
+			continue
+		}
+		method := val.Method(i)
+		typ := method.Type()
+		kind, ok := serverMethodKind(typ)
+		if !ok {
+			invalid = append(invalid, name)
+			continue
+		}
+		m := reflectionMethod{method: method, kind: kind}
+		switch kind {
+		case unary:
+			m.reqType = typ.In(1).Elem()
+		case serverStreaming:
+			m.reqType = typ.In(1).Elem()
+			m.wrapperType = typ.In(2)
+		default:
+			m.wrapperType = typ.In(1)
+		}
+		methods[name] = m
+	}
+	if len(invalid) > 0 {
+		return nil, fmt.Errorf("micro: 服务 %s 的方法 %v 签名不对，必须是 %s",
+			service.Name(), invalid, serverSignatures)
+	}
+	return &reflectionStub{
+		s:          service,
+		methods:    methods,
+		serializes: serializes,
+	}, nil
+}
 
-	method := s.value.MethodByName(req.MethodName)
+func (s *reflectionStub) invoke(ctx context.Context, req *message.Request) ([]byte, error) {
+	method, ok := s.methods[req.MethodName]
+	if !ok {
+		return nil, status.Errorf(status.Unimplemented, "micro: 服务 %s 没有方法 %s", req.ServiceName, req.MethodName)
+	}
+	if method.kind != unary {
+		return nil, status.Errorf(status.Unimplemented, "micro: 服务 %s 的方法 %s 是流式方法", req.ServiceName, req.MethodName)
+	}
 	in := make([]reflect.Value, 2)
 
 	// in[0]：需要传入context
-	in[0] = reflect.ValueOf(context.Background())
+	in[0] = reflect.ValueOf(ctx)
 
 	// in[1]: GetByIdReq数据
-	inReq := reflect.New(method.Type().In(1).Elem())
+	inReq := reflect.New(method.reqType)
 	serializer, ok := s.serializes[req.Serializer]
 	if !ok {
-		return nil, errors.New("micro: 不支持的序列化协议")
+		return nil, status.Errorf(status.Unimplemented, "micro: 不支持的序列化协议")
 	}
 	err := serializer.Decode(req.Data, inReq.Interface())
 
 	if err != nil {
-		return nil, err
+		return nil, status.Errorf(status.InvalidArgument, "micro: 请求数据反序列化失败 %v", err)
 	}
 
 	in[1] = inReq
-	result := method.Call(in)
+	result := method.method.Call(in)
 
 	if result[1].Interface() != nil {
 		// 执行返回的错误
@@ -157,8 +846,34 @@ func (s *reflectionStub) invoke(ctx context.Context, req *message.Request) ([]by
 		var er error
 		res, er = serializer.Encode(result[0].Interface())
 		if er != nil {
-			return nil, er
+			return nil, status.Errorf(status.Internal, "micro: 响应数据序列化失败 %v", er)
 		}
 	}
 	return res, err
 }
+
+func (s *reflectionStub) streamKind(methodName string) streamKind {
+	return s.methods[methodName].kind
+}
+
+func (s *reflectionStub) invokeStream(ctx context.Context, req *message.Request, stream ServerStream) (any, error) {
+	method := s.methods[req.MethodName]
+	// Stream[*Resp] 没法在运行时实例化，通过设置内嵌的 ServerStream 来构造
+	wrapper := reflect.New(method.wrapperType).Elem()
+	wrapper.Field(0).Set(reflect.ValueOf(stream))
+	in := []reflect.Value{reflect.ValueOf(ctx), wrapper}
+	if method.kind == serverStreaming {
+		inReq := reflect.New(method.reqType)
+		if err := s.serializes[req.Serializer].Decode(req.Data, inReq.Interface()); err != nil {
+			return nil, status.Errorf(status.InvalidArgument, "micro: 请求数据反序列化失败 %v", err)
+		}
+		in = []reflect.Value{in[0], inReq, wrapper}
+	}
+	result := method.method.Call(in)
+	err, _ := result[len(result)-1].Interface().(error)
+	// 只有客户端流式方法返回响应
+	if len(result) == 1 || result[0].IsNil() {
+		return nil, err
+	}
+	return result[0].Interface(), err
+}
@@ -0,0 +1,188 @@
+package rpc
+
+import (
+	"context"
+	"io"
+	"self_developed_rpc/rpc/message"
+	"self_developed_rpc/rpc/serialize"
+	"self_developed_rpc/rpc/status"
+)
+
+// serverStream 服务端按照处理普通响应的方式压缩和序列化每一条消息
+type serverStream struct {
+	*streamState
+	ctx    context.Context
+	cancel context.CancelCauseFunc
+	s      *Serve
+	sc     *serverConn
+	req    *message.Request
+	kind   streamKind
+	// serializer 在调用业务之前设置
+	serializer serialize.Serialize
+}
+
+func (ss *serverStream) Context() context.Context {
+	return ss.ctx
+}
+
+func (ss *serverStream) SendMsg(msg any) error {
+	if err := ss.ctx.Err(); err != nil {
+		return err
+	}
+	data, err := ss.serializer.Encode(msg)
+	if err != nil {
+		return status.Errorf(status.Internal, "micro: 响应数据序列化失败 %v", err)
+	}
+	f := &message.Frame{
+		StreamId:   ss.req.MessageId,
+		Type:       message.FrameData,
+		Serializer: ss.req.Serializer,
+	}
+	if f.Data, f.Compresser, err = ss.s.compressData(ss.sc, ss.req, data); err != nil {
+		return err
+	}
+	f.SetHeadLength()
+	f.SetBodyLength()
+	if err = ss.acquire(ss.ctx, f.Size()); err != nil {
+		return err
+	}
+	return ss.sc.writeOrClose(message.EncodeFrame(f))
+}
+
+func (ss *serverStream) RecvMsg(msg any) error {
+	f, increment, err := ss.recv(ss.ctx)
+	if err != nil {
+		return err
+	}
+	if increment > 0 {
+		_ = ss.sc.writeOrClose(message.EncodeFrame(message.NewWindowUpdate(ss.req.MessageId, increment)))
+	}
+	data, err := ss.s.decompressData(f.Compresser, f.Data)
+	if err != nil {
+		return err
+	}
+	if err = ss.serializer.Decode(data, msg); err != nil {
+		return status.Errorf(status.InvalidArgument, "micro: 请求数据反序列化失败 %v", err)
+	}
+	return nil
+}
+
+// handle 读循环收到客户端的帧之后调用
+func (ss *serverStream) handle(f *message.Frame) {
+	switch f.Type {
+	case message.FrameData:
+		if !ss.push(f) {
+			ss.reset(status.Errorf(status.ResourceExhausted, "micro: 客户端发送的数据超过了流控窗口"))
+		}
+	case message.FrameWindowUpdate:
+		if !ss.addCredit(f.Increment()) {
+			ss.reset(status.Errorf(status.ResourceExhausted, "micro: 客户端给的发送额度超过了上限"))
+		}
+	case message.FrameEnd:
+		// 半关闭，服务端还可以继续发送
+		ss.closeRecv(io.EOF)
+	case message.FrameCancel:
+		ss.reset(status.Errorf(status.Canceled, "micro: 客户端取消了流"))
+	}
+}
+
+// reset 结束流，业务通过 ctx 和 RecvMsg 感知到 err
+// 先 abort 再取消 ctx，业务在 ctx 结束之后读到的一定是 err
+func (ss *serverStream) reset(err error) {
+	ss.abort(err)
+	ss.cancel(err)
+}
+
+// streamStub 支持流式方法的 stub
+type streamStub interface {
+	stub
+	streamKind(methodName string) streamKind
+	// invokeStream 调用流式方法，客户端流式方法的响应通过 resp 返回
+	invokeStream(ctx context.Context, req *message.Request, stream ServerStream) (resp any, err error)
+}
+
+// streamStubOf 客户端打开了流，并且方法的类型和客户端一致的时候返回对应的 stub
+// 其它情况按照普通调用处理，出错的时候客户端会把普通响应当成流的结束
+func (s *Serve) streamStubOf(req *message.Request) (streamStub, streamKind, bool) {
+	kind, ok := req.Meta["stream"]
+	if !ok {
+		return nil, unary, false
+	}
+	st, ok := s.services[req.ServiceName].(streamStub)
+	if !ok {
+		return nil, unary, false
+	}
+	k := st.streamKind(req.MethodName)
+	if k == unary || k.String() != kind {
+		return nil, unary, false
+	}
+	return st, k, true
+}
+
+// newServerStream 在读循环里面注册流，保证紧跟着打开流的请求到达的帧不会丢失
+func (s *Serve) newServerStream(sc *serverConn, req *message.Request, kind streamKind) *serverStream {
+	ctx, cancel := context.WithCancelCause(context.Background())
+	ss := &serverStream{
+		streamState: newStreamState(s.streamWindow),
+		ctx:         ctx,
+		cancel:      cancel,
+		s:           s,
+		sc:          sc,
+		req:         req,
+		kind:        kind,
+	}
+	if kind == serverStreaming {
+		// 客户端只会发送打开流的那个请求
+		ss.closeRecv(io.EOF)
+	}
+	sc.addStream(ss)
+	return ss
+}
+
+// serveStream 调用流式方法，方法返回之后发送结束帧
+func (s *Serve) serveStream(st streamStub, ss *serverStream) {
+	defer ss.sc.removeStream(ss.req.MessageId)
+	defer ss.cancel(nil)
+	if s.streamWindow > defaultStreamWindow {
+		_ = ss.sc.writeOrClose(message.EncodeFrame(
+			message.NewWindowUpdate(ss.req.MessageId, s.streamWindow-defaultStreamWindow)))
+	}
+
+	err := s.invokeStream(st, ss)
+	end := &message.Frame{
+		StreamId:   ss.req.MessageId,
+		Type:       message.FrameEnd,
+		Serializer: ss.req.Serializer,
+	}
+	if err != nil {
+		end.Error = status.Convert(err).Marshal()
+	}
+	end.SetHeadLength()
+	end.SetBodyLength()
+	_ = ss.sc.writeOrClose(message.EncodeFrame(end))
+}
+
+func (s *Serve) invokeStream(st streamStub, ss *serverStream) (err error) {
+	req := ss.req
+	serializer, ok := s.serializes[req.Serializer]
+	if !ok {
+		return status.Errorf(status.Unimplemented, "micro: 不支持的序列化协议")
+	}
+	ss.serializer = serializer
+	if err = s.decompress(req); err != nil {
+		return err
+	}
+	ctx, cancel, err := withTimeout(ss.ctx, req)
+	if err != nil {
+		return err
+	}
+	defer cancel()
+	ss.ctx = newIncomingContext(ctx, req.Meta)
+
+	defer s.recoverPanic(req, &err)
+	resp, err := st.invokeStream(ss.ctx, req, ss)
+	if err == nil && resp != nil {
+		err = ss.SendMsg(resp)
+	}
+	return err
+}
@@ -0,0 +1,354 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"self_developed_rpc/rpc/message"
+	"self_developed_rpc/rpc/serialize/json"
+	"self_developed_rpc/rpc/status"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type sleepReq struct {
+	Duration time.Duration
+}
+
+type sleepResp struct {
+	Duration time.Duration
+}
+
+type sleepService struct {
+}
+
+func (s *sleepService) Name() string {
+	return "sleep-service"
+}
+
+type sleepClient struct {
+	Sleep func(ctx context.Context, req *sleepReq) (*sleepResp, error)
+}
+
+func (s *sleepClient) Name() string {
+	return "sleep-service"
+}
+
+func (s *sleepService) Sleep(ctx context.Context, req *sleepReq) (*sleepResp, error) {
+	time.Sleep(req.Duration)
+	return &sleepResp{Duration: req.Duration}, nil
+}
+
+func TestServeHandleConnConcurrent(t *testing.T) {
+	server := NewServer()
+	server.RegisterService(&sleepService{})
+	client, conn := net.Pipe()
+	go func() {
+		_ = server.handleConn(&serverConn{conn: conn})
+	}()
+	defer client.Close()
+
+	sl := &json.Serializer{}
+	durations := []time.Duration{time.Second, time.Millisecond * 10}
+	for i, d := range durations {
+		data, err := sl.Encode(&sleepReq{Duration: d})
+		require.NoError(t, err)
+		req := &message.Request{
+			MessageId:   uint32(i + 1),
+			Serializer:  sl.Code(),
+			ServiceName: "sleep-service",
+			MethodName:  "Sleep",
+			Data:        data,
+		}
+		req.SetHeadLength()
+		req.SetBodyLength()
+		_, err = client.Write(message.EncodeReq(req))
+		require.NoError(t, err)
+	}
+
+	// 慢请求先发，但是快请求的响应先回来
+	wantIds := []uint32{2, 1}
+	for _, id := range wantIds {
+		data, err := ReadMsg(client, 0)
+		require.NoError(t, err)
+		resp, err := message.DecodeResp(data)
+		require.NoError(t, err)
+		assert.Equal(t, id, resp.MessageId)
+		sr := &sleepResp{}
+		require.NoError(t, sl.Decode(resp.Data, sr))
+		assert.Equal(t, durations[id-1], sr.Duration)
+	}
+}
+
+func TestServeOneWay(t *testing.T) {
+	server := NewServer()
+	server.RegisterService(&sleepService{})
+	client, conn := net.Pipe()
+	go func() {
+		_ = server.handleConn(&serverConn{conn: conn})
+	}()
+	defer client.Close()
+
+	sl := &json.Serializer{}
+	write := func(id uint32, serviceName string, mode oneWayMode, d time.Duration) {
+		data, err := sl.Encode(&sleepReq{Duration: d})
+		require.NoError(t, err)
+		req := &message.Request{
+			MessageId:   id,
+			Serializer:  sl.Code(),
+			ServiceName: serviceName,
+			MethodName:  "Sleep",
+			Data:        data,
+		}
+		if mode != oneWayNone {
+			req.Meta = map[string]string{"one-way": string(mode)}
+		}
+		req.SetHeadLength()
+		req.SetBodyLength()
+		_, err = client.Write(message.EncodeReq(req))
+		require.NoError(t, err)
+	}
+	read := func() *message.Response {
+		data, err := ReadMsg(client, 0)
+		require.NoError(t, err)
+		resp, err := message.DecodeResp(data)
+		require.NoError(t, err)
+		return resp
+	}
+
+	// 服务端不回复单向调用，读到的是后面那个普通调用的响应
+	write(1, "sleep-service", oneWayFire, time.Millisecond)
+	write(2, "sleep-service", oneWayNone, time.Millisecond*10)
+	resp := read()
+	assert.Equal(t, uint32(2), resp.MessageId)
+	require.NoError(t, client.SetReadDeadline(time.Now().Add(time.Millisecond*100)))
+	_, err := ReadMsg(client, 0)
+	assert.True(t, errors.Is(err, os.ErrDeadlineExceeded), err)
+	require.NoError(t, client.SetReadDeadline(time.Time{}))
+
+	// 确认不等业务执行完
+	start := time.Now()
+	write(3, "sleep-service", oneWayAck, time.Second)
+	resp = read()
+	assert.Less(t, time.Since(start), time.Millisecond*500)
+	assert.Equal(t, uint32(3), resp.MessageId)
+	assert.Empty(t, resp.Error)
+	assert.Empty(t, resp.Data)
+
+	write(4, "missing-service", oneWayAck, 0)
+	resp = read()
+	assert.Equal(t, uint32(4), resp.MessageId)
+	assert.Equal(t, status.NotFound, status.Unmarshal(resp.Error).Code())
+}
+
+func TestServeInvokeTimeout(t *testing.T) {
+	server := NewServer()
+	server.RegisterService(&sleepService{})
+	sl := &json.Serializer{}
+
+	testCases := []struct {
+		name     string
+		duration time.Duration
+		timeout  string
+		wantErr  error
+	}{
+		{
+			name:     "timeout",
+			duration: time.Second,
+			timeout:  strconv.FormatInt(int64(time.Millisecond*50), 10),
+			wantErr:  context.DeadlineExceeded,
+		},
+		{
+			name:     "no timeout",
+			duration: time.Millisecond,
+			timeout:  strconv.FormatInt(int64(time.Second), 10),
+		},
+		{
+			name:     "invalid timeout",
+			duration: time.Millisecond,
+			timeout:  "abc",
+			wantErr:  status.Errorf(status.InvalidArgument, "micro: 非法的超时时间"),
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			data, err := sl.Encode(&sleepReq{Duration: tc.duration})
+			require.NoError(t, err)
+			req := &message.Request{
+				Serializer:  sl.Code(),
+				ServiceName: "sleep-service",
+				MethodName:  "Sleep",
+				Meta:        map[string]string{"timeout": tc.timeout},
+				Data:        data,
+			}
+			start := time.Now()
+			_, err = server.Invoke(context.Background(), req)
+			assert.Equal(t, tc.wantErr, err)
+			assert.Less(t, time.Since(start), time.Millisecond*500)
+		})
+	}
+}
+
+func TestServeShutdownWaitsTimedOutHandler(t *testing.T) {
+	server := NewServer()
+	require.NoError(t, server.RegisterService(&sleepService{}))
+	sl := &json.Serializer{}
+	data, err := sl.Encode(&sleepReq{Duration: time.Millisecond * 300})
+	require.NoError(t, err)
+	req := &message.Request{
+		Serializer:  sl.Code(),
+		ServiceName: "sleep-service",
+		MethodName:  "Sleep",
+		Meta:        map[string]string{"timeout": strconv.FormatInt(int64(time.Millisecond*50), 10)},
+		Data:        data,
+	}
+	// 模拟 handleConn 处理一个请求
+	require.True(t, server.beginRequest())
+	_, err = server.Invoke(context.Background(), req)
+	server.inFlight.Done()
+	assert.Equal(t, context.DeadlineExceeded, err)
+
+	// 响应已经返回了，但是业务还在执行，Shutdown 要等它结束
+	start := time.Now()
+	require.NoError(t, server.Shutdown(context.Background()))
+	assert.GreaterOrEqual(t, time.Since(start), time.Millisecond*200)
+}
+
+type metaReq struct {
+	Key string
+}
+
+type metaResp struct {
+	Value string
+}
+
+type metaService struct {
+}
+
+func (m *metaService) Name() string {
+	return "meta-service"
+}
+
+type metaClient struct {
+	Get func(ctx context.Context, req *metaReq) (*metaResp, error)
+}
+
+func (m *metaClient) Name() string {
+	return "meta-service"
+}
+
+func (m *metaService) Get(ctx context.Context, req *metaReq) (*metaResp, error) {
+	md, _ := FromIncomingContext(ctx)
+	return &metaResp{Value: md[req.Key]}, nil
+}
+
+func TestServeInvokeMeta(t *testing.T) {
+	server := NewServer()
+	server.RegisterService(&metaService{})
+	sl := &json.Serializer{}
+	data, err := sl.Encode(&metaReq{Key: "trace-id"})
+	require.NoError(t, err)
+	req := &message.Request{
+		Serializer:  sl.Code(),
+		ServiceName: "meta-service",
+		MethodName:  "Get",
+		Meta:        map[string]string{"trace-id": "123"},
+		Data:        data,
+	}
+	resp, err := server.Invoke(context.Background(), req)
+	require.NoError(t, err)
+	mr := &metaResp{}
+	require.NoError(t, sl.Decode(resp.Data, mr))
+	assert.Equal(t, "123", mr.Value)
+}
+
+func TestServeInvokeNotFound(t *testing.T) {
+	server := NewServer()
+	_, err := server.Invoke(context.Background(), &message.Request{ServiceName: "unknown-service"})
+	s, ok := status.FromError(err)
+	require.True(t, ok)
+	assert.Equal(t, status.NotFound, s.Code())
+}
+
+type panicService struct {
+}
+
+func (p *panicService) Name() string {
+	return "panic-service"
+}
+
+func (p *panicService) Panic(ctx context.Context, req *metaReq) (*metaResp, error) {
+	panic("mock panic")
+}
+
+func TestServeInvokePanic(t *testing.T) {
+	server := NewServer(ServerWithPanicStack())
+	server.RegisterService(&panicService{})
+
+	testCases := []struct {
+		name     string
+		method   string
+		wantCode status.Code
+	}{
+		{
+			name:     "panic",
+			method:   "Panic",
+			wantCode: status.Internal,
+		},
+		{
+			name:     "method not found",
+			method:   "NotExist",
+			wantCode: status.Unimplemented,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := server.Invoke(context.Background(), &message.Request{
+				Serializer:  1,
+				ServiceName: "panic-service",
+				MethodName:  tc.method,
+				Data:        []byte(`{}`),
+			})
+			st, _ := status.FromError(err)
+			assert.Equal(t, tc.wantCode, st.Code())
+		})
+	}
+}
+
+type invalidServer struct {
+}
+
+func (i *invalidServer) Name() string {
+	return "invalid-service"
+}
+
+func (i *invalidServer) GetById(ctx context.Context, req *GetByIdReq) (*GetByIdResp, error) {
+	return &GetByIdResp{}, nil
+}
+
+func (i *invalidServer) Helper(id int) string {
+	return ""
+}
+
+func TestServeRegisterService(t *testing.T) {
+	server := NewServer()
+	err := server.RegisterService(&invalidServer{})
+	assert.Equal(t, errors.New("micro: 服务 invalid-service 的方法 [Helper] 签名不对，"+
+		"必须是 func(ctx context.Context, req *Req) (*Resp, error) 或者 "+
+		"func(ctx context.Context, req *Req, stream rpc.Stream[*Resp]) error 或者 "+
+		"func(ctx context.Context, stream rpc.RecvStream[*Req]) (*Resp, error) 或者 "+
+		"func(ctx context.Context, stream rpc.BidiStream[*Req, *Resp]) error"), err)
+	_, ok := server.services["invalid-service"]
+	assert.False(t, ok)
+
+	assert.Equal(t, errors.New("micro: 不支持 nil"), server.RegisterService(nil))
+	require.NoError(t, server.RegisterService(&UserServiceServer{}))
+	assert.Len(t, server.services["user-service"].(*reflectionStub).methods, 2)
+}
@@ -0,0 +1,152 @@
+package rpc
+
+import (
+	"context"
+	"reflect"
+	"strings"
+)
+
+var (
+	contextType = reflect.TypeOf((*context.Context)(nil)).Elem()
+	errorType   = reflect.TypeOf((*error)(nil)).Elem()
+
+	serverStreamType = reflect.TypeOf((*ServerStream)(nil)).Elem()
+	clientStreamType = reflect.TypeOf((*ClientStream)(nil)).Elem()
+)
+
+// unarySignature 出错的时候提示用户正确的签名
+const unarySignature = "func(ctx context.Context, req *Req) (*Resp, error)"
+
+// serverSignatures 服务端方法支持的签名
+var serverSignatures = strings.Join([]string{
+	unarySignature,
+	"func(ctx context.Context, req *Req, stream rpc.Stream[*Resp]) error",
+	"func(ctx context.Context, stream rpc.RecvStream[*Req]) (*Resp, error)",
+	"func(ctx context.Context, stream rpc.BidiStream[*Req, *Resp]) error",
+}, " 或者 ")
+
+// clientSignatures 客户端字段支持的签名
+var clientSignatures = strings.Join([]string{
+	unarySignature,
+	"func(ctx context.Context, req *Req) (*rpc.StreamReader[*Resp], error)",
+	"func(ctx context.Context) (*rpc.StreamWriter[*Req, *Resp], error)",
+	"func(ctx context.Context) (*rpc.StreamReadWriter[*Req, *Resp], error)",
+}, " 或者 ")
+
+// isUnaryFunc 判断 typ 是不是 func(ctx context.Context, req *Req) (*Resp, error)
+// typ 是不带接收器的函数类型
+func isUnaryFunc(typ reflect.Type) bool {
+	return typ.Kind() == reflect.Func &&
+		typ.NumIn() == 2 && typ.In(0) == contextType && isStructPointer(typ.In(1)) &&
+		typ.NumOut() == 2 && isStructPointer(typ.Out(0)) && typ.Out(1) == errorType
+}
+
+func isStructPointer(typ reflect.Type) bool {
+	return typ.Kind() == reflect.Pointer && typ.Elem().Kind() == reflect.Struct
+}
+
+// streamKind 方法的类型，普通方法是 unary
+type streamKind uint8
+
+const (
+	unary streamKind = iota
+	// serverStreaming 客户端发一个请求，服务端推送多个响应
+	serverStreaming
+	// clientStreaming 客户端发送多个请求，服务端返回一个响应
+	clientStreaming
+	// bidiStreaming 双方都可以发送多条消息
+	bidiStreaming
+)
+
+// String 是打开流的时候放在元数据里面的值
+func (k streamKind) String() string {
+	switch k {
+	case serverStreaming:
+		return "server"
+	case clientStreaming:
+		return "client"
+	case bidiStreaming:
+		return "bidi"
+	default:
+		return "unary"
+	}
+}
+
+// kinded 由 Stream、StreamReader 这些泛型结构体实现，用来在运行时判断它们的类型
+type kinded interface {
+	streamKind() streamKind
+}
+
+var kindedType = reflect.TypeOf((*kinded)(nil)).Elem()
+
+// serverMethodKind 返回服务端方法的类型，签名不对的时候返回 false
+// typ 是不带接收器的函数类型
+func serverMethodKind(typ reflect.Type) (streamKind, bool) {
+	if isUnaryFunc(typ) {
+		return unary, true
+	}
+	if typ.Kind() != reflect.Func || typ.NumIn() < 2 || typ.In(0) != contextType {
+		return unary, false
+	}
+	switch typ.NumIn() {
+	case 2:
+		kind, ok := wrapperKind(typ.In(1), serverStreamType)
+		if !ok {
+			return unary, false
+		}
+		if kind == clientStreaming && typ.NumOut() == 2 && isStructPointer(typ.Out(0)) && typ.Out(1) == errorType {
+			return kind, true
+		}
+		if kind == bidiStreaming && typ.NumOut() == 1 && typ.Out(0) == errorType {
+			return kind, true
+		}
+	case 3:
+		kind, ok := wrapperKind(typ.In(2), serverStreamType)
+		if ok && kind == serverStreaming && isStructPointer(typ.In(1)) &&
+			typ.NumOut() == 1 && typ.Out(0) == errorType {
+			return kind, true
+		}
+	}
+	return unary, false
+}
+
+// clientFieldKind 返回客户端字段的类型，签名不对的时候返回 false
+func clientFieldKind(typ reflect.Type) (streamKind, bool) {
+	if typ.Kind() != reflect.Func || typ.NumIn() == 0 || typ.In(0) != contextType ||
+		typ.NumOut() != 2 || typ.Out(0).Kind() != reflect.Pointer || typ.Out(1) != errorType {
+		return unary, false
+	}
+	// *StreamReader[*Resp] 也是结构体指针，要先排除掉流
+	kind, ok := wrapperKind(typ.Out(0).Elem(), clientStreamType)
+	if !ok {
+		return unary, isUnaryFunc(typ)
+	}
+	// 只有服务端流需要在打开的时候带上请求
+	if kind == serverStreaming {
+		return kind, typ.NumIn() == 2 && isStructPointer(typ.In(1))
+	}
+	return kind, typ.NumIn() == 1
+}
+
+// wrapperKind 判断 typ 是不是 Stream[*Resp] 这种第一个字段内嵌了 embedded 的泛型结构体
+// 泛型没法在运行时实例化，框架通过设置内嵌的字段来构造它们
+// 它们收发的消息都必须是结构体指针
+func wrapperKind(typ reflect.Type, embedded reflect.Type) (streamKind, bool) {
+	if typ.Kind() != reflect.Struct || typ.NumField() == 0 ||
+		!typ.Field(0).Anonymous || typ.Field(0).Type != embedded ||
+		!reflect.PointerTo(typ).Implements(kindedType) {
+		return unary, false
+	}
+	ptr := reflect.PointerTo(typ)
+	// 第一个参数是接收器
+	if m, ok := ptr.MethodByName("Send"); ok && !isStructPointer(m.Type.In(1)) {
+		return unary, false
+	}
+	if m, ok := ptr.MethodByName("Recv"); ok && !isStructPointer(m.Type.Out(0)) {
+		return unary, false
+	}
+	if m, ok := ptr.MethodByName("CloseAndRecv"); ok && !isStructPointer(m.Type.Out(0)) {
+		return unary, false
+	}
+	return reflect.New(typ).Interface().(kinded).streamKind(), true
+}
@@ -0,0 +1,152 @@
+package status
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// Status 远端调用的结果，会序列化之后放进 Response.Error 里面传给客户端
+type Status struct {
+	code    Code
+	msg     string
+	details []json.RawMessage
+}
+
+func New(code Code, msg string) *Status {
+	return &Status{code: code, msg: msg}
+}
+
+func Newf(code Code, format string, args ...any) *Status {
+	return New(code, fmt.Sprintf(format, args...))
+}
+
+// Errorf 等价于 Newf(code, format, args...).Err()
+func Errorf(code Code, format string, args ...any) error {
+	return Newf(code, format, args...).Err()
+}
+
+func (s *Status) Code() Code {
+	if s == nil {
+		return OK
+	}
+	return s.code
+}
+
+func (s *Status) Message() string {
+	if s == nil {
+		return ""
+	}
+	return s.msg
+}
+
+// Details 返回 JSON 序列化之后的详情，用 json.Unmarshal 还原
+func (s *Status) Details() []json.RawMessage {
+	if s == nil {
+		return nil
+	}
+	return s.details
+}
+
+// WithDetails 返回一个带上详情的新 Status，详情用 JSON 序列化
+func (s *Status) WithDetails(details ...any) (*Status, error) {
+	if s.Code() == OK {
+		return nil, errors.New("status: OK 不能携带详情")
+	}
+	res := &Status{code: s.code, msg: s.msg, details: append([]json.RawMessage(nil), s.details...)}
+	for _, d := range details {
+		data, err := json.Marshal(d)
+		if err != nil {
+			return nil, err
+		}
+		res.details = append(res.details, data)
+	}
+	return res, nil
+}
+
+// Err 把 Status 转成 error，OK 的时候返回 nil
+func (s *Status) Err() error {
+	if s.Code() == OK {
+		return nil
+	}
+	return &Error{s: s}
+}
+
+// Error 是 Status 转换出来的 error，可以通过 errors.As 拿到
+type Error struct {
+	s *Status
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("rpc: code = %s, msg = %s", e.s.code, e.s.msg)
+}
+
+func (e *Error) Status() *Status {
+	return e.s
+}
+
+// Is 错误码和错误信息一样就认为是同一个错误
+// DeadlineExceeded 和 Canceled 还可以和 context 里面对应的错误匹配上
+func (e *Error) Is(target error) bool {
+	switch target {
+	case context.DeadlineExceeded:
+		return e.s.code == DeadlineExceeded
+	case context.Canceled:
+		return e.s.code == Canceled
+	}
+	t, ok := target.(*Error)
+	if !ok {
+		return false
+	}
+	return t.s.code == e.s.code && t.s.msg == e.s.msg
+}
+
+// FromError 从 error 里面拿到 Status
+// err 为 nil 的时候返回 OK；context 的超时和取消会转换成对应的错误码；
+// 其它不是通过 Status 构造的错误返回 Unknown 和 false
+func FromError(err error) (*Status, bool) {
+	if err == nil {
+		return nil, true
+	}
+	var e *Error
+	if errors.As(err, &e) {
+		return e.s, true
+	}
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		return New(DeadlineExceeded, err.Error()), true
+	case errors.Is(err, context.Canceled):
+		return New(Canceled, err.Error()), true
+	}
+	return New(Unknown, err.Error()), false
+}
+
+// Convert 和 FromError 一样，只是不关心是否转换成功
+func Convert(err error) *Status {
+	s, _ := FromError(err)
+	return s
+}
+
+type wireStatus struct {
+	Code    Code              `json:"code"`
+	Message string            `json:"message"`
+	Details []json.RawMessage `json:"details,omitempty"`
+}
+
+// Marshal 序列化之后放进 Response.Error
+func (s *Status) Marshal() []byte {
+	// 这里的字段都是可以序列化的，不会出错
+	data, _ := json.Marshal(wireStatus{Code: s.Code(), Message: s.Message(), Details: s.Details()})
+	return data
+}
+
+// Unmarshal 还原 Response.Error
+// 老版本的服务端直接把错误信息写进去，这种情况下返回 Unknown
+func Unmarshal(data []byte) *Status {
+	var ws wireStatus
+	if err := json.Unmarshal(data, &ws); err != nil || ws.Code == OK {
+		return New(Unknown, string(data))
+	}
+	return &Status{code: ws.Code, msg: ws.Message, details: ws.Details}
+}
@@ -0,0 +1,95 @@
+package status
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFromError(t *testing.T) {
+	testCases := []struct {
+		name     string
+		err      error
+		wantCode Code
+		wantMsg  string
+		wantOk   bool
+	}{
+		{
+			name:     "nil",
+			wantCode: OK,
+			wantOk:   true,
+		},
+		{
+			name:     "status",
+			err:      Errorf(NotFound, "user %d", 123),
+			wantCode: NotFound,
+			wantMsg:  "user 123",
+			wantOk:   true,
+		},
+		{
+			name:     "wrapped",
+			err:      fmt.Errorf("get user: %w", Errorf(NotFound, "user")),
+			wantCode: NotFound,
+			wantMsg:  "user",
+			wantOk:   true,
+		},
+		{
+			name:     "deadline",
+			err:      context.DeadlineExceeded,
+			wantCode: DeadlineExceeded,
+			wantMsg:  "context deadline exceeded",
+			wantOk:   true,
+		},
+		{
+			name:     "unknown",
+			err:      errors.New("error"),
+			wantCode: Unknown,
+			wantMsg:  "error",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			s, ok := FromError(tc.err)
+			assert.Equal(t, tc.wantOk, ok)
+			assert.Equal(t, tc.wantCode, s.Code())
+			assert.Equal(t, tc.wantMsg, s.Message())
+		})
+	}
+}
+
+func TestErrorIs(t *testing.T) {
+	err := Errorf(DeadlineExceeded, "timeout")
+	assert.True(t, errors.Is(err, Errorf(DeadlineExceeded, "timeout")))
+	assert.False(t, errors.Is(err, Errorf(DeadlineExceeded, "other")))
+	assert.True(t, errors.Is(err, context.DeadlineExceeded))
+	assert.False(t, errors.Is(err, context.Canceled))
+
+	var se *Error
+	require.True(t, errors.As(fmt.Errorf("wrap: %w", err), &se))
+	assert.Equal(t, DeadlineExceeded, se.Status().Code())
+}
+
+func TestMarshalUnmarshal(t *testing.T) {
+	type detail struct {
+		Field string
+	}
+	s, err := New(InvalidArgument, "bad request").WithDetails(detail{Field: "Id"})
+	require.NoError(t, err)
+	res := Unmarshal(s.Marshal())
+	assert.Equal(t, s, res)
+	assert.Equal(t, `{"Field":"Id"}`, string(res.Details()[0]))
+
+	// 老版本服务端直接写入的错误信息
+	res = Unmarshal([]byte("error"))
+	assert.Equal(t, Unknown, res.Code())
+	assert.Equal(t, "error", res.Message())
+
+	_, err = New(OK, "").WithDetails(detail{})
+	assert.Error(t, err)
+	assert.Nil(t, New(OK, "").Err())
+}
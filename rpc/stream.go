@@ -0,0 +1,373 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"io"
+	"reflect"
+	"self_developed_rpc/rpc/message"
+	"sync"
+)
+
+var (
+	// errStreamClosed 调用方主动关闭了流
+	errStreamClosed = errors.New("rpc: 流已关闭")
+	// errSendClosed 已经调用过 CloseSend，不能再发送了
+	errSendClosed = errors.New("rpc: 流的发送端已关闭")
+)
+
+// defaultStreamWindow 每个流两个方向各自的初始接收窗口，单位是字节
+// 两端都按照这个值初始化对端的发送额度，想要更大的窗口的话在打开流之后通过 FrameWindowUpdate 扩大
+const defaultStreamWindow = 64 << 10
+
+// maxStreamWindow 窗口的上限，遵守流控的对端给的发送额度不会超过它
+const maxStreamWindow = 1<<31 - 1
+
+// ServerStream 是服务端流的非泛型部分，业务一般通过 Stream、RecvStream、BidiStream 使用
+// 同一个流上的 SendMsg 不能并发调用，RecvMsg 也一样
+type ServerStream interface {
+	Context() context.Context
+	SendMsg(msg any) error
+	// RecvMsg 读取客户端发送的下一条消息，客户端半关闭之后返回 io.EOF
+	RecvMsg(msg any) error
+}
+
+// Stream 服务端通过它向客户端推送消息
+// 服务端流式方法的签名是 func(ctx context.Context, req *Req, stream rpc.Stream[*Resp]) error
+// 方法返回之后流就结束了，返回的错误会作为 trailer 发给客户端
+type Stream[T any] struct {
+	ServerStream
+}
+
+func (s Stream[T]) Send(msg T) error {
+	return s.SendMsg(msg)
+}
+
+func (Stream[T]) streamKind() streamKind {
+	return serverStreaming
+}
+
+// RecvStream 服务端通过它读取客户端发送的多个请求
+// 客户端流式方法的签名是 func(ctx context.Context, stream rpc.RecvStream[*Req]) (*Resp, error)
+type RecvStream[T any] struct {
+	ServerStream
+}
+
+// Recv 读取下一个请求，客户端发送完毕之后返回 io.EOF
+func (s RecvStream[T]) Recv() (T, error) {
+	return recv[T](s.ServerStream)
+}
+
+func (RecvStream[T]) streamKind() streamKind {
+	return clientStreaming
+}
+
+// BidiStream 服务端双向流
+// 双向流式方法的签名是 func(ctx context.Context, stream rpc.BidiStream[*Req, *Resp]) error
+type BidiStream[Req, Resp any] struct {
+	ServerStream
+}
+
+// Recv 读取下一个请求，客户端半关闭之后返回 io.EOF
+func (s BidiStream[Req, Resp]) Recv() (Req, error) {
+	return recv[Req](s.ServerStream)
+}
+
+func (s BidiStream[Req, Resp]) Send(msg Resp) error {
+	return s.SendMsg(msg)
+}
+
+func (BidiStream[Req, Resp]) streamKind() streamKind {
+	return bidiStreaming
+}
+
+// ClientStream 是客户端流的非泛型部分，业务一般通过 StreamReader、StreamWriter、StreamReadWriter 使用
+// 同一个流上的 SendMsg 不能并发调用，RecvMsg 也一样
+type ClientStream interface {
+	Context() context.Context
+	SendMsg(msg any) error
+	// CloseSend 半关闭，告诉服务端不会再发送消息了，之后还可以继续接收
+	CloseSend() error
+	// RecvMsg 读取下一条消息，流正常结束的时候返回 io.EOF
+	RecvMsg(msg any) error
+	// Close 放弃这个流，服务端会收到取消的通知，之后到达的消息都会被丢弃
+	Close() error
+}
+
+// StreamReader 按顺序读取服务端推送的消息
+// 客户端的字段签名是 func(ctx context.Context, req *Req) (*rpc.StreamReader[*Resp], error)
+//
+//	for reader.Next() {
+//		resp := reader.Msg()
+//	}
+//	err := reader.Err()
+type StreamReader[T any] struct {
+	ClientStream
+	msg T
+	err error
+}
+
+// Recv 读取下一条消息，流正常结束的时候返回 io.EOF
+func (r *StreamReader[T]) Recv() (T, error) {
+	return recv[T](r.ClientStream)
+}
+
+// Next 读取下一条消息，返回 false 说明流结束了，通过 Err 拿到原因
+func (r *StreamReader[T]) Next() bool {
+	if r.err != nil {
+		return false
+	}
+	r.msg, r.err = r.Recv()
+	return r.err == nil
+}
+
+// Msg 返回 Next 读到的消息
+func (r *StreamReader[T]) Msg() T {
+	return r.msg
+}
+
+// Err 流正常结束的时候返回 nil
+func (r *StreamReader[T]) Err() error {
+	if r.err == io.EOF {
+		return nil
+	}
+	return r.err
+}
+
+func (*StreamReader[T]) streamKind() streamKind {
+	return serverStreaming
+}
+
+// StreamWriter 客户端发送多个请求，最后拿到一个响应
+// 客户端的字段签名是 func(ctx context.Context) (*rpc.StreamWriter[*Req, *Resp], error)
+type StreamWriter[Req, Resp any] struct {
+	ClientStream
+}
+
+func (w *StreamWriter[Req, Resp]) Send(msg Req) error {
+	return w.SendMsg(msg)
+}
+
+// CloseAndRecv 半关闭之后等待服务端的响应
+func (w *StreamWriter[Req, Resp]) CloseAndRecv() (Resp, error) {
+	var zero Resp
+	if err := w.CloseSend(); err != nil {
+		return zero, err
+	}
+	resp, err := recv[Resp](w.ClientStream)
+	if err == io.EOF {
+		// 服务端正常结束却没有返回响应
+		return zero, io.ErrUnexpectedEOF
+	}
+	return resp, err
+}
+
+func (*StreamWriter[Req, Resp]) streamKind() streamKind {
+	return clientStreaming
+}
+
+// StreamReadWriter 客户端双向流
+// 客户端的字段签名是 func(ctx context.Context) (*rpc.StreamReadWriter[*Req, *Resp], error)
+type StreamReadWriter[Req, Resp any] struct {
+	ClientStream
+}
+
+func (rw *StreamReadWriter[Req, Resp]) Send(msg Req) error {
+	return rw.SendMsg(msg)
+}
+
+// Recv 读取下一条消息，流正常结束的时候返回 io.EOF
+func (rw *StreamReadWriter[Req, Resp]) Recv() (Resp, error) {
+	return recv[Resp](rw.ClientStream)
+}
+
+func (*StreamReadWriter[Req, Resp]) streamKind() streamKind {
+	return bidiStreaming
+}
+
+// recv 创建一个 T 类型的消息，然后从 r 读取数据
+// T 在注册的时候校验过，一定是结构体指针
+func recv[T any](r interface{ RecvMsg(msg any) error }) (T, error) {
+	var msg T
+	msg = reflect.New(reflect.TypeOf(msg).Elem()).Interface().(T)
+	if err := r.RecvMsg(msg); err != nil {
+		var zero T
+		return zero, err
+	}
+	return msg, nil
+}
+
+// streamState 是两端共用的流状态：接收队列和两个方向的流控
+//
+// 发送方只有在对端给的额度大于 0 的时候才能发送数据帧，每发一个帧扣掉帧的长度，
+// 额度可以被扣成负数，所以一条比窗口还大的消息也能发出去。
+// 接收方的业务每读走一个帧就记下它的长度，攒够半个窗口之后通过 FrameWindowUpdate 还给对端。
+// 读协程只会往队列里面追加，永远不会阻塞，队列的长度由流控限制在一个窗口左右。
+// 接收方按照同样的规则记录对端剩下的额度，对端不遵守流控的时候 push 返回 false，调用方负责重置流。
+type streamState struct {
+	mu sync.Mutex
+	// frames 收到了还没有被读走的数据帧
+	frames []*message.Frame
+	// recvErr 不为 nil 说明不会再收到数据了，io.EOF 表示对端正常结束
+	recvErr error
+	// sendErr 不为 nil 说明不能再发送了
+	sendErr error
+	// sendCredit 对端还允许我们发送的字节数
+	sendCredit int64
+	// recvCredit 我们还允许对端发送的字节数，额度在还给对端的时候就加上
+	recvCredit int64
+	// window 自己的接收窗口，consumed 是已经读走但是还没有还给对端的字节数
+	window   int64
+	consumed int64
+	// recvReady 和 sendReady 分别唤醒等待接收和等待额度的调用方
+	recvReady chan struct{}
+	sendReady chan struct{}
+}
+
+func newStreamState(window uint32) *streamState {
+	return &streamState{
+		sendCredit: defaultStreamWindow,
+		// 超出默认值的部分在打开流之后马上通过 FrameWindowUpdate 给对端
+		recvCredit: int64(window),
+		window:     int64(window),
+		recvReady:  make(chan struct{}, 1),
+		sendReady:  make(chan struct{}, 1),
+	}
+}
+
+// push 读协程收到数据帧之后调用，对端在没有额度的时候还发送数据帧返回 false
+func (st *streamState) push(f *message.Frame) bool {
+	st.mu.Lock()
+	if st.recvErr != nil {
+		st.mu.Unlock()
+		return true
+	}
+	// 和 acquire 的规则一样，有额度就可以发一个帧，不管帧有多大
+	if st.recvCredit <= 0 {
+		st.mu.Unlock()
+		return false
+	}
+	st.recvCredit -= int64(f.Size())
+	st.frames = append(st.frames, f)
+	st.mu.Unlock()
+	signal(st.recvReady)
+	return true
+}
+
+// addCredit 对端归还了发送额度，加上之后超过 maxStreamWindow 说明对端不遵守流控，返回 false
+func (st *streamState) addCredit(n uint32) bool {
+	st.mu.Lock()
+	if st.sendCredit+int64(n) > maxStreamWindow {
+		st.mu.Unlock()
+		return false
+	}
+	st.sendCredit += int64(n)
+	st.mu.Unlock()
+	signal(st.sendReady)
+	return true
+}
+
+// closeRecv 不会再收到新的数据了，已经收到的还可以继续读
+func (st *streamState) closeRecv(err error) {
+	st.mu.Lock()
+	if st.recvErr == nil {
+		st.recvErr = err
+	}
+	st.mu.Unlock()
+	signal(st.recvReady)
+}
+
+func (st *streamState) closeSend(err error) {
+	st.mu.Lock()
+	if st.sendErr == nil {
+		st.sendErr = err
+	}
+	st.mu.Unlock()
+	signal(st.sendReady)
+}
+
+// abort 两个方向都结束，丢弃还没有读走的数据
+func (st *streamState) abort(err error) {
+	st.mu.Lock()
+	st.frames = nil
+	st.mu.Unlock()
+	st.closeRecv(err)
+	st.closeSend(err)
+}
+
+// recv 取出下一个数据帧，返回值 increment 大于 0 的时候需要把这么多的额度还给对端
+func (st *streamState) recv(ctx context.Context) (f *message.Frame, increment uint32, err error) {
+	for {
+		st.mu.Lock()
+		if len(st.frames) > 0 {
+			f = st.frames[0]
+			st.frames[0] = nil
+			st.frames = st.frames[1:]
+			st.consumed += int64(f.Size())
+			if st.consumed >= st.window/2 {
+				increment = uint32(st.consumed)
+				st.recvCredit += st.consumed
+				st.consumed = 0
+			}
+			st.mu.Unlock()
+			return f, increment, nil
+		}
+		err = st.recvErr
+		st.mu.Unlock()
+		if err != nil {
+			return nil, 0, err
+		}
+
+		select {
+		case <-st.recvReady:
+		case <-ctx.Done():
+			return nil, 0, ctx.Err()
+		}
+	}
+}
+
+// acquire 等到有发送额度之后扣掉 size
+func (st *streamState) acquire(ctx context.Context, size uint32) error {
+	for {
+		st.mu.Lock()
+		if st.sendErr != nil {
+			err := st.sendErr
+			st.mu.Unlock()
+			return err
+		}
+		if st.sendCredit > 0 {
+			st.sendCredit -= int64(size)
+			st.mu.Unlock()
+			return nil
+		}
+		st.mu.Unlock()
+
+		select {
+		case <-st.sendReady:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (st *streamState) sendClosed() bool {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return st.sendErr != nil
+}
+
+// signal 不阻塞地唤醒一个等待者
+func signal(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// streamWindow 窗口不能比默认值小，对端一开始就认为有这么多额度，也不能超过 maxStreamWindow
+func streamWindow(window uint32) uint32 {
+	if window < defaultStreamWindow {
+		return defaultStreamWindow
+	}
+	return min(window, maxStreamWindow)
+}
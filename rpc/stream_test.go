@@ -0,0 +1,563 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"net"
+	"self_developed_rpc/rpc/compress/gzip"
+	"self_developed_rpc/rpc/message"
+	"self_developed_rpc/rpc/serialize/json"
+	"self_developed_rpc/rpc/status"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type ListUsersReq struct {
+	Total    int
+	PageSize int
+	// FailAfter 大于 0 的时候，发送这么多页之后返回错误
+	FailAfter int
+	// Block 为 true 的时候一直等到超时
+	Block bool
+}
+
+type UserPage struct {
+	Names []string
+}
+
+type listService struct{}
+
+func (l *listService) Name() string {
+	return "list-service"
+}
+
+// ListUsers 分页推送用户
+func (l *listService) ListUsers(ctx context.Context, req *ListUsersReq, stream Stream[*UserPage]) error {
+	if req.Block {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	page := &UserPage{}
+	pages := 0
+	for i := 0; i < req.Total; i++ {
+		page.Names = append(page.Names, "user-"+strings.Repeat("x", i%3))
+		if len(page.Names) < req.PageSize && i != req.Total-1 {
+			continue
+		}
+		if err := stream.Send(page); err != nil {
+			return err
+		}
+		page = &UserPage{}
+		pages++
+		if pages == req.FailAfter {
+			return status.Errorf(status.ResourceExhausted, "too many pages")
+		}
+	}
+	return nil
+}
+
+func (l *listService) Count(ctx context.Context, req *ListUsersReq) (*UserPage, error) {
+	return &UserPage{Names: make([]string, req.Total)}, nil
+}
+
+type listClient struct {
+	ListUsers func(ctx context.Context, req *ListUsersReq) (*StreamReader[*UserPage], error)
+	Count     func(ctx context.Context, req *ListUsersReq) (*UserPage, error)
+}
+
+func (l *listClient) Name() string {
+	return "list-service"
+}
+
+type missingListClient struct {
+	ListUsers func(ctx context.Context, req *ListUsersReq) (*StreamReader[*UserPage], error)
+}
+
+func (m *missingListClient) Name() string {
+	return "missing-service"
+}
+
+// unaryListClient 把流式方法当成普通方法调用
+type unaryListClient struct {
+	ListUsers func(ctx context.Context, req *ListUsersReq) (*UserPage, error)
+}
+
+func (u *unaryListClient) Name() string {
+	return "list-service"
+}
+
+func TestServerStream(t *testing.T) {
+	server := NewServer(ServerWithCompressThreshold(10))
+	server.RegisterCompressor(&gzip.Compressor{})
+	require.NoError(t, server.RegisterService(&listService{}))
+	go func() {
+		_ = server.Start("tcp", ":8092")
+	}()
+	defer func() {
+		_ = server.Shutdown(context.Background())
+	}()
+	time.Sleep(time.Second)
+
+	client, err := NewClient("localhost:8092",
+		ClientWithCompressor(&gzip.Compressor{}), ClientWithCompressThreshold(10))
+	require.NoError(t, err)
+	defer client.Close()
+	lc := &listClient{}
+	require.NoError(t, client.InitService(lc))
+
+	testCases := []struct {
+		name    string
+		timeout time.Duration
+		req     *ListUsersReq
+
+		wantPages []int
+		wantErr   error
+	}{
+		{
+			name:      "pages",
+			req:       &ListUsersReq{Total: 7, PageSize: 3},
+			wantPages: []int{3, 3, 1},
+		},
+		{
+			name: "empty",
+			req:  &ListUsersReq{},
+		},
+		{
+			name:      "error trailer",
+			req:       &ListUsersReq{Total: 10, PageSize: 2, FailAfter: 2},
+			wantPages: []int{2, 2},
+			wantErr:   status.Errorf(status.ResourceExhausted, "too many pages"),
+		},
+		{
+			name:    "timeout",
+			timeout: time.Millisecond * 100,
+			req:     &ListUsersReq{Block: true},
+			wantErr: context.DeadlineExceeded,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := context.Background()
+			if tc.timeout > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, tc.timeout)
+				defer cancel()
+			}
+			reader, err := lc.ListUsers(ctx, tc.req)
+			require.NoError(t, err)
+			var pages []int
+			for reader.Next() {
+				pages = append(pages, len(reader.Msg().Names))
+			}
+			assert.Equal(t, tc.wantPages, pages)
+			assert.True(t, errors.Is(reader.Err(), tc.wantErr), reader.Err())
+			// 结束之后一直返回同样的结果
+			assert.False(t, reader.Next())
+		})
+	}
+
+	t.Run("recv", func(t *testing.T) {
+		reader, err := lc.ListUsers(context.Background(), &ListUsersReq{Total: 2, PageSize: 1})
+		require.NoError(t, err)
+		page, err := reader.Recv()
+		require.NoError(t, err)
+		assert.Len(t, page.Names, 1)
+		_, err = reader.Recv()
+		require.NoError(t, err)
+		_, err = reader.Recv()
+		assert.Equal(t, io.EOF, err)
+	})
+
+	t.Run("close", func(t *testing.T) {
+		reader, err := lc.ListUsers(context.Background(), &ListUsersReq{Total: 100, PageSize: 1})
+		require.NoError(t, err)
+		require.True(t, reader.Next())
+		require.NoError(t, reader.Close())
+		assert.False(t, reader.Next())
+		assert.Equal(t, errStreamClosed, reader.Err())
+		// 同一个连接上的普通调用不受影响
+		resp, err := lc.Count(context.Background(), &ListUsersReq{Total: 3})
+		require.NoError(t, err)
+		assert.Len(t, resp.Names, 3)
+	})
+
+	t.Run("service not found", func(t *testing.T) {
+		mc := &missingListClient{}
+		require.NoError(t, client.InitService(mc))
+		reader, err := mc.ListUsers(context.Background(), &ListUsersReq{Total: 1})
+		require.NoError(t, err)
+		assert.False(t, reader.Next())
+		assert.Equal(t, status.NotFound, status.Convert(reader.Err()).Code())
+	})
+
+	t.Run("unary call on stream method", func(t *testing.T) {
+		uc := &unaryListClient{}
+		require.NoError(t, client.InitService(uc))
+		_, err := uc.ListUsers(context.Background(), &ListUsersReq{Total: 1})
+		assert.Equal(t, status.Unimplemented, status.Convert(err).Code())
+	})
+}
+
+type Num struct {
+	Val int
+}
+
+type ChatMsg struct {
+	Text string
+}
+
+type FloodReq struct {
+	Count int
+	Size  int
+}
+
+type chatService struct {
+	// sent Flood 已经发出去的消息数
+	sent atomic.Int64
+	// canceled Wait 感知到 ctx 结束之后写入
+	canceled chan error
+}
+
+func (c *chatService) Name() string {
+	return "chat-service"
+}
+
+// Sum 把客户端发送的数字加起来，遇到负数返回错误
+func (c *chatService) Sum(ctx context.Context, stream RecvStream[*Num]) (*Num, error) {
+	res := &Num{}
+	for {
+		n, err := stream.Recv()
+		if err == io.EOF {
+			return res, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if n.Val < 0 {
+			return nil, status.Errorf(status.InvalidArgument, "negative")
+		}
+		res.Val += n.Val
+	}
+}
+
+// Echo 原样返回，客户端半关闭之后再发一条 bye
+func (c *chatService) Echo(ctx context.Context, stream BidiStream[*ChatMsg, *ChatMsg]) error {
+	for {
+		msg, err := stream.Recv()
+		if err == io.EOF {
+			return stream.Send(&ChatMsg{Text: "bye"})
+		}
+		if err != nil {
+			return err
+		}
+		if err = stream.Send(msg); err != nil {
+			return err
+		}
+	}
+}
+
+func (c *chatService) Wait(ctx context.Context, stream BidiStream[*ChatMsg, *ChatMsg]) error {
+	<-ctx.Done()
+	c.canceled <- ctx.Err()
+	return ctx.Err()
+}
+
+// Block 一直不读，流被重置之后返回 Recv 拿到的原因
+func (c *chatService) Block(ctx context.Context, stream BidiStream[*ChatMsg, *ChatMsg]) error {
+	<-ctx.Done()
+	_, err := stream.Recv()
+	return err
+}
+
+func (c *chatService) Flood(ctx context.Context, req *FloodReq, stream Stream[*ChatMsg]) error {
+	msg := &ChatMsg{Text: strings.Repeat("x", req.Size)}
+	for i := 0; i < req.Count; i++ {
+		if err := stream.Send(msg); err != nil {
+			return err
+		}
+		c.sent.Add(1)
+	}
+	return nil
+}
+
+type chatClient struct {
+	Sum   func(ctx context.Context) (*StreamWriter[*Num, *Num], error)
+	Echo  func(ctx context.Context) (*StreamReadWriter[*ChatMsg, *ChatMsg], error)
+	Wait  func(ctx context.Context) (*StreamReadWriter[*ChatMsg, *ChatMsg], error)
+	Flood func(ctx context.Context, req *FloodReq) (*StreamReader[*ChatMsg], error)
+}
+
+func (c *chatClient) Name() string {
+	return "chat-service"
+}
+
+func TestClientAndBidiStream(t *testing.T) {
+	service := &chatService{canceled: make(chan error, 1)}
+	server := NewServer()
+	require.NoError(t, server.RegisterService(service))
+	go func() {
+		_ = server.Start("tcp", ":8093")
+	}()
+	defer func() {
+		_ = server.Shutdown(context.Background())
+	}()
+	time.Sleep(time.Second)
+
+	client, err := NewClient("localhost:8093")
+	require.NoError(t, err)
+	defer client.Close()
+	cc := &chatClient{}
+	require.NoError(t, client.InitService(cc))
+
+	t.Run("client stream", func(t *testing.T) {
+		testCases := []struct {
+			name string
+			nums []int
+
+			wantResp *Num
+			wantErr  error
+		}{
+			{
+				name:     "sum",
+				nums:     []int{1, 2, 3, 4},
+				wantResp: &Num{Val: 10},
+			},
+			{
+				name:     "empty",
+				wantResp: &Num{},
+			},
+			{
+				name:    "error",
+				nums:    []int{1, -1},
+				wantErr: status.Errorf(status.InvalidArgument, "negative"),
+			},
+		}
+		for _, tc := range testCases {
+			t.Run(tc.name, func(t *testing.T) {
+				w, err := cc.Sum(context.Background())
+				require.NoError(t, err)
+				for _, n := range tc.nums {
+					// 服务端提前结束的时候 Send 可能返回 io.EOF，原因通过 CloseAndRecv 拿到
+					if err = w.Send(&Num{Val: n}); err != nil {
+						require.Equal(t, io.EOF, err)
+					}
+				}
+				resp, err := w.CloseAndRecv()
+				assert.Equal(t, tc.wantErr, err)
+				assert.Equal(t, tc.wantResp, resp)
+			})
+		}
+	})
+
+	t.Run("bidi half close", func(t *testing.T) {
+		rw, err := cc.Echo(context.Background())
+		require.NoError(t, err)
+		for _, text := range []string{"a", "b", "c"} {
+			require.NoError(t, rw.Send(&ChatMsg{Text: text}))
+			msg, err := rw.Recv()
+			require.NoError(t, err)
+			assert.Equal(t, text, msg.Text)
+		}
+		require.NoError(t, rw.CloseSend())
+		// 半关闭之后还能继续接收
+		msg, err := rw.Recv()
+		require.NoError(t, err)
+		assert.Equal(t, "bye", msg.Text)
+		_, err = rw.Recv()
+		assert.Equal(t, io.EOF, err)
+		assert.Equal(t, errSendClosed, rw.Send(&ChatMsg{}))
+	})
+
+	t.Run("cancel", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		_, err := cc.Wait(ctx)
+		require.NoError(t, err)
+		cancel()
+		select {
+		case err = <-service.canceled:
+			assert.Equal(t, context.Canceled, err)
+		case <-time.After(time.Second):
+			t.Fatal("服务端没有感知到取消")
+		}
+	})
+
+	t.Run("close", func(t *testing.T) {
+		rw, err := cc.Wait(context.Background())
+		require.NoError(t, err)
+		require.NoError(t, rw.Close())
+		select {
+		case err = <-service.canceled:
+			assert.Equal(t, context.Canceled, err)
+		case <-time.After(time.Second):
+			t.Fatal("服务端没有感知到取消")
+		}
+		_, err = rw.Recv()
+		assert.Equal(t, errStreamClosed, err)
+	})
+
+	t.Run("flow control", func(t *testing.T) {
+		service.sent.Store(0)
+		reader, err := cc.Flood(context.Background(), &FloodReq{Count: 100, Size: 4 << 10})
+		require.NoError(t, err)
+		time.Sleep(time.Millisecond * 200)
+		// 客户端一直没读，服务端最多发出一个窗口的数据
+		sent := service.sent.Load()
+		assert.Less(t, sent, int64(20))
+		cnt := 0
+		for reader.Next() {
+			cnt++
+		}
+		require.NoError(t, reader.Err())
+		assert.Equal(t, 100, cnt)
+	})
+
+	t.Run("message larger than window", func(t *testing.T) {
+		reader, err := cc.Flood(context.Background(), &FloodReq{Count: 2, Size: 200 << 10})
+		require.NoError(t, err)
+		cnt := 0
+		for reader.Next() {
+			assert.Len(t, reader.Msg().Text, 200<<10)
+			cnt++
+		}
+		require.NoError(t, reader.Err())
+		assert.Equal(t, 2, cnt)
+	})
+
+	t.Run("large window", func(t *testing.T) {
+		largeClient, err := NewClient("localhost:8093", ClientWithStreamWindow(1<<20))
+		require.NoError(t, err)
+		defer largeClient.Close()
+		lc := &chatClient{}
+		require.NoError(t, largeClient.InitService(lc))
+
+		service.sent.Store(0)
+		reader, err := lc.Flood(context.Background(), &FloodReq{Count: 100, Size: 4 << 10})
+		require.NoError(t, err)
+		// 窗口足够大，不读也能全部发出去
+		assert.Eventually(t, func() bool {
+			return service.sent.Load() == 100
+		}, time.Second, time.Millisecond*10)
+		require.NoError(t, reader.Close())
+	})
+}
+
+func TestStreamStateFlowControl(t *testing.T) {
+	st := newStreamState(defaultStreamWindow)
+	frame := func(size int) *message.Frame {
+		f := &message.Frame{Type: message.FrameData, Data: make([]byte, size)}
+		f.SetHeadLength()
+		f.SetBodyLength()
+		return f
+	}
+	// 还有额度的时候一个比窗口还大的帧也能收
+	assert.True(t, st.push(frame(1)))
+	assert.True(t, st.push(frame(defaultStreamWindow)))
+	// 额度用完了还发就是对端不遵守流控
+	assert.False(t, st.push(frame(1)))
+
+	// 读走之后还给对端的额度可以继续用
+	for i := 0; i < 2; i++ {
+		_, _, err := st.recv(context.Background())
+		require.NoError(t, err)
+	}
+	assert.True(t, st.push(frame(1)))
+
+	assert.True(t, st.addCredit(maxStreamWindow-defaultStreamWindow))
+	assert.False(t, st.addCredit(1))
+}
+
+// writeRawFrames 模拟不遵守流控的对端，不管额度直接写数据帧
+func writeRawFrames(conn net.Conn, streamId uint32, count, size int) error {
+	for i := 0; i < count; i++ {
+		f := &message.Frame{
+			StreamId:   streamId,
+			Type:       message.FrameData,
+			Serializer: 1,
+			Data:       []byte(`{"Text":"` + strings.Repeat("x", size) + `"}`),
+		}
+		f.SetHeadLength()
+		f.SetBodyLength()
+		if _, err := conn.Write(message.EncodeFrame(f)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readRawFrame 跳过其它帧，读到 typ 类型的帧为止
+func readRawFrame(t *testing.T, conn net.Conn, typ message.FrameType) *message.Frame {
+	for {
+		data, err := ReadMsg(conn, 0)
+		require.NoError(t, err)
+		require.True(t, message.IsFrame(data))
+		f, err := message.DecodeFrame(data)
+		require.NoError(t, err)
+		if f.Type == typ {
+			return f
+		}
+	}
+}
+
+func TestServeStreamIgnoreWindow(t *testing.T) {
+	server := NewServer()
+	require.NoError(t, server.RegisterService(&chatService{}))
+	client, conn := net.Pipe()
+	defer client.Close()
+	go func() {
+		_ = server.handleConn(&serverConn{conn: conn, streams: make(map[uint32]*serverStream)})
+	}()
+
+	req := &message.Request{
+		MessageId:   1,
+		Serializer:  1,
+		ServiceName: "chat-service",
+		MethodName:  "Block",
+		Meta:        map[string]string{"stream": bidiStreaming.String()},
+	}
+	req.SetHeadLength()
+	req.SetBodyLength()
+	_, err := client.Write(message.EncodeReq(req))
+	require.NoError(t, err)
+	// 服务端一直不读，客户端发出去的数据远远超过一个窗口
+	require.NoError(t, writeRawFrames(client, 1, 20, 8<<10))
+
+	end := readRawFrame(t, client, message.FrameEnd)
+	assert.Equal(t, uint32(1), end.StreamId)
+	assert.Equal(t, status.ResourceExhausted, status.Unmarshal(end.Error).Code())
+}
+
+func TestClientStreamIgnoreWindow(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	cc := newClientConn(client, 0)
+	cs := &clientStream{
+		streamState: newStreamState(defaultStreamWindow),
+		ctx:         context.Background(),
+		c:           &Client{serializer: &json.Serializer{}},
+		cc:          cc,
+		id:          1,
+		stop:        func() bool { return true },
+	}
+	cc.mu.Lock()
+	cc.streams[cs.id] = cs
+	cc.mu.Unlock()
+
+	// 客户端一直不读，服务端发出去的数据远远超过一个窗口
+	go func() {
+		_ = writeRawFrames(server, cs.id, 20, 8<<10)
+	}()
+	f := readRawFrame(t, server, message.FrameCancel)
+	assert.Equal(t, cs.id, f.StreamId)
+
+	err := cs.RecvMsg(&ChatMsg{})
+	assert.Equal(t, status.ResourceExhausted, status.Convert(err).Code())
+	cc.mu.Lock()
+	assert.NotContains(t, cc.streams, cs.id)
+	cc.mu.Unlock()
+}
@@ -0,0 +1,157 @@
+package rpc
+
+import (
+	"context"
+	"self_developed_rpc/rpc/breaker"
+	"self_developed_rpc/rpc/status"
+	"sync"
+	"sync/atomic"
+)
+
+// subConn 客户端到一个实例的子连接，实现了 balancer.Endpoint
+// 同一个实例的调用复用一个连接，连接断开之后下一次选中的时候再重新建立
+type subConn struct {
+	c        *Client
+	addr     string
+	weight   atomic.Uint32
+	inFlight atomic.Int64
+
+	mu sync.Mutex
+	cc *clientConn
+	// dialing 正在建立的连接，为 nil 说明没有在建立连接
+	dialing *dialCall
+	// removed 为 true 说明实例已经下线或者客户端已经关闭，不能再建立连接
+	removed bool
+	// breakers 这个实例上每个方法的熔断器，key 是服务名/方法名，值是 *breaker.Breaker
+	breakers sync.Map
+}
+
+// dialCall 一次建立连接的过程，同时需要连接的调用方都等它，done 关闭之后才能读 cc 和 err
+type dialCall struct {
+	done   chan struct{}
+	cancel context.CancelFunc
+	cc     *clientConn
+	err    error
+}
+
+func newSubConn(c *Client, addr string) *subConn {
+	return &subConn{c: c, addr: addr}
+}
+
+func (sc *subConn) Addr() string {
+	return sc.addr
+}
+
+func (sc *subConn) Weight() uint32 {
+	return sc.weight.Load()
+}
+
+func (sc *subConn) InFlight() int64 {
+	return sc.inFlight.Load()
+}
+
+// setWeight 0 当成 1
+func (sc *subConn) setWeight(weight uint32) {
+	sc.weight.Store(max(weight, 1))
+}
+
+// conn 返回可用的连接，没有的话建立一个，ctx 结束的时候不再等待
+// 建立连接的时候不持有 sc.mu，同一个实例同时只会建立一个连接
+func (sc *subConn) conn(ctx context.Context) (*clientConn, error) {
+	sc.mu.Lock()
+	if sc.removed {
+		sc.mu.Unlock()
+		return nil, sc.removedErr()
+	}
+	if sc.cc != nil && sc.cc.available() {
+		cc := sc.cc
+		sc.mu.Unlock()
+		return cc, nil
+	}
+	call := sc.dialing
+	if call == nil {
+		// 连接是大家共用的，不能因为发起的调用方放弃了就中断，dial 自己有超时时间
+		dialCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+		call = &dialCall{done: make(chan struct{}), cancel: cancel}
+		sc.dialing = call
+		go sc.dial(dialCtx, call)
+	}
+	sc.mu.Unlock()
+
+	select {
+	case <-call.done:
+		return call.cc, call.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// dial 建立连接之后唤醒所有等待的调用方，这期间实例下线了的话关掉新建立的连接
+func (sc *subConn) dial(ctx context.Context, call *dialCall) {
+	defer call.cancel()
+	cc, err := sc.c.dial(ctx, sc.addr)
+	sc.mu.Lock()
+	sc.dialing = nil
+	if sc.removed {
+		if cc != nil {
+			cc.close(errConnClosed)
+		}
+		cc, err = nil, sc.removedErr()
+	} else if err == nil {
+		sc.cc = cc
+	}
+	sc.mu.Unlock()
+	call.cc, call.err = cc, err
+	close(call.done)
+}
+
+func (sc *subConn) removedErr() error {
+	return status.Errorf(status.Unavailable, "rpc: 实例 %s 已经下线", sc.addr)
+}
+
+// drain 实例下线了，连接上还没结束的调用和流结束之后再关闭
+func (sc *subConn) drain() {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	sc.removeLocked()
+	if sc.cc != nil {
+		sc.cc.drain()
+	}
+}
+
+func (sc *subConn) close(err error) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	sc.removeLocked()
+	if sc.cc != nil {
+		sc.cc.close(err)
+	}
+}
+
+// removeLocked 不再建立新的连接，正在建立的也放弃
+func (sc *subConn) removeLocked() {
+	sc.removed = true
+	if sc.dialing != nil {
+		sc.dialing.cancel()
+	}
+}
+
+// breakerOf 返回这个实例上 serviceName.methodName 的熔断器，客户端没有开启熔断的时候返回 nil
+func (sc *subConn) breakerOf(serviceName, methodName string) *breaker.Breaker {
+	cfg := sc.c.breakerConfig
+	if cfg == nil {
+		return nil
+	}
+	key := serviceName + "/" + methodName
+	if b, ok := sc.breakers.Load(key); ok {
+		return b.(*breaker.Breaker)
+	}
+	var onStateChange func(from, to breaker.State)
+	if fn := sc.c.onBreakerStateChange; fn != nil {
+		onStateChange = func(from, to breaker.State) {
+			fn(sc.addr, serviceName, methodName, from, to)
+		}
+	}
+	b, _ := sc.breakers.LoadOrStore(key, breaker.New(*cfg, onStateChange))
+	return b.(*breaker.Breaker)
+}
@@ -2,26 +2,68 @@ package rpc
 
 import (
 	"encoding/binary"
-	"net"
+	"errors"
+	"fmt"
+	"io"
 )
 
 const numOfLengthBytes = 8
 
-func ReadMsg(conn net.Conn) ([]byte, error) {
+// minFrameLength 头部固定部分的长度：两个长度字段、MessageId、版本、压缩算法、序列化方法
+const minFrameLength = 15
+
+// defaultMaxFrameSize 默认一个帧最大 4MB
+const defaultMaxFrameSize = 4 << 20
+
+var (
+	ErrFrameTooLarge  = errors.New("rpc: 帧超过了最大长度")
+	ErrMalformedFrame = errors.New("rpc: 非法的帧")
+)
+
+// FrameError 读取到了超长或者非法的帧，连接上的数据已经不可信，必须关闭连接
+type FrameError struct {
+	HeadLength uint32
+	BodyLength uint32
+	Err        error
+}
+
+func (e *FrameError) Error() string {
+	return fmt.Sprintf("%s, head length: %d, body length: %d", e.Err, e.HeadLength, e.BodyLength)
+}
+
+func (e *FrameError) Unwrap() error {
+	return e.Err
+}
+
+// ReadMsg 读取一个完整的帧，r 最好是带缓冲的
+// maxFrameSize 为 0 的时候不限制帧的长度
+func ReadMsg(r io.Reader, maxFrameSize uint32) ([]byte, error) {
 	lengthByte := make([]byte, numOfLengthBytes)
-	_, err := conn.Read(lengthByte)
+	// 一次 Read 不一定能读满，必须用 ReadFull
+	_, err := io.ReadFull(r, lengthByte)
 	if err != nil {
 		return nil, err
 	}
 	headerLength := binary.BigEndian.Uint32(lengthByte[:4])
 	bodyLength := binary.BigEndian.Uint32(lengthByte[4:8])
-	length := headerLength + bodyLength
+	if headerLength < minFrameLength {
+		return nil, &FrameError{HeadLength: headerLength, BodyLength: bodyLength, Err: ErrMalformedFrame}
+	}
+	// 用 uint64 计算，避免溢出
+	length := uint64(headerLength) + uint64(bodyLength)
+	if maxFrameSize > 0 && length > uint64(maxFrameSize) {
+		return nil, &FrameError{HeadLength: headerLength, BodyLength: bodyLength, Err: ErrFrameTooLarge}
+	}
 
 	data := make([]byte, length)
-	_, err = conn.Read(data[8:])
+	_, err = io.ReadFull(r, data[numOfLengthBytes:])
 	if err != nil {
+		if err == io.EOF {
+			// 读到一半连接断开了
+			err = io.ErrUnexpectedEOF
+		}
 		return nil, err
 	}
-	copy(data[:8], lengthByte)
+	copy(data[:numOfLengthBytes], lengthByte)
 	return data, err
 }
@@ -0,0 +1,109 @@
+package rpc
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"self_developed_rpc/rpc/message"
+	"testing"
+	"testing/iotest"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadMsg(t *testing.T) {
+	req := &message.Request{
+		MessageId:   1,
+		ServiceName: "user-service",
+		MethodName:  "GetById",
+		Data:        []byte("hello, world"),
+	}
+	req.SetHeadLength()
+	req.SetBodyLength()
+	frame := message.EncodeReq(req)
+
+	lengthPrefix := func(head, body uint32) []byte {
+		bs := make([]byte, 8)
+		binary.BigEndian.PutUint32(bs[:4], head)
+		binary.BigEndian.PutUint32(bs[4:], body)
+		return bs
+	}
+
+	testCases := []struct {
+		name         string
+		reader       io.Reader
+		maxFrameSize uint32
+
+		wantData []byte
+		wantErr  error
+	}{
+		{
+			name:     "partial read",
+			reader:   iotest.OneByteReader(bytes.NewReader(frame)),
+			wantData: frame,
+		},
+		{
+			name:         "too large",
+			reader:       bytes.NewReader(frame),
+			maxFrameSize: uint32(len(frame) - 1),
+			wantErr:      ErrFrameTooLarge,
+		},
+		{
+			name:         "overflow",
+			reader:       bytes.NewReader(lengthPrefix(1<<32-1, 1<<32-1)),
+			maxFrameSize: defaultMaxFrameSize,
+			wantErr:      ErrFrameTooLarge,
+		},
+		{
+			name:    "malformed",
+			reader:  bytes.NewReader(lengthPrefix(3, 0)),
+			wantErr: ErrMalformedFrame,
+		},
+		{
+			name:    "truncated",
+			reader:  bytes.NewReader(frame[:len(frame)-1]),
+			wantErr: io.ErrUnexpectedEOF,
+		},
+		{
+			name:    "empty",
+			reader:  bytes.NewReader(nil),
+			wantErr: io.EOF,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			data, err := ReadMsg(tc.reader, tc.maxFrameSize)
+			assert.True(t, errors.Is(err, tc.wantErr), "unexpected error %v", err)
+			assert.Equal(t, tc.wantData, data)
+		})
+	}
+}
+
+func TestServeCloseOnLargeFrame(t *testing.T) {
+	server := NewServer(ServerWithMaxFrameSize(64))
+	client, conn := net.Pipe()
+	defer client.Close()
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- server.handleConn(&serverConn{conn: conn})
+	}()
+
+	req := &message.Request{
+		MessageId:   1,
+		ServiceName: "user-service",
+		MethodName:  "GetById",
+		Data:        make([]byte, 128),
+	}
+	req.SetHeadLength()
+	req.SetBodyLength()
+	go func() {
+		_, _ = client.Write(message.EncodeReq(req))
+	}()
+	var fe *FrameError
+	require.True(t, errors.As(<-errCh, &fe))
+	assert.Equal(t, ErrFrameTooLarge, fe.Err)
+}
@@ -9,6 +9,13 @@ type Service interface {
 	Name() string
 }
 
+// Dispatcher 按方法名把请求分发给业务方法，一般由 rpcgen 生成
+// decode 把请求数据反序列化到传入的指针里，返回的响应为 nil 的时候不会序列化
+type Dispatcher interface {
+	Service
+	Dispatch(ctx context.Context, methodName string, decode func(req any) error) (any, error)
+}
+
 type Proxy interface {
 	Invoke(ctx context.Context, req *message.Request) (*message.Response, error)
 }
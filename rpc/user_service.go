@@ -6,6 +6,8 @@ import (
 	"self_developed_rpc/rpc/proto/gen"
 )
 
+//go:generate go run ./cmd/rpcgen -type UserServiceServer
+
 type UserService struct {
 	// 用反射来赋值
 	// 类型是函数的字段，它不是方法（它不是定义在 UserService 上的方法）
@@ -20,7 +22,8 @@ func (u UserService) Name() string {
 }
 
 type GetByIdReq struct {
-	Id int
+	// 同一个 Id 的请求落到同一个实例上，配合 balancer.ConsistentHash 使用
+	Id int `rpc:"hashkey"`
 }
 
 type GetByIdResp struct {
@@ -0,0 +1,77 @@
+// Code generated by rpcgen. DO NOT EDIT.
+
+package rpc
+
+import (
+	"context"
+	"self_developed_rpc/rpc/proto/gen"
+	"self_developed_rpc/rpc/status"
+)
+
+// UserServiceClient 是 user-service 的客户端
+type UserServiceClient struct {
+	client *Client
+}
+
+func NewUserServiceClient(client *Client) *UserServiceClient {
+	return &UserServiceClient{client: client}
+}
+
+func (c *UserServiceClient) Name() string {
+	return "user-service"
+}
+
+func (c *UserServiceClient) GetById(ctx context.Context, req *GetByIdReq) (*GetByIdResp, error) {
+	resp := &GetByIdResp{}
+	err := c.client.Call(ctx, "user-service", "GetById", req, resp)
+	return resp, err
+}
+
+func (c *UserServiceClient) GetByIdProto(ctx context.Context, req *gen.GetByIdReq) (*gen.GetByIdResp, error) {
+	resp := &gen.GetByIdResp{}
+	err := c.client.Call(ctx, "user-service", "GetByIdProto", req, resp)
+	return resp, err
+}
+
+// UserServiceDispatcher 把 user-service 的请求分发给 UserServiceServer
+// 通过 Serve.RegisterDispatcher 注册
+type UserServiceDispatcher struct {
+	impl *UserServiceServer
+}
+
+var _ Dispatcher = (*UserServiceDispatcher)(nil)
+
+func NewUserServiceDispatcher(impl *UserServiceServer) *UserServiceDispatcher {
+	return &UserServiceDispatcher{impl: impl}
+}
+
+func (d *UserServiceDispatcher) Name() string {
+	return "user-service"
+}
+
+func (d *UserServiceDispatcher) Dispatch(ctx context.Context, methodName string, decode func(req any) error) (any, error) {
+	switch methodName {
+	case "GetById":
+		req := &GetByIdReq{}
+		if err := decode(req); err != nil {
+			return nil, err
+		}
+		resp, err := d.impl.GetById(ctx, req)
+		if resp == nil {
+			return nil, err
+		}
+		return resp, err
+	case "GetByIdProto":
+		req := &gen.GetByIdReq{}
+		if err := decode(req); err != nil {
+			return nil, err
+		}
+		resp, err := d.impl.GetByIdProto(ctx, req)
+		if resp == nil {
+			return nil, err
+		}
+		return resp, err
+	default:
+		return nil, status.Errorf(status.Unimplemented, "micro: 服务 %s 没有方法 %s", "user-service", methodName)
+	}
+}